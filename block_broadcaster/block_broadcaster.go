@@ -1,14 +1,17 @@
 package bb
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"nano-pp/logging"
+	"nano-pp/metrics"
 	structs "nano-pp/paymentstructs"
-	"os"
-	"os/signal"
+	"nano-pp/store"
+	"sync"
+	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"github.com/sacOO7/gowebsocket"
 )
 
@@ -40,48 +43,129 @@ type Block struct {
 	Subtype        string `json:"subtype"`
 }
 
-//BlockBroadcaster listens to a webhook and broadcasts the blocks
-func BlockBroadcaster() {
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+//reconnectDelay is the wait before reconnecting after the websocket drops
+const reconnectDelay = 5 * time.Second
 
-	config := structs.LoadConfig()
-	fmt.Println("websocket host:", config.NanoWebsocketHost)
-	fmt.Println("websocket port:", config.NanoWebsocketPort)
+//ConnectionState tracks whether the websocket is connected and since when
+type ConnectionState struct {
+	mu        sync.Mutex
+	connected bool
+	since     time.Time
+}
+
+//NewConnectionState returns a disconnected state starting now.
+func NewConnectionState() *ConnectionState {
+	return &ConnectionState{since: time.Now()}
+}
 
-	socket := gowebsocket.New(fmt.Sprintf("%s:%s", config.NanoWebsocketHost, config.NanoWebsocketPort))
-	c, err := redis.Dial("tcp", fmt.Sprintf("%s:%s", config.RedisHost, config.RedisPort))
-	if err != nil {
-		fmt.Println("Error connecting to redis for Block Broadcaster:", err)
+//SetConnected records a change of connection, keeping the time of the last change.
+func (s *ConnectionState) SetConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connected != connected {
+		s.connected = connected
+		s.since = time.Now()
 	}
-	defer c.Close()
+}
+
+//Connected returns whether the websocket is connected and the time it connected or disconnected.
+func (s *ConnectionState) Connected() (bool, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected, s.since
+}
+
+//BlockBroadcaster listens to a webhook and broadcasts the blocks until stop is closed.  The websocket is
+//reconnected whenever it drops or fails to connect, and the connection is recorded in the state.  With
+//websocket_record set, every frame is also written to the rotating recording for Replay.
+func BlockBroadcaster(st store.Store, config structs.Config, logger *slog.Logger, state *ConnectionState, stop <-chan struct{}) {
+	url := fmt.Sprintf("%s:%s", config.NanoWebsocketHost, config.NanoWebsocketPort)
+	logger = logger.With("websocket", url)
+
+	var recorder *Recorder
+	if config.WebsocketRecord != "" {
+		var err error
+		recorder, err = NewRecorder(config.WebsocketRecord, int64(config.WebsocketRecordMaxBytes), config.WebsocketRecordBackups)
+		if err != nil {
+			logger.Error("error starting the websocket recording", "error", err)
+		} else {
+			logger.Info("recording websocket frames", "path", config.WebsocketRecord)
+			defer recorder.Close()
+		}
+	}
+
+	socket := gowebsocket.New(url)
 
 	socket.OnConnected = func(socket gowebsocket.Socket) {
-		log.Println("Connected to nano websocket")
+		logger.Info("connected to nano websocket")
+		state.SetConnected(true)
 		data := map[string]string{"action": "subscribe", "topic": "confirmation"}
 		dataJSON, _ := json.Marshal(data)
 		socket.SendBinary(dataJSON)
 	}
 
+	// Signalled by the callbacks when the connection is lost
+	disconnected := make(chan struct{}, 1)
+	signalDisconnect := func() {
+		select {
+		case disconnected <- struct{}{}:
+		default:
+		}
+	}
+
 	socket.OnTextMessage = func(message string, socket gowebsocket.Socket) {
-		_, err := c.Do("PUBLISH", "nano-websocket-confirmations", string(message))
+		metrics.WebsocketMessages.Inc()
+		if recorder != nil {
+			if err := recorder.Record(time.Now(), message); err != nil {
+				logger.Error("error recording websocket frame", "error", err)
+			}
+		}
+		err := st.Append(store.ConfirmationStream, message)
 		if err != nil {
-			log.Println("error in publishing:", err)
+			logger.Error("error publishing confirmation", "error", err)
+			return
+		}
+		if logger.Enabled(context.Background(), slog.LevelDebug) {
+			var confirmation WebsocketMessage
+			json.Unmarshal([]byte(message), &confirmation)
+			logger.Debug("confirmation published",
+				logging.DestinationAddress, confirmation.Message.Block.LinkAsAccount,
+				logging.Hash, confirmation.Message.Hash,
+				"stream", store.ConfirmationStream)
 		}
-		log.Println("block published to nano-websocket-confirmations")
 	}
 
 	socket.OnConnectError = func(err error, socket gowebsocket.Socket) {
-		fmt.Println("Error connecting to websocket:", err)
+		logger.Error("error connecting to websocket", "error", err)
+		state.SetConnected(false)
+		signalDisconnect()
+	}
+
+	socket.OnDisconnected = func(err error, socket gowebsocket.Socket) {
+		logger.Warn("disconnected from websocket", "error", err)
+		state.SetConnected(false)
+		signalDisconnect()
 	}
 
 	socket.Connect()
 
 	for {
 		select {
-		case <-interrupt:
-			log.Println("Disconnecting from websocket.")
+		case <-stop:
+			logger.Info("disconnecting from websocket")
+			socket.Close()
+			state.SetConnected(false)
+			return
+		case <-disconnected:
+		}
+
+		select {
+		case <-stop:
 			return
+		case <-time.After(reconnectDelay):
 		}
+		logger.Info("reconnecting to nano websocket")
+		metrics.WebsocketReconnects.Inc()
+		socket.Connect()
 	}
 }
@@ -0,0 +1,154 @@
+package bb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"nano-pp/store"
+	"os"
+	"sync"
+	"time"
+)
+
+//Frame is a raw websocket frame and the time it was received, recorded as one JSON line
+type Frame struct {
+	Time time.Time `json:"time"`
+	Data string    `json:"data"`
+}
+
+//Recorder writes websocket frames to a file.  The file is rotated before it grows past maxBytes, keeping
+//the previous files as path.1 (the newest) to path.<backups>.
+type Recorder struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+//NewRecorder opens the recording at path, appending to it if it exists.
+func NewRecorder(path string, maxBytes int64, backups int) (*Recorder, error) {
+	r := &Recorder{path: path, maxBytes: maxBytes, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening websocket recording: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening websocket recording: %v", err)
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+//Record writes a frame received at the provided time.
+func (r *Recorder) Record(received time.Time, data string) error {
+	line, err := json.Marshal(Frame{Time: received, Data: data})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return fmt.Errorf("websocket recording is closed")
+	}
+	if r.size > 0 && r.size+int64(len(line)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+//rotate shifts the backups up by one, dropping the oldest, and starts a new file.
+func (r *Recorder) rotate() error {
+	r.file.Close()
+	r.file = nil
+
+	if r.backups == 0 {
+		os.Remove(r.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.backups))
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fmt.Errorf("error rotating websocket recording: %v", err)
+		}
+	}
+	return r.open()
+}
+
+//Close closes the recording.  Frames recorded afterwards return an error.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+//Replay appends the frames recorded at path to the confirmation stream, as the broadcaster did when they
+//were received.  The gaps between frames are divided by speed, so 1 keeps the original timing and 0 replays
+//as fast as possible.  It stops early when stop is closed and returns the number of frames replayed.
+func Replay(st store.Store, logger *slog.Logger, path string, speed float64, stop <-chan struct{}) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error opening websocket recording: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	replayed := 0
+	var previous time.Time
+	for scanner.Scan() {
+		var frame Frame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return replayed, fmt.Errorf("error reading frame %d of %s: %v", replayed+1, path, err)
+		}
+
+		if speed > 0 && !previous.IsZero() && frame.Time.After(previous) {
+			select {
+			case <-stop:
+				return replayed, nil
+			case <-time.After(time.Duration(float64(frame.Time.Sub(previous)) / speed)):
+			}
+		}
+		previous = frame.Time
+
+		select {
+		case <-stop:
+			return replayed, nil
+		default:
+		}
+		if err := st.Append(store.ConfirmationStream, frame.Data); err != nil {
+			return replayed, fmt.Errorf("error replaying frame %d of %s: %v", replayed+1, path, err)
+		}
+		replayed++
+		logger.Debug("replayed websocket frame", "recorded", frame.Time, "stream", store.ConfirmationStream)
+	}
+	if err := scanner.Err(); err != nil {
+		return replayed, fmt.Errorf("error reading websocket recording: %v", err)
+	}
+	return replayed, nil
+}
@@ -0,0 +1,76 @@
+package bb
+
+import (
+	"fmt"
+	"log/slog"
+	"nano-pp/store"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorderRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "websocket.jsonl")
+	recorder, err := NewRecorder(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := recorder.Record(start, fmt.Sprintf(`{"topic":"confirmation","frame":%d}`, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing %s: %v", name, err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s is %d bytes, over the 200 byte limit", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 backups")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "websocket.jsonl")
+	recorder, err := NewRecorder(path, 1<<20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	frames := []string{`{"frame":1}`, `{"frame":2}`, `{"frame":3}`}
+	for i, frame := range frames {
+		recorder.Record(start.Add(time.Duration(i)*time.Second), frame)
+	}
+	recorder.Close()
+
+	st := store.NewMemory()
+	sub, _ := st.Follow(store.ConfirmationStream, slog.Default())
+	defer sub.Close()
+
+	// Two seconds of recording at twenty times the speed
+	began := time.Now()
+	replayed, err := Replay(st, slog.Default(), path, 20, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("replay took %v want about 100ms", elapsed)
+	}
+	if replayed != len(frames) {
+		t.Errorf("got %d frames replayed want %d", replayed, len(frames))
+	}
+	for _, frame := range frames {
+		if message := <-sub.Messages(); message.Payload != frame {
+			t.Errorf("got frame '%s' want '%s'", message.Payload, frame)
+		}
+	}
+}
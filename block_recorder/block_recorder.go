@@ -2,41 +2,32 @@ package br
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	nano "nano-pp/nanocurrency"
 	nanostructs "nano-pp/nanocurrency/nanostructs"
-	structs "nano-pp/paymentstructs"
-	"os"
-	"os/signal"
+	"nano-pp/store"
 	"strings"
-
-	"github.com/gomodule/redigo/redis"
 )
 
 //BlockRecorder will retrieve the most recently confirmed block hashes and pending block hashes for
-//a provided account and save them in a redis set for reference
-func BlockRecorder(pool *redis.Pool, destinationAccount string) {
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-
-	config := structs.LoadConfig()
-
-	rpc := nanostructs.NanoRPC{Host: config.RPCHost, Port: config.RPCPort}
-
-	c := pool.Get()
-
-	c.Do("DEL", fmt.Sprintf("known_pending/%s", destinationAccount))
+//a provided account and save them in the store for reference.  They are recorded for the worker's
+//request only, so other requests to the account keep theirs.  The logger should carry the
+//correlation fields of the payment request the blocks are recorded for.
+func BlockRecorder(st store.Store, rpc nanostructs.NanoRPC, logger *slog.Logger, destinationAccount string, workerID string) {
+	if err := st.ResetKnownHashes(destinationAccount, workerID); err != nil {
+		logger.Error("error clearing known hashes", "error", err)
+	}
 
 	optionalHistory := map[string]string{"raw": "true"}
 	accountHistoryresponse, accountErr := nano.AccountHistory(rpc, destinationAccount, "1000", optionalHistory)
 	if accountErr != nil {
-		fmt.Printf("Error retrieving account history: %v", accountErr)
+		logger.Error("error retrieving account history", "error", accountErr)
 	}
 
 	optionalPending := map[string]string{"include_active": "true"}
 	pendingResponse, pendingErr := nano.Pending(rpc, destinationAccount, optionalPending)
 	if pendingErr != nil {
-		fmt.Printf("Error retrieving pending blocks: %v", pendingErr)
+		logger.Error("error retrieving pending blocks", "error", pendingErr)
 	}
 
 	var accountHistory nanostructs.AccountHistoryReturnRaw
@@ -47,21 +38,22 @@ func BlockRecorder(pool *redis.Pool, destinationAccount string) {
 	d = json.NewDecoder(strings.NewReader(string(pendingResponse)))
 	d.Decode(&pending)
 
+	known := make([]string, 0, len(accountHistory.HistoryCollection)+len(pending.Blocks))
 	for _, v := range accountHistory.HistoryCollection {
 		if v.Subtype == "receive" {
 			// For receive blocks, use the Link field as this is the hash
 			// of the send transaction to match what we are tracking on
 			// incoming blocks
-			c.Do("SADD", fmt.Sprintf("known_pending/%s", destinationAccount), v.Link)
+			known = append(known, v.Link)
 		} else {
-			c.Do("SADD", fmt.Sprintf("known_pending/%s", destinationAccount), v.Hash)
+			known = append(known, v.Hash)
 		}
 	}
-	for _, v := range pending.Blocks {
-		// Pending blocks will always be of type Send, so we don't need to use the Link field
-		_, saddErr := c.Do("SADD", fmt.Sprintf("known_pending/%s", destinationAccount), v)
-		if saddErr != nil {
-			fmt.Println("error adding to redis:", saddErr)
-		}
+	// Pending blocks will always be of type Send, so we don't need to use the Link field
+	known = append(known, pending.Blocks...)
+
+	if err := st.AddKnownHashes(destinationAccount, workerID, known...); err != nil {
+		logger.Error("error adding known hashes to the store", "error", err)
 	}
+	logger.Debug("recorded known blocks", "count", len(known))
 }
@@ -0,0 +1,255 @@
+//Package codec encodes the payment requests, acknowledgements and payment events carried by the queue,
+//pub/sub channels and event streams.  The format written is chosen by config, and every payload is
+//decoded by the format it is marked with, so producers on either format can share the queue and channels
+//during a migration.
+//
+//A protobuf payload starts with the marker byte 0x00 followed by its content type byte, which can't begin
+//a JSON document.  JSON payloads are left unmarked, their leading '{' tells them apart, so consumers
+//predating the marker still read them.
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"nano-pp/paymentpb"
+	structs "nano-pp/paymentstructs"
+
+	"google.golang.org/protobuf/proto"
+)
+
+//The content types a payload can be marked with
+const (
+	ContentJSON     = "application/json"
+	ContentProtobuf = "application/x-protobuf"
+)
+
+//marker starts every marked payload and protobufType follows it for protobuf payloads
+const (
+	marker       = 0x00
+	protobufType = 0x01
+)
+
+//Codec encodes the payment messages in one wire format
+type Codec interface {
+	// ContentType names the format the payloads are written in
+	ContentType() string
+	EncodePaymentRequest(request structs.PaymentRequest) (string, error)
+	EncodeAck(ack structs.Ack) (string, error)
+	EncodePayment(payment structs.Payment) (string, error)
+}
+
+//New returns the codec for a wire_format setting, "json" or "protobuf"
+func New(format string) (Codec, error) {
+	switch format {
+	case "", "json":
+		return JSON{}, nil
+	case "protobuf":
+		return Protobuf{}, nil
+	}
+	return nil, fmt.Errorf("unknown wire format %q, want json or protobuf", format)
+}
+
+//For returns the codec for a validated wire_format setting, falling back to JSON
+func For(format string) Codec {
+	c, err := New(format)
+	if err != nil {
+		return JSON{}
+	}
+	return c
+}
+
+//ContentType returns the content type a payload is marked with
+func ContentType(payload string) (string, error) {
+	if len(payload) == 0 || payload[0] != marker {
+		return ContentJSON, nil
+	}
+	if len(payload) > 1 && payload[1] == protobufType {
+		return ContentProtobuf, nil
+	}
+	return "", fmt.Errorf("unknown content type marker in payload")
+}
+
+//JSON writes the payloads as the JSON documents the processor has always used
+type JSON struct{}
+
+func (JSON) ContentType() string { return ContentJSON }
+
+func (JSON) EncodePaymentRequest(request structs.PaymentRequest) (string, error) {
+	return encodeJSON(request)
+}
+
+func (JSON) EncodeAck(ack structs.Ack) (string, error) {
+	return encodeJSON(ack)
+}
+
+func (JSON) EncodePayment(payment structs.Payment) (string, error) {
+	return encodeJSON(payment)
+}
+
+func encodeJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+//Protobuf writes the payloads as the paymentpb messages of the processor steps doc, behind the marker
+type Protobuf struct{}
+
+func (Protobuf) ContentType() string { return ContentProtobuf }
+
+func (Protobuf) EncodePaymentRequest(request structs.PaymentRequest) (string, error) {
+	return encodeProtobuf(PaymentRequestProto(request))
+}
+
+func (Protobuf) EncodeAck(ack structs.Ack) (string, error) {
+	return encodeProtobuf(&paymentpb.PaymentAck{
+		DestinationAddress: ack.DestinationAddress,
+		ExpectedAmount:     ack.ExpectedAmount,
+		WorkerId:           ack.WorkerID,
+		Token:              ack.Token,
+		PaymentUri:         ack.PaymentURI,
+		FiatAmount:         ack.FiatAmount,
+		Currency:           ack.Currency,
+		Rate:               ack.Rate,
+		Error:              ack.Error,
+		RequestedAmount:    ack.RequestedAmount,
+		RequestId:          ack.RequestID,
+	})
+}
+
+func (Protobuf) EncodePayment(payment structs.Payment) (string, error) {
+	return encodeProtobuf(PaymentProto(payment))
+}
+
+func encodeProtobuf(m proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{}.MarshalAppend([]byte{marker, protobufType}, m)
+	return string(data), err
+}
+
+//decode reads a payload into the JSON value or, for protobuf payloads, the message m, reporting which
+//one was read
+func decode(payload string, v interface{}, m proto.Message) (bool, error) {
+	contentType, err := ContentType(payload)
+	if err != nil {
+		return false, err
+	}
+	if contentType == ContentProtobuf {
+		return true, proto.Unmarshal([]byte(payload[2:]), m)
+	}
+	return false, json.Unmarshal([]byte(payload), v)
+}
+
+//DecodePaymentRequest reads a payment request in either format
+func DecodePaymentRequest(payload string) (structs.PaymentRequest, error) {
+	var request structs.PaymentRequest
+	var m paymentpb.PaymentRequest
+	isProtobuf, err := decode(payload, &request, &m)
+	if err != nil {
+		return request, err
+	}
+	if isProtobuf {
+		request = structs.PaymentRequest{
+			ValidationHash:     m.GetValidationHash(),
+			DestinationAddress: m.GetDestinationAddress(),
+			Amount:             m.GetAmount(),
+			WorkerID:           m.GetWorkerId(),
+			Merchant:           m.GetMerchant(),
+			Message:            m.GetMessage(),
+			FiatAmount:         m.GetFiatAmount(),
+			Currency:           m.GetCurrency(),
+			Rate:               m.GetRate(),
+			Tolerance:          m.GetTolerance(),
+			RequestID:          m.GetRequestId(),
+		}
+	}
+	return request, nil
+}
+
+//DecodeAck reads an acknowledgement in either format
+func DecodeAck(payload string) (structs.Ack, error) {
+	var ack structs.Ack
+	var m paymentpb.PaymentAck
+	isProtobuf, err := decode(payload, &ack, &m)
+	if err != nil {
+		return ack, err
+	}
+	if isProtobuf {
+		ack = structs.Ack{
+			DestinationAddress: m.GetDestinationAddress(),
+			ExpectedAmount:     m.GetExpectedAmount(),
+			WorkerID:           m.GetWorkerId(),
+			Token:              m.GetToken(),
+			PaymentURI:         m.GetPaymentUri(),
+			FiatAmount:         m.GetFiatAmount(),
+			Currency:           m.GetCurrency(),
+			Rate:               m.GetRate(),
+			Error:              m.GetError(),
+			RequestedAmount:    m.GetRequestedAmount(),
+			RequestID:          m.GetRequestId(),
+		}
+	}
+	return ack, nil
+}
+
+//DecodePayment reads a payment event in either format
+func DecodePayment(payload string) (structs.Payment, error) {
+	var payment structs.Payment
+	var m paymentpb.Payment
+	isProtobuf, err := decode(payload, &payment, &m)
+	if err != nil {
+		return payment, err
+	}
+	if isProtobuf {
+		payment = structs.Payment{
+			Status:             m.GetStatus(),
+			Hash:               m.GetHash(),
+			ErrorCode:          int(m.GetErrorCode()),
+			ErrorMessage:       m.GetErrorMessage(),
+			DestinationAddress: m.GetDestinationAddress(),
+			SendingAddress:     m.GetSendingAddress(),
+			ExpectedAmount:     m.GetExpectedAmount(),
+			ValidatedAmount:    m.GetValidatedAmount(),
+			WorkerID:           m.GetWorkerId(),
+			FiatAmount:         m.GetFiatAmount(),
+			Currency:           m.GetCurrency(),
+			Rate:               m.GetRate(),
+			Note:               m.GetNote(),
+		}
+	}
+	return payment, nil
+}
+
+//PaymentRequestProto converts a payment request to its protobuf message
+func PaymentRequestProto(request structs.PaymentRequest) *paymentpb.PaymentRequest {
+	return &paymentpb.PaymentRequest{
+		ValidationHash:     request.ValidationHash,
+		DestinationAddress: request.DestinationAddress,
+		Amount:             request.Amount,
+		WorkerId:           request.WorkerID,
+		Merchant:           request.Merchant,
+		Message:            request.Message,
+		FiatAmount:         request.FiatAmount,
+		Currency:           request.Currency,
+		Rate:               request.Rate,
+		Tolerance:          request.Tolerance,
+		RequestId:          request.RequestID,
+	}
+}
+
+//PaymentProto converts a payment event to its protobuf message
+func PaymentProto(payment structs.Payment) *paymentpb.Payment {
+	return &paymentpb.Payment{
+		Status:             payment.Status,
+		Hash:               payment.Hash,
+		ErrorCode:          int32(payment.ErrorCode),
+		ErrorMessage:       payment.ErrorMessage,
+		DestinationAddress: payment.DestinationAddress,
+		SendingAddress:     payment.SendingAddress,
+		ExpectedAmount:     payment.ExpectedAmount,
+		ValidatedAmount:    payment.ValidatedAmount,
+		WorkerId:           payment.WorkerID,
+		FiatAmount:         payment.FiatAmount,
+		Currency:           payment.Currency,
+		Rate:               payment.Rate,
+		Note:               payment.Note,
+	}
+}
@@ -0,0 +1,65 @@
+package codec
+
+import (
+	structs "nano-pp/paymentstructs"
+	"testing"
+)
+
+var payment = structs.Payment{
+	Status:             "error",
+	Hash:               "E2FB233EF4554077A7BF1AA85851D5BF0B36965D2B0FB504B2BC778AB89917D3",
+	ErrorCode:          2,
+	ErrorMessage:       "Underpayment received, remaining balance of 500000000000000000000000000000 raw owed.",
+	DestinationAddress: "nano_1natrium1o3z5519ifou7xii8crpxpk8y65qmkih8e8bpsjri651oza8imdd",
+	SendingAddress:     "nano_3t6k35gi95xu6tergt6p69ck76ogmitsa8mnijtpxm9fkcm736xtoncuohr3",
+	ExpectedAmount:     "1000000000000000000000000000000",
+	ValidatedAmount:    "500000000000000000000000000000",
+	WorkerID:           "5e3c1f36-8f71-4a4e-9d1e-2b1f6f0b7a11",
+}
+
+func TestRoundTrip(t *testing.T) {
+	request := structs.PaymentRequest{DestinationAddress: payment.DestinationAddress, Amount: "1000", WorkerID: "worker", Merchant: "shop", Message: "order 42", Tolerance: "0.1%", RequestID: "request"}
+	ack := structs.Ack{DestinationAddress: payment.DestinationAddress, ExpectedAmount: "1000", WorkerID: "worker", Token: "token", PaymentURI: "nano:" + payment.DestinationAddress + "?amount=1000", RequestID: "request"}
+
+	for _, c := range []Codec{JSON{}, Protobuf{}} {
+		data, _ := c.EncodePaymentRequest(request)
+		if got, err := DecodePaymentRequest(data); err != nil || got != request {
+			t.Errorf("%s: got request %+v, %v", c.ContentType(), got, err)
+		}
+		data, _ = c.EncodeAck(ack)
+		if got, err := DecodeAck(data); err != nil || got != ack {
+			t.Errorf("%s: got ack %+v, %v", c.ContentType(), got, err)
+		}
+		data, _ = c.EncodePayment(payment)
+		if got, err := DecodePayment(data); err != nil || got != payment {
+			t.Errorf("%s: got payment %+v, %v", c.ContentType(), got, err)
+		}
+		if got, _ := ContentType(data); got != c.ContentType() {
+			t.Errorf("payload marked %s want %s", got, c.ContentType())
+		}
+	}
+}
+
+func TestUnmarkedJSON(t *testing.T) {
+	// Written by a producer predating the marker
+	request, err := DecodePaymentRequest(`{"destination_address":"nano_1merchant","amount":"1000"}`)
+	if err != nil || request.DestinationAddress != "nano_1merchant" || request.Amount != "1000" {
+		t.Errorf("got %+v, %v", request, err)
+	}
+	if _, err := DecodePayment("\x00\x7f"); err == nil {
+		t.Error("decoded a payload with an unknown content type")
+	}
+}
+
+func benchmarkDecode(b *testing.B, c Codec) {
+	data, _ := c.EncodePayment(payment)
+	b.ReportMetric(float64(len(data)), "payload-bytes")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodePayment(data)
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B)     { benchmarkDecode(b, JSON{}) }
+func BenchmarkDecodeProtobuf(b *testing.B) { benchmarkDecode(b, Protobuf{}) }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	nano "nano-pp/nanocurrency"
+	"nano-pp/nanocurrency/nanostructs"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"os"
+	"sort"
+	"strings"
+)
+
+//command is a nano-pp subcommand.  Each parses its own flags from args, including -config.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":           {"serve [-replay file [-replay-speed n]]  run the payment processor", serve},
+	"status":          {"status <workerID>  print the status of a payment worker", statusCommand},
+	"list":            {"list [--state=pending]  list payment workers and their status", listCommand},
+	"cancel":          {"cancel <workerID>  publish to cancel/<workerID>, cancelling a request still waiting for payment", cancelCommand},
+	"requeue":         {"requeue  return rejected payment requests and checkpoints to their queues", requeueCommand},
+	"loadtest":        {"loadtest [-invoices n] [-rate n] [-report file] [-baseline file]  measure the pipeline against a fake node", loadtestCommand},
+	"inspect-address": {"inspect-address [--clear-confirming] <address>  dump the stored and node view of an address", inspectAddressCommand},
+}
+
+//errUsage is returned by a command given the wrong number of arguments
+var errUsage = errors.New("wrong number of arguments")
+
+//output is where the admin commands print their results
+var output io.Writer = os.Stdout
+
+func main() {
+	// Without a subcommand the processor is served, as before subcommands existed
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		if err == errUsage {
+			err = fmt.Errorf("usage: nano-pp %s", cmd.usage)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: nano-pp <command> [-config file] [arguments]")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+//configFlag adds the -config flag shared by every command
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", os.Getenv("CONFIGFILE"), "path to a YAML config file, ENV values override it")
+}
+
+//adminStore parses the flags of an admin command, loads the configuration and opens the store.  The
+//positional arguments must number exactly nargs.
+func adminStore(flags *flag.FlagSet, args []string, nargs int) (store.Store, structs.Config, []string, error) {
+	configPath := configFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() != nargs {
+		return nil, structs.Config{}, nil, errUsage
+	}
+
+	config, err := structs.LoadConfig(*configPath)
+	if err != nil {
+		return nil, config, nil, err
+	}
+	if config.StoreBackend != "redis" {
+		return nil, config, nil, fmt.Errorf("%s needs store_backend redis, the memory store is not shared between processes", flags.Name())
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	st, _, err := openStore(config)
+	if err != nil {
+		return nil, config, nil, fmt.Errorf("error connecting to the store: %v", err)
+	}
+	return st, config, flags.Args(), nil
+}
+
+func statusCommand(args []string) error {
+	st, _, args, err := adminStore(flag.NewFlagSet("status", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	status, err := st.Status(args[0])
+	if err != nil {
+		return err
+	}
+	if status == "" {
+		return fmt.Errorf("no status recorded for worker %s", args[0])
+	}
+	fmt.Fprintln(output, status)
+	return nil
+}
+
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	state := flags.String("state", "", "only list workers with this status, e.g. pending or confirming")
+	st, _, _, err := adminStore(flags, args, 0)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	statuses, err := st.Statuses()
+	if err != nil {
+		return err
+	}
+	workerIDs := make([]string, 0, len(statuses))
+	for workerID, status := range statuses {
+		if *state == "" || status == *state {
+			workerIDs = append(workerIDs, workerID)
+		}
+	}
+	sort.Strings(workerIDs)
+
+	for _, workerID := range workerIDs {
+		fmt.Fprintf(output, "%s\t%s\n", workerID, statuses[workerID])
+	}
+	return nil
+}
+
+func cancelCommand(args []string) error {
+	st, _, args, err := adminStore(flag.NewFlagSet("cancel", flag.ExitOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if err := st.Publish(store.CancelChannel(args[0]), "true"); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "published %s\n", store.CancelChannel(args[0]))
+	return nil
+}
+
+func requeueCommand(args []string) error {
+	st, _, _, err := adminStore(flag.NewFlagSet("requeue", flag.ExitOnError), args, 0)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	for _, name := range []string{store.PaymentRequestQueue, store.CheckpointQueue} {
+		returned, err := st.OpenQueue(name).ReturnRejected()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(output, "returned %d rejected payment requests to %s\n", returned, name)
+	}
+	return nil
+}
+
+//addressReport is the view of an address printed by inspect-address.  The node responses are printed
+//as the node returned them.
+type addressReport struct {
+	Address  string          `json:"address"`
+	Requests []requestReport `json:"requests"`
+	Pending  json.RawMessage `json:"node_pending"`
+	History  json.RawMessage `json:"node_history"`
+}
+
+//requestReport is the stored state of a request watching the address, oldest first
+type requestReport struct {
+	WorkerID    string   `json:"worker_id"`
+	Confirming  bool     `json:"confirming"`
+	KnownHashes []string `json:"known_pending"`
+}
+
+func inspectAddressCommand(args []string) error {
+	flags := flag.NewFlagSet("inspect-address", flag.ExitOnError)
+	count := flags.String("count", "20", "number of history entries to show")
+	clearConfirming := flags.Bool("clear-confirming", false, "remove the confirming flags of the requests after printing")
+	st, config, args, err := adminStore(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	report := addressReport{Address: args[0], Requests: []requestReport{}}
+	watchers, err := st.Watchers(report.Address)
+	if err != nil {
+		return err
+	}
+	for _, workerID := range watchers {
+		request := requestReport{WorkerID: workerID}
+		if request.Confirming, err = st.IsConfirming(report.Address, workerID); err != nil {
+			return err
+		}
+		if request.KnownHashes, err = st.KnownHashes(report.Address, workerID); err != nil {
+			return err
+		}
+		report.Requests = append(report.Requests, request)
+	}
+
+	rpc := nanostructs.NanoRPC{Host: config.RPCHost, Port: config.RPCPort, Logger: slog.Default()}
+	if report.Pending, err = nano.Pending(rpc, report.Address, map[string]string{"include_active": "true"}); err != nil {
+		return fmt.Errorf("error retrieving pending blocks: %v", err)
+	}
+	if report.History, err = nano.AccountHistory(rpc, report.Address, *count, nil); err != nil {
+		return fmt.Errorf("error retrieving account history: %v", err)
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+
+	if *clearConfirming {
+		for _, request := range report.Requests {
+			if !request.Confirming {
+				continue
+			}
+			if err := st.ClearConfirming(report.Address, request.WorkerID); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "cleared the confirming flag of %s\n", request.WorkerID)
+		}
+	}
+	return nil
+}
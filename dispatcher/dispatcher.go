@@ -0,0 +1,216 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	bb "nano-pp/block_broadcaster"
+	"nano-pp/logging"
+	"nano-pp/store"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//subscriptionBuffer is the amount of confirmations held for a subscriber before new ones are dropped
+const subscriptionBuffer = 16
+
+//Stats contains the routing metrics for the dispatcher
+type Stats struct {
+	// Confirmations received from redis
+	Received uint64
+	// Confirmations that could not be decoded
+	DecodeErrors uint64
+	// Confirmations delivered to a subscriber
+	Routed uint64
+	// Confirmations dropped because a subscriber's buffer was full
+	Dropped uint64
+	// Active subscriptions
+	Subscriptions int
+	// Average time between receiving a confirmation and handing it to every subscriber
+	AverageRouteLatency time.Duration
+	// Longest time between receiving a confirmation and handing it to every subscriber
+	MaxRouteLatency time.Duration
+}
+
+//Subscription receives the confirmations routed to it by the dispatcher on C
+type Subscription struct {
+	C <-chan bb.WebsocketMessage
+
+	c          chan bb.WebsocketMessage
+	key        string
+	index      map[string]map[*Subscription]bool
+	dispatcher *Dispatcher
+	once       sync.Once
+}
+
+//Dispatcher holds a single subscription to the node confirmations, decodes each confirmation once
+//and routes it to the workers watching the destination account or block hash.
+type Dispatcher struct {
+	store  store.Store
+	logger *slog.Logger
+
+	mu        sync.RWMutex
+	byAccount map[string]map[*Subscription]bool
+	byHash    map[string]map[*Subscription]bool
+
+	received       uint64
+	decodeErrors   uint64
+	routed         uint64
+	dropped        uint64
+	routedMessages uint64
+	latencyTotal   int64
+	latencyMax     int64
+}
+
+//New returns a dispatcher that follows the confirmations appended to the provided store.
+func New(st store.Store, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{
+		store:     st,
+		logger:    logger,
+		byAccount: make(map[string]map[*Subscription]bool),
+		byHash:    make(map[string]map[*Subscription]bool),
+	}
+}
+
+//SubscribeAccount returns a subscription receiving every confirmation whose link is the provided account.
+func (d *Dispatcher) SubscribeAccount(account string) *Subscription {
+	return d.subscribe(d.byAccount, account)
+}
+
+//SubscribeHash returns a subscription receiving the confirmation of the provided block hash.
+func (d *Dispatcher) SubscribeHash(hash string) *Subscription {
+	return d.subscribe(d.byHash, hash)
+}
+
+func (d *Dispatcher) subscribe(index map[string]map[*Subscription]bool, key string) *Subscription {
+	c := make(chan bb.WebsocketMessage, subscriptionBuffer)
+	sub := &Subscription{C: c, c: c, key: key, index: index, dispatcher: d}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := index[key]; !ok {
+		index[key] = make(map[*Subscription]bool)
+	}
+	index[key][sub] = true
+
+	return sub
+}
+
+//Close removes the subscription from the dispatcher.  No more confirmations are sent on C once it returns.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		d := s.dispatcher
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(s.index[s.key], s)
+		if len(s.index[s.key]) == 0 {
+			delete(s.index, s.key)
+		}
+	})
+}
+
+//Run follows the confirmations and routes them until stop is closed.  If the subscription fails it is
+//re-established after a short delay.
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	for {
+		if err := d.receive(stop); err != nil {
+			d.logger.Error("error receiving confirmations in dispatcher", "error", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (d *Dispatcher) receive(stop <-chan struct{}) error {
+	sub, err := d.store.Follow(store.ConfirmationStream, d.logger)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case message, ok := <-sub.Messages():
+			if !ok {
+				return fmt.Errorf("confirmation subscription closed")
+			}
+			d.route([]byte(message.Payload))
+		}
+	}
+}
+
+//route decodes a confirmation and hands it to every subscriber of its link account and hash.
+func (d *Dispatcher) route(data []byte) {
+	start := time.Now()
+	atomic.AddUint64(&d.received, 1)
+
+	var message bb.WebsocketMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		atomic.AddUint64(&d.decodeErrors, 1)
+		d.logger.Error("error decoding confirmation in dispatcher", "error", err)
+		return
+	}
+
+	d.mu.RLock()
+	d.deliver(d.byAccount[message.Message.Block.LinkAsAccount], message)
+	d.deliver(d.byHash[message.Message.Hash], message)
+	d.mu.RUnlock()
+
+	elapsed := int64(time.Since(start))
+	atomic.AddUint64(&d.routedMessages, 1)
+	atomic.AddInt64(&d.latencyTotal, elapsed)
+	for {
+		max := atomic.LoadInt64(&d.latencyMax)
+		if elapsed <= max || atomic.CompareAndSwapInt64(&d.latencyMax, max, elapsed) {
+			break
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(subs map[*Subscription]bool, message bb.WebsocketMessage) {
+	for sub := range subs {
+		select {
+		case sub.c <- message:
+			atomic.AddUint64(&d.routed, 1)
+		default:
+			atomic.AddUint64(&d.dropped, 1)
+			d.logger.Warn("dropped confirmation, subscriber buffer full",
+				logging.DestinationAddress, message.Message.Block.LinkAsAccount,
+				logging.Hash, message.Message.Hash,
+				"subscriber", sub.key)
+		}
+	}
+}
+
+//Stats returns a snapshot of the dispatcher's routing metrics.
+func (d *Dispatcher) Stats() Stats {
+	d.mu.RLock()
+	subscriptions := 0
+	for _, subs := range d.byAccount {
+		subscriptions += len(subs)
+	}
+	for _, subs := range d.byHash {
+		subscriptions += len(subs)
+	}
+	d.mu.RUnlock()
+
+	stats := Stats{
+		Received:        atomic.LoadUint64(&d.received),
+		DecodeErrors:    atomic.LoadUint64(&d.decodeErrors),
+		Routed:          atomic.LoadUint64(&d.routed),
+		Dropped:         atomic.LoadUint64(&d.dropped),
+		Subscriptions:   subscriptions,
+		MaxRouteLatency: time.Duration(atomic.LoadInt64(&d.latencyMax)),
+	}
+	if count := atomic.LoadUint64(&d.routedMessages); count > 0 {
+		stats.AverageRouteLatency = time.Duration(atomic.LoadInt64(&d.latencyTotal) / int64(count))
+	}
+
+	return stats
+}
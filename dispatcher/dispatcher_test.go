@@ -0,0 +1,152 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"log/slog"
+	bb "nano-pp/block_broadcaster"
+	"nano-pp/store"
+	"testing"
+	"time"
+)
+
+//confirmation returns a confirmation of a send to the account with the hash
+func confirmation(account string, hash string) []byte {
+	var message bb.WebsocketMessage
+	message.Message.Hash = hash
+	message.Message.Block.LinkAsAccount = account
+	data, _ := json.Marshal(message)
+	return data
+}
+
+//received returns the hashes of the confirmations waiting on the subscription
+func received(sub *Subscription) []string {
+	var hashes []string
+	for {
+		select {
+		case message := <-sub.C:
+			hashes = append(hashes, message.Message.Hash)
+		default:
+			return hashes
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	d := New(store.NewMemory(), slog.Default())
+	account := d.SubscribeAccount("nano_1merchant")
+	hash := d.SubscribeHash("A")
+	other := d.SubscribeAccount("nano_1other")
+
+	d.route(confirmation("nano_1merchant", "A"))
+	d.route(confirmation("nano_1merchant", "B"))
+	d.route(confirmation("nano_1customer", "A"))
+
+	if got := received(account); len(got) != 2 || got[0] != "A" || got[1] != "B" {
+		t.Errorf("got %v routed by account", got)
+	}
+	if got := received(hash); len(got) != 2 {
+		t.Errorf("got %v routed by hash", got)
+	}
+	if got := received(other); len(got) != 0 {
+		t.Errorf("got %v routed to another account", got)
+	}
+	if stats := d.Stats(); stats.Received != 3 || stats.Routed != 4 || stats.Subscriptions != 3 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestRouteDropsWhenBufferFull(t *testing.T) {
+	d := New(store.NewMemory(), slog.Default())
+	sub := d.SubscribeAccount("nano_1merchant")
+	for i := 0; i < subscriptionBuffer+2; i++ {
+		d.route(confirmation("nano_1merchant", "A"))
+	}
+
+	if got := received(sub); len(got) != subscriptionBuffer {
+		t.Errorf("got %d confirmations want %d", len(got), subscriptionBuffer)
+	}
+	if stats := d.Stats(); stats.Routed != subscriptionBuffer || stats.Dropped != 2 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestRouteDecodeErrors(t *testing.T) {
+	d := New(store.NewMemory(), slog.Default())
+	d.SubscribeAccount("nano_1merchant")
+	d.route([]byte("{"))
+
+	if stats := d.Stats(); stats.Received != 1 || stats.DecodeErrors != 1 || stats.Routed != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	d := New(store.NewMemory(), slog.Default())
+	first := d.SubscribeAccount("nano_1merchant")
+	second := d.SubscribeAccount("nano_1merchant")
+
+	first.Close()
+	d.route(confirmation("nano_1merchant", "A"))
+	if got := received(first); len(got) != 0 {
+		t.Errorf("got %v after closing", got)
+	}
+	if got := received(second); len(got) != 1 {
+		t.Errorf("got %v on the open subscription", got)
+	}
+
+	// The account is removed from the index with its last subscription, and closing again is harmless
+	second.Close()
+	second.Close()
+	if _, ok := d.byAccount["nano_1merchant"]; ok {
+		t.Error("the account is still indexed")
+	}
+	if stats := d.Stats(); stats.Subscriptions != 0 {
+		t.Errorf("got %d subscriptions", stats.Subscriptions)
+	}
+}
+
+//closableSubscription is a subscription whose messages the test sends and closes
+type closableSubscription struct {
+	messages chan store.Message
+}
+
+func (s closableSubscription) Messages() <-chan store.Message { return s.messages }
+func (s closableSubscription) Close() error                   { return nil }
+
+//followStore hands each subscription returned by Follow to the test
+type followStore struct {
+	store.Store
+	follows chan chan store.Message
+}
+
+func (s followStore) Follow(stream string, logger *slog.Logger) (store.Subscription, error) {
+	messages := make(chan store.Message, 1)
+	s.follows <- messages
+	return closableSubscription{messages}, nil
+}
+
+func TestRunFollowsAgain(t *testing.T) {
+	st := followStore{Store: store.NewMemory(), follows: make(chan chan store.Message, 2)}
+	d := New(st, slog.Default())
+	sub := d.SubscribeHash("A")
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.Run(stop)
+
+	close(<-st.follows)
+	select {
+	case messages := <-st.follows:
+		messages <- store.Message{Channel: store.ConfirmationStream, Payload: string(confirmation("nano_1merchant", "A"))}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the confirmations were not followed again after the subscription closed")
+	}
+
+	select {
+	case message := <-sub.C:
+		if message.Message.Hash != "A" {
+			t.Errorf("got %+v", message)
+		}
+	case <-time.After(time.Second):
+		t.Error("no confirmation routed after following again")
+	}
+}
@@ -0,0 +1,38 @@
+package dispatcher
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	receivedDesc      = prometheus.NewDesc("nanopp_dispatcher_received_total", "Confirmations received by the dispatcher.", nil, nil)
+	decodeErrorsDesc  = prometheus.NewDesc("nanopp_dispatcher_decode_errors_total", "Confirmations the dispatcher could not decode.", nil, nil)
+	routedDesc        = prometheus.NewDesc("nanopp_dispatcher_routed_total", "Confirmations delivered to a subscriber.", nil, nil)
+	droppedDesc       = prometheus.NewDesc("nanopp_dispatcher_dropped_total", "Confirmations dropped because a subscriber's buffer was full.", nil, nil)
+	subscriptionsDesc = prometheus.NewDesc("nanopp_dispatcher_subscriptions", "Active dispatcher subscriptions.", nil, nil)
+	avgLatencyDesc    = prometheus.NewDesc("nanopp_dispatcher_route_latency_average_seconds", "Average time to route a confirmation to every subscriber.", nil, nil)
+	maxLatencyDesc    = prometheus.NewDesc("nanopp_dispatcher_route_latency_max_seconds", "Longest time to route a confirmation to every subscriber.", nil, nil)
+)
+
+//Describe implements prometheus.Collector so the dispatcher's stats can be registered as metrics.
+func (d *Dispatcher) Describe(ch chan<- *prometheus.Desc) {
+	ch <- receivedDesc
+	ch <- decodeErrorsDesc
+	ch <- routedDesc
+	ch <- droppedDesc
+	ch <- subscriptionsDesc
+	ch <- avgLatencyDesc
+	ch <- maxLatencyDesc
+}
+
+//Collect implements prometheus.Collector with a snapshot of the dispatcher's stats.
+func (d *Dispatcher) Collect(ch chan<- prometheus.Metric) {
+	stats := d.Stats()
+	ch <- prometheus.MustNewConstMetric(receivedDesc, prometheus.CounterValue, float64(stats.Received))
+	ch <- prometheus.MustNewConstMetric(decodeErrorsDesc, prometheus.CounterValue, float64(stats.DecodeErrors))
+	ch <- prometheus.MustNewConstMetric(routedDesc, prometheus.CounterValue, float64(stats.Routed))
+	ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(stats.Dropped))
+	ch <- prometheus.MustNewConstMetric(subscriptionsDesc, prometheus.GaugeValue, float64(stats.Subscriptions))
+	ch <- prometheus.MustNewConstMetric(avgLatencyDesc, prometheus.GaugeValue, stats.AverageRouteLatency.Seconds())
+	ch <- prometheus.MustNewConstMetric(maxLatencyDesc, prometheus.GaugeValue, stats.MaxRouteLatency.Seconds())
+}
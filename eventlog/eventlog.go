@@ -0,0 +1,199 @@
+package eventlog
+
+import (
+	"fmt"
+	structs "nano-pp/paymentstructs"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	//ModePubSub publishes events with PUBLISH only
+	ModePubSub = "pubsub"
+	//ModeStreams appends events to a redis stream only
+	ModeStreams = "streams"
+	//ModeBoth appends events to a redis stream and publishes them for pub/sub subscribers
+	ModeBoth = "both"
+)
+
+//payloadField is the stream entry field that holds the event payload
+const payloadField = "data"
+
+//Entry is a single event read from a stream
+type Entry struct {
+	// Stream entry ID, usable to acknowledge or replay from this event
+	ID string
+	// Event payload as published
+	Payload string
+}
+
+//Publisher writes events to streams and/or pub/sub channels depending on the configured mode
+type Publisher struct {
+	Mode string
+	// Approximate number of entries kept in each stream
+	MaxLen int
+}
+
+//NewPublisher returns a publisher using the event mode and stream length from the configuration.  An
+//unknown mode is an error.
+func NewPublisher(config structs.Config) (Publisher, error) {
+	p := Publisher{Mode: config.EventMode, MaxLen: config.StreamMaxLen}
+	if !p.Streams() && !p.PubSub() {
+		return p, fmt.Errorf("unknown event mode %q, must be %s, %s or %s", config.EventMode, ModePubSub, ModeStreams, ModeBoth)
+	}
+	return p, nil
+}
+
+//Streams reports whether events are appended to redis streams.
+func (p Publisher) Streams() bool {
+	return p.Mode == ModeStreams || p.Mode == ModeBoth
+}
+
+//PubSub reports whether events are sent with PUBLISH.
+func (p Publisher) PubSub() bool {
+	return p.Mode == ModePubSub || p.Mode == ModeBoth
+}
+
+//appendScript appends an entry to a stream and sets the stream's expiry in one step, so the stream never
+//exists without it
+var appendScript = redis.NewScript(1, `
+if tonumber(ARGV[3]) > 0 then
+  redis.call("XADD", KEYS[1], "MAXLEN", "~", ARGV[3], "*", ARGV[1], ARGV[2])
+else
+  redis.call("XADD", KEYS[1], "*", ARGV[1], ARGV[2])
+end
+if tonumber(ARGV[4]) > 0 then
+  redis.call("EXPIRE", KEYS[1], ARGV[4])
+end
+return redis.status_reply("OK")`)
+
+//Publish writes the payload to the stream and/or channel with the provided name.  A stream is expired
+//after ttl, unless ttl is 0.
+func (p Publisher) Publish(c redis.Conn, name string, payload string, ttl time.Duration) error {
+	if !p.Streams() && !p.PubSub() {
+		return fmt.Errorf("error publishing to %s: unknown event mode %q", name, p.Mode)
+	}
+	if p.Streams() {
+		if _, err := appendScript.Do(c, name, payloadField, payload, p.MaxLen, int64((ttl+time.Second-1)/time.Second)); err != nil {
+			return fmt.Errorf("error appending to stream %s: %v", name, err)
+		}
+	}
+	if p.PubSub() {
+		if _, err := c.Do("PUBLISH", name, payload); err != nil {
+			return fmt.Errorf("error publishing to %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+//EnsureGroup creates the consumer group on the stream, creating the stream if needed.  New groups
+//start at the provided ID ("$" for new events only, "0" for the whole stream).
+func EnsureGroup(c redis.Conn, stream string, group string, start string) error {
+	_, err := c.Do("XGROUP", "CREATE", stream, group, start, "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+//Read returns up to count entries of the stream after the provided ID, blocking for up to blockMillis
+//milliseconds when there are none.  Use "$" to wait for new entries only.
+func Read(c redis.Conn, stream string, afterID string, count int, blockMillis int) ([]Entry, error) {
+	reply, err := c.Do("XREAD", "COUNT", count, "BLOCK", blockMillis, "STREAMS", stream, afterID)
+	if err != nil {
+		return nil, err
+	}
+	return parseStreams(reply)
+}
+
+//ReadGroup returns up to count entries for the consumer in the group.  An ID of ">" returns new
+//entries, while "0" returns the entries already delivered to this consumer and not acknowledged.
+func ReadGroup(c redis.Conn, stream string, group string, consumer string, id string, count int, blockMillis int) ([]Entry, error) {
+	reply, err := c.Do("XREADGROUP", "GROUP", group, consumer, "COUNT", count, "BLOCK", blockMillis, "STREAMS", stream, id)
+	if err != nil {
+		return nil, err
+	}
+	return parseStreams(reply)
+}
+
+//Ack acknowledges entries for the consumer group so they are not redelivered.
+func Ack(c redis.Conn, stream string, group string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := c.Do("XACK", redis.Args{stream, group}.AddFlat(ids)...)
+	return err
+}
+
+//LastID returns the ID of the last entry of the stream, or "0-0" for an empty or missing stream.  Reading
+//after it gets every entry appended from now on, unlike "$", which is only resolved when the read runs.
+func LastID(c redis.Conn, stream string) (string, error) {
+	reply, err := redis.Values(c.Do("XREVRANGE", stream, "+", "-", "COUNT", 1))
+	if err != nil {
+		return "", err
+	}
+	entries, err := parseEntries(reply)
+	if err != nil || len(entries) == 0 {
+		return "0-0", err
+	}
+	return entries[0].ID, nil
+}
+
+//Range returns up to count entries starting at the provided ID (inclusive) so a consumer can replay
+//events it missed.
+func Range(c redis.Conn, stream string, fromID string, count int) ([]Entry, error) {
+	reply, err := redis.Values(c.Do("XRANGE", stream, fromID, "+", "COUNT", count))
+	if err != nil {
+		return nil, err
+	}
+	return parseEntries(reply)
+}
+
+//parseStreams converts an XREAD/XREADGROUP reply for a single stream into entries
+func parseStreams(reply interface{}) ([]Entry, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, s := range streams {
+		stream, err := redis.Values(s, nil)
+		if err != nil || len(stream) != 2 {
+			return nil, fmt.Errorf("unexpected stream reply: %v", s)
+		}
+		values, err := redis.Values(stream[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseEntries(values)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, parsed...)
+	}
+	return entries, nil
+}
+
+func parseEntries(values []interface{}) ([]Entry, error) {
+	entries := make([]Entry, 0, len(values))
+	for _, v := range values {
+		entry, err := redis.Values(v, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry: %v", v)
+		}
+		id, err := redis.String(entry[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		// Entries claimed after being deleted have no fields
+		fields, _ := redis.StringMap(entry[1], nil)
+		entries = append(entries, Entry{ID: id, Payload: fields[payloadField]})
+	}
+	return entries, nil
+}
@@ -0,0 +1,138 @@
+package eventlog
+
+import (
+	structs "nano-pp/paymentstructs"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestNewPublisher(t *testing.T) {
+	config := structs.DefaultConfig()
+	config.EventMode = "kafka"
+	if _, err := NewPublisher(config); err == nil {
+		t.Error("got no error for an unknown event mode")
+	}
+	if err := (Publisher{Mode: "kafka"}).Publish(nil, "events", "{}", 0); err == nil {
+		t.Error("got no error publishing in an unknown event mode")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		streams bool
+		pubsub  bool
+	}{
+		{ModePubSub, false, true},
+		{ModeStreams, true, false},
+		{ModeBoth, true, true},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			server := miniredis.RunT(t)
+			dial := func() redis.Conn {
+				c, err := redis.Dial("tcp", server.Addr())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { c.Close() })
+				return c
+			}
+
+			sub := redis.PubSubConn{Conn: dial()}
+			sub.Subscribe("events")
+			sub.ReceiveWithTimeout(time.Second)
+
+			config := structs.DefaultConfig()
+			config.EventMode = tc.mode
+			config.StreamMaxLen = 10
+			p, err := NewPublisher(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := dial()
+			if err := p.Publish(c, "events", "first", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, _ := Range(c, "events", "-", 10)
+			if tc.streams != (len(entries) == 1 && entries[0].Payload == "first") {
+				t.Errorf("got stream entries %v", entries)
+			}
+			if tc.streams && server.TTL("events") != time.Minute {
+				t.Errorf("got TTL %v want %v", server.TTL("events"), time.Minute)
+			}
+
+			message, _ := sub.ReceiveWithTimeout(100 * time.Millisecond).(redis.Message)
+			if tc.pubsub != (string(message.Data) == "first") {
+				t.Errorf("got published message %q", message.Data)
+			}
+		})
+	}
+}
+
+func TestConsumerGroup(t *testing.T) {
+	server := miniredis.RunT(t)
+	c, err := redis.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Creating the group again is not an error
+	for i := 0; i < 2; i++ {
+		if err := EnsureGroup(c, "events", "group", "0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := Publisher{Mode: ModeStreams}
+	p.Publish(c, "events", "first", 0)
+	p.Publish(c, "events", "second", 0)
+
+	delivered, err := ReadGroup(c, "events", "group", "consumer", ">", 10, 10)
+	if err != nil || len(delivered) != 2 || delivered[0].Payload != "first" || delivered[1].Payload != "second" {
+		t.Fatalf("got delivered %v, %v", delivered, err)
+	}
+	if entries, _ := ReadGroup(c, "events", "group", "consumer", ">", 10, 10); len(entries) != 0 {
+		t.Errorf("got %v delivered twice", entries)
+	}
+
+	// Only the entries not acknowledged are pending
+	if err := Ack(c, "events", "group", delivered[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := ReadGroup(c, "events", "group", "consumer", "0", 10, 10)
+	if err != nil || len(pending) != 1 || pending[0].ID != delivered[1].ID {
+		t.Errorf("got pending %v, %v", pending, err)
+	}
+}
+
+func TestRangeAndLastID(t *testing.T) {
+	server := miniredis.RunT(t)
+	c, err := redis.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if id, err := LastID(c, "events"); id != "0-0" || err != nil {
+		t.Errorf("got last ID %s, %v of a missing stream", id, err)
+	}
+	p := Publisher{Mode: ModeStreams}
+	p.Publish(c, "events", "first", 0)
+	p.Publish(c, "events", "second", 0)
+
+	last, err := LastID(c, "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := Range(c, "events", last, 10)
+	if err != nil || len(entries) != 1 || entries[0].Payload != "second" {
+		t.Errorf("got entries %v, %v from the last ID", entries, err)
+	}
+	if entries, _ := Read(c, "events", last, 10, 10); len(entries) != 0 {
+		t.Errorf("got entries %v after the last ID", entries)
+	}
+}
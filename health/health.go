@@ -0,0 +1,146 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	bb "nano-pp/block_broadcaster"
+	nano "nano-pp/nanocurrency"
+	"nano-pp/nanocurrency/nanostructs"
+	"nano-pp/store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//Thresholds are the limits past which a dependency makes the processor unready
+type Thresholds struct {
+	// How long the websocket may be disconnected
+	WebsocketDown time.Duration
+	// Most unchecked blocks the node may have before it is considered bootstrapping
+	MaxUnchecked uint64
+	// Most blocks the node's cemented count may trail its block count
+	MaxCementedLag uint64
+}
+
+//Check is the result of checking one dependency
+type Check struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+//Report is the body of the readiness endpoint.  Status is "ok" or "unavailable".
+type Report struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+}
+
+//Checker checks the store, the node websocket and the node itself
+type Checker struct {
+	store      store.Store
+	websocket  *bb.ConnectionState
+	rpc        nanostructs.NanoRPC
+	thresholds Thresholds
+}
+
+//NewChecker returns a checker of the dependencies using the provided thresholds.
+func NewChecker(st store.Store, websocket *bb.ConnectionState, rpc nanostructs.NanoRPC, thresholds Thresholds) *Checker {
+	return &Checker{store: st, websocket: websocket, rpc: rpc, thresholds: thresholds}
+}
+
+//Ready checks every dependency.  The report's status is "ok" only when all the checks pass.
+func (c *Checker) Ready() Report {
+	report := Report{Status: "ok", Checks: map[string]Check{
+		"redis":     result(c.store.Ping()),
+		"websocket": result(c.checkWebsocket()),
+		"node":      result(c.checkNode()),
+	}}
+	for _, check := range report.Checks {
+		if !check.OK {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+func result(err error) Check {
+	if err != nil {
+		return Check{OK: false, Error: err.Error()}
+	}
+	return Check{OK: true}
+}
+
+//checkWebsocket fails once the websocket has been disconnected longer than the threshold
+func (c *Checker) checkWebsocket() error {
+	connected, since := c.websocket.Connected()
+	if connected {
+		return nil
+	}
+	if down := time.Since(since); down > c.thresholds.WebsocketDown {
+		return fmt.Errorf("websocket disconnected for %s", down.Round(time.Second))
+	}
+	return nil
+}
+
+//checkNode fails when the node is unreachable or still bootstrapping
+func (c *Checker) checkNode() error {
+	response, err := nano.BlockCount(c.rpc)
+	if err != nil {
+		return fmt.Errorf("error retrieving block count: %v", err)
+	}
+
+	count, err := countField(response, "count")
+	if err != nil {
+		return err
+	}
+	unchecked, err := countField(response, "unchecked")
+	if err != nil {
+		return err
+	}
+	cemented, err := countField(response, "cemented")
+	if err != nil {
+		return err
+	}
+
+	if unchecked > c.thresholds.MaxUnchecked {
+		return fmt.Errorf("node is bootstrapping: %d unchecked blocks", unchecked)
+	}
+	if count > cemented && count-cemented > c.thresholds.MaxCementedLag {
+		return fmt.Errorf("node is bootstrapping: cemented count %d is %d behind block count %d", cemented, count-cemented, count)
+	}
+	return nil
+}
+
+//countField reads a count the node returns as a string
+func countField(response map[string]interface{}, field string) (uint64, error) {
+	value, ok := response[field].(string)
+	if !ok {
+		return 0, fmt.Errorf("block count response has no %s", field)
+	}
+	count, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error converting %s: %v", field, err)
+	}
+	return count, nil
+}
+
+//Healthz reports that the process is up and serving.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+//Readyz reports whether the processor can take payment requests, with 503 and the failing checks when
+//it cannot.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := c.Ready()
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,63 @@
+package health
+
+import (
+	"encoding/json"
+	bb "nano-pp/block_broadcaster"
+	"nano-pp/nanocurrency/nanostructs"
+	"nano-pp/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//fakeNode answers block_count with the provided counts
+func fakeNode(count string, unchecked string, cemented string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"count": count, "unchecked": unchecked, "cemented": cemented})
+	}))
+}
+
+func newTestChecker(node *httptest.Server, websocket *bb.ConnectionState) *Checker {
+	host := node.URL[:strings.LastIndex(node.URL, ":")]
+	port := node.URL[strings.LastIndex(node.URL, ":")+1:]
+	return NewChecker(store.NewMemory(), websocket, nanostructs.NanoRPC{Host: host, Port: port}, Thresholds{
+		WebsocketDown:  time.Minute,
+		MaxUnchecked:   100,
+		MaxCementedLag: 100,
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	node := fakeNode("1000", "5", "990")
+	defer node.Close()
+	websocket := bb.NewConnectionState()
+	websocket.SetConnected(true)
+
+	recorder := httptest.NewRecorder()
+	newTestChecker(node, websocket).Readyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("got status %d want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+}
+
+func TestReadyzBootstrapping(t *testing.T) {
+	node := fakeNode("1000", "5000", "10")
+	defer node.Close()
+	websocket := bb.NewConnectionState()
+	websocket.SetConnected(true)
+
+	recorder := httptest.NewRecorder()
+	newTestChecker(node, websocket).Readyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	var report Report
+	json.NewDecoder(recorder.Body).Decode(&report)
+	if report.Checks["node"].OK || !report.Checks["redis"].OK || !report.Checks["websocket"].OK {
+		t.Errorf("expected only the node check to fail, got %v", report.Checks)
+	}
+}
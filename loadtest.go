@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"nano-pp/codec"
+	"nano-pp/dispatcher"
+	"nano-pp/eventlog"
+	"nano-pp/logging"
+	"nano-pp/nanocurrency/fakenode"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"nano-pp/workers"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//loadOptions sets the shape of a load test
+type loadOptions struct {
+	// Payment requests enqueued
+	Invoices int `json:"invoices"`
+	// Time a customer takes to pay after the request is acknowledged
+	PayDelay time.Duration `json:"pay_delay"`
+	// Payments made per second, 0 pays each request once its delay has passed
+	PaymentRate float64 `json:"payment_rate"`
+	// Longest the run waits for every request to finish
+	Timeout time.Duration `json:"timeout"`
+}
+
+//latency summarises the durations measured for one stage of the pipeline, in milliseconds
+type latency struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+//resources is the resource use of the process over a load test
+type resources struct {
+	CPUSeconds     float64 `json:"cpu_seconds"`
+	PeakHeapBytes  uint64  `json:"peak_heap_bytes"`
+	TotalAlloc     uint64  `json:"total_alloc_bytes"`
+	GCCycles       uint32  `json:"gc_cycles"`
+	PeakGoroutines int     `json:"peak_goroutines"`
+}
+
+//loadReport is the result of a load test, written as JSON so runs of different releases can be compared
+type loadReport struct {
+	Version      string         `json:"version"`
+	GoVersion    string         `json:"go_version"`
+	Started      time.Time      `json:"started"`
+	Options      loadOptions    `json:"options"`
+	StoreBackend string         `json:"store_backend"`
+	WireFormat   string         `json:"wire_format"`
+	MaxWorkers   int            `json:"max_workers"`
+	Consumers    int            `json:"consumers"`
+	Duration     float64        `json:"duration_seconds"`
+	Throughput   float64        `json:"invoices_per_second"`
+	Outcomes     map[string]int `json:"outcomes"`
+	Unfinished   int            `json:"unfinished"`
+	Ack          latency        `json:"ack_latency"`
+	Success      latency        `json:"time_to_success"`
+	Settle       latency        `json:"payment_to_success"`
+	Resources    resources      `json:"resources"`
+}
+
+//invoice tracks one synthetic payment request through the pipeline
+type invoice struct {
+	request  structs.PaymentRequest
+	enqueued time.Time
+	acked    time.Time
+	due      time.Time
+	paid     time.Time
+	finished time.Time
+	outcome  string
+}
+
+func summarise(durations []time.Duration) latency {
+	if len(durations) == 0 {
+		return latency{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	at := func(q float64) float64 {
+		return float64(durations[int(q*float64(len(durations)-1))]) / float64(time.Millisecond)
+	}
+	return latency{Count: len(durations), P50: at(.5), P90: at(.9), P99: at(.99), Max: at(1)}
+}
+
+//cpuSeconds returns the user and system CPU time used by the process, the fake node included
+func cpuSeconds() float64 {
+	var usage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &usage) != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()).Seconds()
+}
+
+//sampleResources records the peak heap and goroutine count every 100ms until stop is closed
+func sampleResources(r *resources, mu *sync.Mutex, stop <-chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		mu.Lock()
+		if stats.HeapAlloc > r.PeakHeapBytes {
+			r.PeakHeapBytes = stats.HeapAlloc
+		}
+		if n := runtime.NumGoroutine(); n > r.PeakGoroutines {
+			r.PeakGoroutines = n
+		}
+		mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+}
+
+//runLoad enqueues synthetic payment requests into the payment request queue of an in-process processor
+//using the configured store, and pays each from a fake node once it is acknowledged.  Confirmations are
+//relayed from the fake node into the confirmation stream as the block broadcaster does.  A payment made
+//before the worker has recorded the known blocks of the address is not credited, so the pay delay stands
+//in for the customer and should stay well above the ack latency.
+func runLoad(config structs.Config, options loadOptions, logger *slog.Logger) (loadReport, error) {
+	report := loadReport{
+		Version:      buildVersion(),
+		GoVersion:    runtime.Version(),
+		Started:      time.Now(),
+		Options:      options,
+		StoreBackend: config.StoreBackend,
+		WireFormat:   config.WireFormat,
+		MaxWorkers:   config.MaxWorkers,
+		Consumers:    config.Consumers,
+		Outcomes:     make(map[string]int),
+	}
+
+	if publisher, err := eventlog.NewPublisher(config); config.StoreBackend == "redis" && (err != nil || !publisher.PubSub()) {
+		return report, fmt.Errorf("loadtest follows the invoice events with pub/sub, event_mode must be pubsub or both")
+	}
+	// Keep the synthetic requests and their keys apart from the real ones
+	config.KeyPrefix += "loadtest:"
+
+	node := fakenode.Start()
+	defer node.Close()
+	node.Configure(&config)
+
+	stop := make(chan struct{})
+	st, err := newStore(config, logger, stop)
+	if err != nil {
+		return report, fmt.Errorf("error connecting to the store: %v", err)
+	}
+	defer st.Close()
+	defer close(stop)
+
+	stopRelay, err := node.RelayTo(st)
+	if err != nil {
+		return report, fmt.Errorf("error relaying fake node confirmations: %v", err)
+	}
+	defer stopRelay()
+
+	invoices := make(map[string]*invoice, options.Invoices)
+	channels := make([]string, 0, 2*options.Invoices)
+	for i := 0; i < options.Invoices; i++ {
+		address := fmt.Sprintf("nano_1load%08d", i)
+		invoices[address] = &invoice{request: structs.PaymentRequest{DestinationAddress: address, Amount: "1000000"}}
+		channels = append(channels, store.AckChannel(address), store.PaymentStream(address))
+	}
+	events, err := st.Subscribe(channels...)
+	if err != nil {
+		return report, fmt.Errorf("error subscribing to the invoice events: %v", err)
+	}
+	defer events.Close()
+
+	var usageMu sync.Mutex
+	sampling := make(chan struct{})
+	go sampleResources(&report.Resources, &usageMu, sampling)
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	cpuBefore := cpuSeconds()
+
+	confirmations := dispatcher.New(st, logger)
+	go confirmations.Run(stop)
+	lifecycle := workers.NewLifecycle(logger, config.MaxWorkers)
+	queue := st.OpenQueue(store.PaymentRequestQueue)
+	queue.StartConsuming(config.PrefetchLimit, time.Duration(config.PollDuration)*time.Millisecond)
+	for i := 0; i < config.Consumers; i++ {
+		queue.AddConsumer("loadtest", newConsumer(i, store.PaymentRequestQueue, st, confirmations, lifecycle, logger, config, nil))
+	}
+
+	// Acknowledged invoices wait here to be paid after the delay and at the payment rate.  The time
+	// paid is written under paidMu as it is read once the run ends.
+	var paidMu sync.Mutex
+	payable := make(chan *invoice, options.Invoices)
+	go func() {
+		var tick <-chan time.Time
+		if options.PaymentRate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / options.PaymentRate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case inv := <-payable:
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Until(inv.due)):
+				}
+				if tick != nil {
+					select {
+					case <-stop:
+						return
+					case <-tick:
+					}
+				}
+				paidMu.Lock()
+				inv.paid = time.Now()
+				paidMu.Unlock()
+				// Each invoice is paid by its own customer, as the worker rejects blocks outside the most
+				// recent 5% of the sender's chain
+				customer := strings.Replace(inv.request.DestinationAddress, "load", "customer", 1)
+				node.Confirm(node.Send(customer, inv.request.DestinationAddress, inv.request.Amount))
+			}
+		}
+	}()
+
+	start := time.Now()
+	wire := codec.For(config.WireFormat)
+	for _, inv := range invoices {
+		data, _ := wire.EncodePaymentRequest(inv.request)
+		inv.enqueued = time.Now()
+		if err := queue.Publish(data); err != nil {
+			return report, fmt.Errorf("error enqueueing payment request: %v", err)
+		}
+	}
+
+	deadline := time.After(options.Timeout)
+	remaining := options.Invoices
+	for remaining > 0 {
+		select {
+		case message, ok := <-events.Messages():
+			if !ok {
+				return report, fmt.Errorf("invoice event subscription closed")
+			}
+			now := time.Now()
+			if address := strings.TrimPrefix(message.Channel, store.AckChannel("")); address != message.Channel {
+				if inv := invoices[address]; inv != nil && inv.acked.IsZero() {
+					inv.acked = now
+					inv.due = now.Add(options.PayDelay)
+					payable <- inv
+				}
+				continue
+			}
+			payment, _ := codec.DecodePayment(message.Payload)
+			inv := invoices[strings.TrimPrefix(message.Channel, store.PaymentStream(""))]
+			if inv == nil || payment.Status == "confirming" || !inv.finished.IsZero() {
+				continue
+			}
+			inv.finished = now
+			inv.outcome = payment.Outcome()
+			remaining--
+		case <-deadline:
+			logger.Warn("load test timed out", "unfinished", remaining)
+			remaining = 0
+		}
+	}
+	report.Duration = time.Since(start).Seconds()
+
+	queue.StopConsuming()
+	lifecycle.Drain(0)
+	close(sampling)
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	usageMu.Lock()
+	report.Resources.CPUSeconds = cpuSeconds() - cpuBefore
+	report.Resources.TotalAlloc = after.TotalAlloc - before.TotalAlloc
+	report.Resources.GCCycles = after.NumGC - before.NumGC
+	usageMu.Unlock()
+
+	paidMu.Lock()
+	defer paidMu.Unlock()
+	var acks, successes, settles []time.Duration
+	for _, inv := range invoices {
+		if !inv.acked.IsZero() {
+			acks = append(acks, inv.acked.Sub(inv.enqueued))
+		}
+		if inv.finished.IsZero() {
+			report.Unfinished++
+			continue
+		}
+		report.Outcomes[inv.outcome]++
+		if inv.outcome == "success" {
+			successes = append(successes, inv.finished.Sub(inv.enqueued))
+			settles = append(settles, inv.finished.Sub(inv.paid))
+		}
+	}
+	report.Ack = summarise(acks)
+	report.Success = summarise(successes)
+	report.Settle = summarise(settles)
+	if report.Duration > 0 {
+		report.Throughput = float64(options.Invoices-report.Unfinished) / report.Duration
+	}
+	return report, nil
+}
+
+//compareReports prints the change of each headline figure from a baseline report
+func compareReports(baseline loadReport, report loadReport) {
+	change := func(name string, was float64, now float64) {
+		if was == 0 {
+			fmt.Fprintf(output, "%-24s %12.2f -> %12.2f\n", name, was, now)
+			return
+		}
+		fmt.Fprintf(output, "%-24s %12.2f -> %12.2f  %+6.1f%%\n", name, was, now, 100*(now-was)/was)
+	}
+	fmt.Fprintf(output, "compared with %s (%s)\n", baseline.Version, baseline.Started.Format(time.RFC3339))
+	change("invoices/s", baseline.Throughput, report.Throughput)
+	change("ack p50 ms", baseline.Ack.P50, report.Ack.P50)
+	change("ack p99 ms", baseline.Ack.P99, report.Ack.P99)
+	change("success p50 ms", baseline.Success.P50, report.Success.P50)
+	change("success p99 ms", baseline.Success.P99, report.Success.P99)
+	change("settle p99 ms", baseline.Settle.P99, report.Settle.P99)
+	change("cpu s", baseline.Resources.CPUSeconds, report.Resources.CPUSeconds)
+	change("peak heap MiB", float64(baseline.Resources.PeakHeapBytes)/(1<<20), float64(report.Resources.PeakHeapBytes)/(1<<20))
+	change("peak goroutines", float64(baseline.Resources.PeakGoroutines), float64(report.Resources.PeakGoroutines))
+}
+
+func loadtestCommand(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	configPath := configFlag(flags)
+	var options loadOptions
+	flags.IntVar(&options.Invoices, "invoices", 1000, "number of payment requests to enqueue")
+	flags.DurationVar(&options.PayDelay, "pay-delay", 500*time.Millisecond, "time a customer takes to pay after the request is acknowledged")
+	flags.Float64Var(&options.PaymentRate, "rate", 0, "payments made per second, 0 pays each request once its delay has passed")
+	flags.DurationVar(&options.Timeout, "timeout", 5*time.Minute, "longest to wait for every request to finish")
+	reportPath := flags.String("report", "", "write the JSON report to this file instead of stdout")
+	baselinePath := flags.String("baseline", "", "a previous JSON report to compare the run with")
+	flags.Parse(args)
+	if flags.NArg() != 0 || options.Invoices <= 0 {
+		return errUsage
+	}
+
+	config, err := structs.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	logger := logging.New("error")
+
+	report, err := runLoad(config, options, logger)
+	if err != nil {
+		return err
+	}
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if *reportPath == "" {
+		fmt.Fprintln(output, string(data))
+	} else if err := os.WriteFile(*reportPath, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+
+	if *baselinePath != "" {
+		var baseline loadReport
+		data, err := os.ReadFile(*baselinePath)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			return fmt.Errorf("error reading baseline report %s: %v", *baselinePath, err)
+		}
+		compareReports(baseline, report)
+	}
+	return nil
+}
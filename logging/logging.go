@@ -0,0 +1,48 @@
+package logging
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+//Field names carried by every line logged for a payment request
+const (
+	WorkerID           = "worker_id"
+	DestinationAddress = "destination_address"
+	Hash               = "hash"
+)
+
+//New returns a JSON logger writing to stdout at the level named by level: "debug", "info", "warn" or
+//"error".  Unknown levels log at info.
+func New(level string) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: ParseLevel(level)}))
+}
+
+//ParseLevel converts a level name to a slog level, defaulting to info.
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+//Payment returns a logger carrying the correlation fields of a payment request.  Fields that are not
+//known yet, such as the hash before a block is seen, are logged empty so every line has the same shape.
+func Payment(logger *slog.Logger, workerID string, destinationAddress string, hash string) *slog.Logger {
+	return logger.With(WorkerID, workerID, DestinationAddress, destinationAddress, Hash, hash)
+}
+
+//OrDefault returns the logger, or the default logger when it is nil.
+func OrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
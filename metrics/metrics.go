@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "nanopp"
+
+//Terminal statuses of a payment worker that are counted as outcomes
+var outcomes = map[string]bool{"success": true, "overpayment": true, "underpayment": true, "timeout": true, "cancelled": true, "within_tolerance": true}
+
+var (
+	//ActiveWorkers is the number of payment requests currently holding a worker slot
+	ActiveWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_workers",
+		Help:      "Payment requests currently holding a worker slot.",
+	})
+
+	//WorkerLimit is the most payment workers allowed to run at once
+	WorkerLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_limit",
+		Help:      "Most payment workers allowed to run at once.",
+	})
+
+	//WaitingDeliveries is the number of queue deliveries held unacked while waiting for a worker slot
+	WaitingDeliveries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deliveries_waiting_for_worker",
+		Help:      "Payment requests held unacked while the worker limit is full.",
+	})
+
+	//ReturnedDeliveries counts the queue deliveries handed back to the queue by the unacked depth limit
+	ReturnedDeliveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_returned_total",
+		Help:      "Payment requests handed back to the queue while the worker limit was full and too many were unacked.",
+	})
+
+	//RequestsConsumed counts the payment requests taken from the queue by each consumer
+	RequestsConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_consumed_total",
+		Help:      "Payment requests consumed from the queue, by consumer.",
+	}, []string{"consumer"})
+
+	//LastConsumed is the time each consumer last took a payment request
+	LastConsumed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_last_consumed_timestamp_seconds",
+		Help:      "Unix time each consumer last consumed a payment request.",
+	}, []string{"consumer"})
+
+	//Outcomes counts the finished payment requests by status
+	Outcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payment_outcomes_total",
+		Help:      "Finished payment requests, by status.",
+	}, []string{"status"})
+
+	//TimeToFirstSeen is the time from a worker starting to the payment's block first being seen
+	TimeToFirstSeen = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_first_seen_seconds",
+		Help:      "Time from a payment worker starting to the payment block being seen.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60},
+	})
+
+	//TimeToConfirmation is the time from a worker starting to the payment's outcome
+	TimeToConfirmation = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_confirmation_seconds",
+		Help:      "Time from a payment worker starting to the payment outcome.",
+		Buckets:   []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	})
+
+	//RPCDuration is the latency of the calls to the node, by action
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Latency of node RPC calls, by action.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 3},
+	}, []string{"action"})
+
+	//RPCErrors counts the failed calls to the node, by action
+	RPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed node RPC calls, by action.",
+	}, []string{"action"})
+
+	//WebsocketReconnects counts the reconnections to the node websocket
+	WebsocketReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_reconnects_total",
+		Help:      "Reconnections to the node websocket.",
+	})
+
+	//WebsocketMessages counts the messages received from the node websocket
+	WebsocketMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_messages_total",
+		Help:      "Messages received from the node websocket.",
+	})
+
+	//PublishFailures counts the failed writes of events and queue messages to redis, by kind
+	PublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_publish_failures_total",
+		Help:      "Failed redis publishes, by kind (publish, append, queue).",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ActiveWorkers,
+		WorkerLimit,
+		WaitingDeliveries,
+		ReturnedDeliveries,
+		RequestsConsumed,
+		LastConsumed,
+		Outcomes,
+		TimeToFirstSeen,
+		TimeToConfirmation,
+		RPCDuration,
+		RPCErrors,
+		WebsocketReconnects,
+		WebsocketMessages,
+		PublishFailures,
+	)
+}
+
+//workerTimes holds the time each running worker started and whether its block has been seen
+var workerTimes = struct {
+	sync.Mutex
+	started map[string]time.Time
+	seen    map[string]bool
+}{started: make(map[string]time.Time), seen: make(map[string]bool)}
+
+//WorkerStarted records the start of the worker for the timing histograms.
+func WorkerStarted(workerID string) {
+	workerTimes.Lock()
+	defer workerTimes.Unlock()
+	workerTimes.started[workerID] = time.Now()
+	delete(workerTimes.seen, workerID)
+}
+
+//BlockSeen observes the time to first seen the first time a block is seen for the worker.
+func BlockSeen(workerID string) {
+	workerTimes.Lock()
+	defer workerTimes.Unlock()
+	started, ok := workerTimes.started[workerID]
+	if !ok || workerTimes.seen[workerID] {
+		return
+	}
+	workerTimes.seen[workerID] = true
+	TimeToFirstSeen.Observe(time.Since(started).Seconds())
+}
+
+//WorkerStatus counts terminal statuses as outcomes and observes the time to confirmation.  Statuses
+//that are not terminal are ignored.
+func WorkerStatus(workerID string, status string) {
+	if !outcomes[status] {
+		return
+	}
+	Outcomes.WithLabelValues(status).Inc()
+
+	workerTimes.Lock()
+	defer workerTimes.Unlock()
+	// Only a payment has a time to confirmation
+	if started, ok := workerTimes.started[workerID]; ok && status != "timeout" && status != "cancelled" {
+		TimeToConfirmation.Observe(time.Since(started).Seconds())
+	}
+	delete(workerTimes.started, workerID)
+	delete(workerTimes.seen, workerID)
+}
+
+//WorkerStopped forgets a worker that stopped without an outcome, such as one checkpointed on shutdown.
+func WorkerStopped(workerID string) {
+	workerTimes.Lock()
+	defer workerTimes.Unlock()
+	delete(workerTimes.started, workerID)
+	delete(workerTimes.seen, workerID)
+}
+
+//ObserveRPC records the latency of a node call and counts it if it failed.
+func ObserveRPC(action string, started time.Time, err error) {
+	RPCDuration.WithLabelValues(action).Observe(time.Since(started).Seconds())
+	if err != nil {
+		RPCErrors.WithLabelValues(action).Inc()
+	}
+}
+
+//Register adds another collector, such as the dispatcher, to the served metrics.  A collector that can't
+//be registered is logged and left out.
+func Register(logger *slog.Logger, collector prometheus.Collector) {
+	if err := prometheus.Register(collector); err != nil {
+		logger.Error("error registering metrics collector", "error", err)
+	}
+}
+
+//RegisterQueue reports the depth of the named queue, read through depth at each scrape.
+func RegisterQueue(logger *slog.Logger, name string, depth func() (ready int, unacked int, rejected int)) {
+	gauge := func(metric string, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        metric,
+			Help:        help,
+			ConstLabels: prometheus.Labels{"queue": name},
+		}, value)
+	}
+	Register(logger, gauge("queue_ready", "Deliveries waiting in the queue.", func() float64 {
+		ready, _, _ := depth()
+		return float64(ready)
+	}))
+	Register(logger, gauge("queue_unacked", "Deliveries taken from the queue and not yet acked.", func() float64 {
+		_, unacked, _ := depth()
+		return float64(unacked)
+	}))
+	Register(logger, gauge("queue_rejected", "Deliveries rejected from the queue.", func() float64 {
+		_, _, rejected := depth()
+		return float64(rejected)
+	}))
+}
+
+//Handler returns the HTTP handler serving the registered metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
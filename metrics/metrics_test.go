@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWorkerStatusOutcomes(t *testing.T) {
+	for i, status := range []string{"success", "cancelled", "within_tolerance"} {
+		before := testutil.ToFloat64(Outcomes.WithLabelValues(status))
+
+		WorkerStarted("worker")
+		BlockSeen("worker")
+		BlockSeen("worker")
+		WorkerStatus("worker", "pending")
+		WorkerStatus("worker", status)
+
+		if got := testutil.ToFloat64(Outcomes.WithLabelValues(status)); got != before+1 {
+			t.Errorf("got %v %s outcomes want %v", got, status, before+1)
+		}
+		if got := testutil.CollectAndCount(Outcomes, "nanopp_payment_outcomes_total"); got != i+1 {
+			t.Errorf("got %d outcome series want %d, pending must not be counted", got, i+1)
+		}
+
+		workerTimes.Lock()
+		if len(workerTimes.started) != 0 || len(workerTimes.seen) != 0 {
+			t.Errorf("expected the worker finished as %s to be forgotten", status)
+		}
+		workerTimes.Unlock()
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"log/slog"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	poolInUseDesc        = prometheus.NewDesc("nanopp_redis_pool_in_use", "Redis connections checked out of the pool.", nil, nil)
+	poolIdleDesc         = prometheus.NewDesc("nanopp_redis_pool_idle", "Idle redis connections in the pool.", nil, nil)
+	poolActiveDesc       = prometheus.NewDesc("nanopp_redis_pool_active", "Redis connections open in the pool, idle or in use.", nil, nil)
+	poolWaitDesc         = prometheus.NewDesc("nanopp_redis_pool_wait_total", "Times a caller waited for a redis connection.", nil, nil)
+	poolWaitDurationDesc = prometheus.NewDesc("nanopp_redis_pool_wait_seconds_total", "Time spent waiting for redis connections.", nil, nil)
+)
+
+//poolCollector exports the stats of a redis pool
+type poolCollector struct {
+	pool *redis.Pool
+}
+
+//RegisterPool reports the stats of the redis pool at each scrape.
+func RegisterPool(logger *slog.Logger, pool *redis.Pool) {
+	Register(logger, poolCollector{pool: pool})
+}
+
+func (c poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolInUseDesc
+	ch <- poolIdleDesc
+	ch <- poolActiveDesc
+	ch <- poolWaitDesc
+	ch <- poolWaitDurationDesc
+}
+
+func (c poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.pool.Stats()
+	ch <- prometheus.MustNewConstMetric(poolInUseDesc, prometheus.GaugeValue, float64(stats.ActiveCount-stats.IdleCount))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.IdleCount))
+	ch <- prometheus.MustNewConstMetric(poolActiveDesc, prometheus.GaugeValue, float64(stats.ActiveCount))
+	ch <- prometheus.MustNewConstMetric(poolWaitDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(poolWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
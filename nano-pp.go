@@ -1,16 +1,31 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	bb "nano-pp/block_broadcaster"
+	"nano-pp/codec"
+	"nano-pp/dispatcher"
+	"nano-pp/eventlog"
+	"nano-pp/health"
+	"nano-pp/logging"
+	"nano-pp/metrics"
+	nano "nano-pp/nanocurrency"
+	"nano-pp/nanocurrency/nanostructs"
 	"nano-pp/nanoredis"
+	"nano-pp/paymentapi"
 	structs "nano-pp/paymentstructs"
+	"nano-pp/pricing"
+	"nano-pp/store"
 	workers "nano-pp/workers"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/adjust/rmq"
@@ -18,94 +33,419 @@ import (
 	"github.com/google/uuid"
 )
 
-//Consumer reads messages from the message queue
+//Consumer reads messages from the message queue.  The count and time of the last request are exported
+//as metrics under the consumer's name.
 type Consumer struct {
-	name   string
-	count  int
-	before time.Time
+	name       string
+	queue      string
+	count      int
+	before     time.Time
+	store      store.Store
+	dispatcher *dispatcher.Dispatcher
+	lifecycle  *workers.Lifecycle
+	logger     *slog.Logger
+	config     structs.Config
+	oracle     pricing.Oracle
 }
 
-//readPaymentRequest converts a payload to a PaymentRequest struct
-func readPaymentRequest(data string) structs.PaymentRequest {
-	var paymentRequest structs.PaymentRequest
-	d := json.NewDecoder(strings.NewReader(string(data)))
-	d.Decode(&paymentRequest)
-	fmt.Println("Received new payment request:", paymentRequest)
+//readPaymentRequest decodes a payload in either wire format to a PaymentRequest struct
+func readPaymentRequest(logger *slog.Logger, data string) structs.PaymentRequest {
+	paymentRequest, err := codec.DecodePaymentRequest(data)
+	if err != nil {
+		logger.Error("error decoding payment request", "error", err)
+	}
 
 	return paymentRequest
 }
 
-//acknowledge sends an acknowledgement message to the middleware
-func acknowledge(pool *redis.Pool, destinationAddress string, amount string, workerID uuid.UUID) {
-	var ack structs.Ack
-	ack.DestinationAddress = destinationAddress
-	ack.ExpectedAmount = amount
-	ack.WorkerID = workerID.String()
-
-	data, err := json.Marshal(ack)
+//acknowledge sends an acknowledgement message to the middleware in the configured wire format
+func acknowledge(st store.Store, wire codec.Codec, logger *slog.Logger, ack structs.Ack) {
+	data, err := wire.EncodeAck(ack)
 	if err != nil {
-		fmt.Println("Error converting json for payment request:", err)
+		logger.Error("error encoding acknowledgement", "error", err, "content_type", wire.ContentType())
 	}
-	ackC := pool.Get()
-	_, pubErr := ackC.Do("PUBLISH", fmt.Sprintf("ack.%s", destinationAddress), string(data))
+	pubErr := st.Publish(store.AckChannel(ack.DestinationAddress), data)
 	if pubErr != nil {
-		fmt.Println("Error publishing acknowledgement:", pubErr)
+		logger.Error("error publishing acknowledgement", "error", pubErr)
 	}
 }
 
-//newConsumer creates a new message consumer for the Redis message queue
-func newConsumer(tag int) *Consumer {
+//newConsumer creates a new message consumer for the named Redis message queue.  The oracle prices fiat
+//payment requests and may be nil if they aren't accepted.
+func newConsumer(tag int, queue string, st store.Store, d *dispatcher.Dispatcher, lc *workers.Lifecycle, logger *slog.Logger, config structs.Config, oracle pricing.Oracle) *Consumer {
+	name := fmt.Sprintf("consumer %d", tag)
 	return &Consumer{
-		name:   fmt.Sprintf("consumer %d", tag),
-		count:  0,
-		before: time.Now(),
+		name:       name,
+		queue:      queue,
+		count:      0,
+		before:     time.Now(),
+		store:      st,
+		dispatcher: d,
+		lifecycle:  lc,
+		logger:     logger.With("consumer", name),
+		config:     config,
+		oracle:     oracle,
 	}
 }
 
-//Consume will pull a message from the request queue and start a new payment worker
+//Consume will pull a message from the request queue and start a new payment worker.  A request
+//checkpointed by another processor, read from the checkpoint queue, keeps its worker ID and is not
+//acknowledged again.  While the worker limit is full Consume waits with the delivery unacked, so further
+//requests stay in the queue, unless the queue already holds more than max_unacked deliveries unacked.
+//The delivery is then handed back to the queue for a processor with free slots.
 func (consumer *Consumer) Consume(delivery rmq.Delivery) {
+	if consumer.handBack(delivery) {
+		return
+	}
 	consumer.count++
 	consumer.before = time.Now()
+	metrics.RequestsConsumed.WithLabelValues(consumer.name).Inc()
+	metrics.LastConsumed.WithLabelValues(consumer.name).Set(float64(consumer.before.Unix()))
+
+	paymentRequest := readPaymentRequest(consumer.logger, delivery.Payload())
+	workerID := paymentRequest.WorkerID
+	resumed := consumer.queue == store.CheckpointQueue
+	if !resumed {
+		// Only a processor sets these, on the requests it checkpoints
+		workerID = uuid.New().String()
+		paymentRequest.WorkerID = ""
+		paymentRequest.ValidationHash = ""
+	} else if workerID == "" {
+		plog := logging.Payment(consumer.logger, "", paymentRequest.DestinationAddress, "")
+		plog.Error("dropped a checkpoint without a worker ID")
+		delivery.Reject()
+		return
+	}
 
-	fmt.Printf("consumer %s processing request number %v", consumer.name, consumer.count)
+	plog := logging.Payment(consumer.logger, workerID, paymentRequest.DestinationAddress, paymentRequest.ValidationHash)
+	plog.Info("received new payment request", "request_number", consumer.count, "amount", paymentRequest.Amount, "resumed", resumed)
 
-	pool := nanoredis.NewPool()
+	if _, err := structs.ParseTolerance(paymentRequest.Tolerance); err != nil && !resumed {
+		consumer.reject(delivery, plog, paymentRequest, err)
+		return
+	}
+
+	// A fiat request is locked to raw at the current price once, so a resumed request keeps its amount
+	if !resumed && paymentRequest.FiatAmount != "" && paymentRequest.Amount == "" {
+		amount, rate, err := pricing.Lock(consumer.oracle, paymentRequest.FiatAmount, paymentRequest.Currency)
+		if err != nil {
+			consumer.reject(delivery, plog, paymentRequest, fmt.Errorf("error pricing fiat payment request: %v", err))
+			return
+		}
+		paymentRequest.Amount = amount
+		paymentRequest.Currency = strings.ToUpper(paymentRequest.Currency)
+		paymentRequest.Rate = rate
+		plog.Info("locked fiat payment request", "amount", amount, "fiat_amount", paymentRequest.FiatAmount, "currency", paymentRequest.Currency, "rate", rate)
+	}
 
-	paymentRequest := readPaymentRequest(delivery.Payload())
-	workerID := uuid.New()
+	// A merchant with a static address tells its requests apart by a unique suffix to the amount
+	requested := paymentRequest.Amount
+	policy := consumer.config.Policy(paymentRequest.Merchant, paymentRequest.DestinationAddress)
+	if !resumed && policy.UniqueAmounts {
+		tagged, err := workers.TagAmount(consumer.store, policy, paymentRequest, workerID)
+		if err != nil {
+			consumer.reject(delivery, plog, paymentRequest, err)
+			return
+		}
+		paymentRequest.Amount = tagged
+		plog.Info("reserved a unique amount", "amount", tagged, "requested_amount", requested)
+	}
 
-	acknowledge(pool, paymentRequest.DestinationAddress, paymentRequest.Amount, workerID)
+	started := consumer.lifecycle.Go(workerID, func() {
+		workers.PaymentRequestWorker(consumer.store, consumer.dispatcher, consumer.lifecycle, consumer.logger, consumer.config, paymentRequest, workerID)
+	})
+	if !started {
+		// Shutting down, leave the request for another processor
+		if policy.UniqueAmounts && !resumed {
+			consumer.store.ReleaseAmount(paymentRequest.DestinationAddress, paymentRequest.Amount, workerID)
+		}
+		if err := consumer.store.OpenQueue(consumer.queue).Publish(delivery.Payload()); err != nil {
+			plog.Error("error requeueing payment request", "error", err)
+			delivery.Reject()
+			return
+		}
+		delivery.Ack()
+		return
+	}
+	delivery.Ack()
 
-	go workers.PaymentRequestWorker(pool, paymentRequest, workerID.String())
+	if !resumed {
+		ack := consumer.ack(paymentRequest, workerID)
+		if paymentRequest.Amount != requested {
+			ack.RequestedAmount = requested
+		}
+		acknowledge(consumer.store, codec.For(consumer.config.WireFormat), plog, ack)
+	}
 }
 
-func main() {
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+//handBack returns the delivery to its queue when every worker slot is taken and the queue's unacked
+//depth is above the limit, and then pauses the consumer for a poll so it slows to one delivery per poll.
+//It returns false when the delivery should be consumed.
+func (consumer *Consumer) handBack(delivery rmq.Delivery) bool {
+	if !consumer.lifecycle.Full() {
+		return false
+	}
+	queue := consumer.store.OpenQueue(consumer.queue)
+	if queue.Depth().Unacked <= consumer.config.MaxUnacked {
+		return false
+	}
+	if err := queue.Publish(delivery.Payload()); err != nil {
+		consumer.logger.Error("error handing a payment request back to the queue", "error", err)
+		return false
+	}
+	delivery.Ack()
+	metrics.ReturnedDeliveries.Inc()
+	time.Sleep(time.Duration(consumer.config.PollDuration) * time.Millisecond)
+	return true
+}
 
-	config := structs.LoadConfig()
+//reject acknowledges a payment request that can't be watched with an Ack giving the reason, without
+//starting a worker
+func (consumer *Consumer) reject(delivery rmq.Delivery, logger *slog.Logger, paymentRequest structs.PaymentRequest, err error) {
+	logger.Warn("rejected payment request", "error", err)
+	ack := consumer.ack(paymentRequest, "")
+	ack.Error = err.Error()
+	delivery.Ack()
+	acknowledge(consumer.store, codec.For(consumer.config.WireFormat), logger, ack)
+}
 
-	ppID := uuid.New()
+//ack returns the acknowledgement of a payment request taken by the worker, with its payment URI and, when
+//a stream secret is configured, the token opening its payment stream
+func (consumer *Consumer) ack(paymentRequest structs.PaymentRequest, workerID string) structs.Ack {
+	policy := consumer.config.Policy(paymentRequest.Merchant, paymentRequest.DestinationAddress)
+	ack := structs.Ack{
+		DestinationAddress: paymentRequest.DestinationAddress,
+		ExpectedAmount:     paymentRequest.Amount,
+		WorkerID:           workerID,
+		FiatAmount:         paymentRequest.FiatAmount,
+		Currency:           paymentRequest.Currency,
+		Rate:               paymentRequest.Rate,
+		RequestID:          paymentRequest.RequestID,
+	}
+	if workerID == "" {
+		// Rejected before a worker was started
+		return ack
+	}
+	ack.PaymentURI = nano.PaymentURI(paymentRequest.DestinationAddress, paymentRequest.Amount, policy.Label, paymentRequest.Message)
+	if consumer.config.StreamSecret != "" {
+		ttl := time.Duration(consumer.config.StreamTokenTTL) * time.Second
+		ack.Token = paymentapi.IssueToken([]byte(consumer.config.StreamSecret), workerID, paymentRequest.DestinationAddress, ttl)
+	}
+	return ack
+}
+
+//serveHTTP serves /metrics, /healthz and /readyz on the address until stop is closed
+func serveHTTP(logger *slog.Logger, address string, checker *health.Checker, stop <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", checker.Healthz)
+	mux.HandleFunc("/readyz", checker.Readyz)
+	listen(logger, "metrics and health checks", address, mux, stop)
+}
 
-	pool := nanoredis.NewPool()
-	defer pool.Close()
+//serveAPI serves the payment streams and QR codes for checkout pages on the address until stop is closed
+func serveAPI(st store.Store, logger *slog.Logger, config structs.Config, stop <-chan struct{}) {
+	mux := http.NewServeMux()
+	paymentapi.NewStreams(st, logger, []byte(config.StreamSecret)).Register(mux)
+	mux.HandleFunc("GET /qr", paymentapi.ServeQR)
+	listen(logger, "the checkout API", config.HTTPAddress, mux, stop)
+}
+
+//listen serves the handler on the address until stop is closed
+func listen(logger *slog.Logger, name string, address string, handler http.Handler, stop <-chan struct{}) {
+	server := &http.Server{Addr: address, Handler: handler}
 
-	rmqConn := rmq.OpenConnection("PaymentRequests", "tcp", fmt.Sprintf("%s:%s", config.RedisHost, config.RedisPort), 1)
-	paymentQueue := rmqConn.OpenQueue("PaymentRequestQueue")
+	go func() {
+		<-stop
+		server.Close()
+	}()
 
-	paymentQueue.StartConsuming(10, 500*time.Millisecond)
-	for i := 0; i < 3; i++ {
-		paymentQueue.AddConsumer(fmt.Sprintf("%s-paymentworker", ppID.String()), newConsumer(i))
+	logger.Info("serving "+name, "address", address)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error("error serving "+name, "error", err)
 	}
+}
 
-	go bb.BlockBroadcaster()
+//shutdown stops taking payment requests, then gives the running workers the grace period to finish while
+//confirmations still arrive.  Workers still running afterwards checkpoint their requests.  New workers are
+//refused first, so consumers waiting for a worker slot requeue their request and the queues can stop.
+func shutdown(logger *slog.Logger, lifecycle *workers.Lifecycle, queues []store.Queue, grace time.Duration) {
+	lifecycle.StopStarting()
 
-	for {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, queue := range queues {
 		select {
-		case <-interrupt:
-			log.Println("Disconnecting from payment processor.")
-			return
+		case <-queue.StopConsuming():
+		case <-ctx.Done():
+			logger.Warn("timed out waiting for consumers to stop")
 		}
 	}
+	if !lifecycle.Drain(grace) {
+		logger.Info("checkpointed unfinished payment workers")
+	}
+}
+
+//openStore connects to the store of the configured backend, returning the redis pool behind it if there
+//is one.  Nothing is started in the background.
+func openStore(config structs.Config) (store.Store, *redis.Pool, error) {
+	ttl := store.TTLPolicy{
+		RequestTimeout:   time.Duration(config.MaxTimeout()) * time.Second,
+		WorkingRetention: time.Duration(config.WorkingRetention) * time.Second,
+		ResultRetention:  time.Duration(config.ResultRetention) * time.Second,
+	}
+	if config.StoreBackend == "memory" {
+		return store.NewMemoryWithTTL(ttl), nil, nil
+	}
+
+	publisher, err := eventlog.NewPublisher(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	options := nanoredis.NewOptions(config)
+	pool, err := nanoredis.NewPool(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rmqConn, err := nanoredis.NewRMQConnection(config.KeyPrefix+"PaymentRequests", options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return store.NewRedis(pool, rmqConn, publisher, store.RedisOptions{Prefix: config.KeyPrefix, TTL: ttl}), pool, nil
+}
+
+//newStore returns the store for the configured backend, exporting the metrics of its pool and running
+//the janitor until stop is closed
+func newStore(config structs.Config, logger *slog.Logger, stop <-chan struct{}) (store.Store, error) {
+	st, pool, err := openStore(config)
+	if err != nil || pool == nil {
+		return st, err
+	}
+	metrics.RegisterPool(logger, pool)
+
+	if config.JanitorInterval > 0 {
+		janitor := store.NewJanitor(pool, config.KeyPrefix)
+		janitor.DryRun = config.JanitorDryRun
+		janitor.Logger = logger
+		go janitor.Run(time.Duration(config.JanitorInterval)*time.Second, stop)
+	}
+
+	return st, nil
+}
+
+//serve runs the payment processor until it is interrupted
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := configFlag(flags)
+	replayPath := flags.String("replay", "", "replay a websocket recording instead of connecting to the node websocket")
+	replaySpeed := flags.Float64("replay-speed", 1, "speed up the replay by this factor, 0 replays as fast as possible")
+	flags.Parse(args)
+
+	config, err := structs.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	ppID := uuid.New()
+
+	logger := logging.New(config.LogLevel).With("processor_id", ppID.String())
+	slog.SetDefault(logger)
+
+	// Closed on shutdown to stop the websocket, dispatcher and janitor
+	stop := make(chan struct{})
+
+	st, err := newStore(config, logger, stop)
+	if err != nil {
+		return fmt.Errorf("error connecting to the store: %v", err)
+	}
+
+	// A single dispatcher decodes the node confirmations and routes them to the payment workers
+	confirmations := dispatcher.New(st, logger)
+	go confirmations.Run(stop)
+	metrics.Register(logger, confirmations)
+
+	websocket := bb.NewConnectionState()
+	if config.MetricsAddress != "" {
+		rpc := nanostructs.NanoRPC{Host: config.RPCHost, Port: config.RPCPort, Logger: logger}
+		checker := health.NewChecker(st, websocket, rpc, health.Thresholds{
+			WebsocketDown:  time.Duration(config.WebsocketDownLimit) * time.Second,
+			MaxUnchecked:   uint64(config.NodeMaxUnchecked),
+			MaxCementedLag: uint64(config.NodeMaxCementedLag),
+		})
+		go serveHTTP(logger, config.MetricsAddress, checker, stop)
+	}
+
+	if config.GRPCAddress != "" {
+		go func() {
+			if err := paymentapi.Serve(st, codec.For(config.WireFormat), logger, config.GRPCAddress, stop); err != nil {
+				logger.Error("error serving the gRPC payment service", "error", err)
+			}
+		}()
+	}
+
+	if config.HTTPAddress != "" {
+		go serveAPI(st, logger, config, stop)
+	}
+
+	oracle, err := pricing.New(config)
+	if err != nil {
+		return fmt.Errorf("error creating the price oracle: %v", err)
+	}
+
+	lifecycle := workers.NewLifecycle(logger, config.MaxWorkers)
+
+	paymentQueue := st.OpenQueue(store.PaymentRequestQueue)
+	metrics.RegisterQueue(logger, store.PaymentRequestQueue, func() (int, int, int) {
+		depth := paymentQueue.Depth()
+		return depth.Ready, depth.Unacked, depth.Rejected
+	})
+
+	checkpointQueue := st.OpenQueue(store.CheckpointQueue)
+	metrics.RegisterQueue(logger, store.CheckpointQueue, func() (int, int, int) {
+		depth := checkpointQueue.Depth()
+		return depth.Ready, depth.Unacked, depth.Rejected
+	})
+
+	poll := time.Duration(config.PollDuration) * time.Millisecond
+	paymentQueue.StartConsuming(config.PrefetchLimit, poll)
+	checkpointQueue.StartConsuming(config.PrefetchLimit, poll)
+	for i := 0; i < config.Consumers; i++ {
+		paymentQueue.AddConsumer(fmt.Sprintf("%s-paymentworker", ppID.String()), newConsumer(i, store.PaymentRequestQueue, st, confirmations, lifecycle, logger, config, oracle))
+		checkpointQueue.AddConsumer(fmt.Sprintf("%s-checkpointworker", ppID.String()), newConsumer(i, store.CheckpointQueue, st, confirmations, lifecycle, logger, config, oracle))
+	}
+
+	var broadcaster sync.WaitGroup
+	broadcaster.Add(1)
+	go func() {
+		defer broadcaster.Done()
+		if *replayPath == "" {
+			bb.BlockBroadcaster(st, config, logger, websocket, stop)
+			return
+		}
+		// Replayed frames stand in for the node websocket, which is never connected
+		websocket.SetConnected(true)
+		logger.Info("replaying websocket recording", "path", *replayPath, "speed", *replaySpeed)
+		replayed, err := bb.Replay(st, logger, *replayPath, *replaySpeed, stop)
+		if err != nil {
+			logger.Error("error replaying websocket recording", "error", err)
+		}
+		logger.Info("finished replaying websocket recording", "frames", replayed)
+	}()
+
+	sig := <-interrupt
+	logger.Info("shutting down payment processor", "signal", sig.String())
+
+	shutdown(logger, lifecycle, []store.Queue{paymentQueue, checkpointQueue}, time.Duration(config.ShutdownGrace)*time.Second)
+
+	close(stop)
+	broadcaster.Wait()
 
+	st.Close()
+	logger.Info("disconnected from payment processor")
+	return nil
 }
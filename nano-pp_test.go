@@ -1,22 +1,392 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"log/slog"
+	"nano-pp/codec"
+	"nano-pp/dispatcher"
+	"nano-pp/metrics"
+	"nano-pp/nanocurrency/fakenode"
+	"nano-pp/paymentapi"
+	"nano-pp/paymentpb"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/pricing"
+	"nano-pp/store"
+	"nano-pp/store/storetest"
+	"nano-pp/workers"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
-func TestHello(t *testing.T) {
-	c, err := redis.Dial("tcp", ":6379")
+//waitFor polls until the condition holds, failing the test after five seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPaymentRequestOffline(t *testing.T) {
+	node := fakenode.New(t)
+	st, _, _ := storetest.NewRedis(t, store.RedisOptions{})
+	node.Relay(t, st)
+
+	config := structs.DefaultConfig()
+	node.Configure(&config)
+	config.TimeoutDuration = 10
+
+	stop := make(chan struct{})
+	defer close(stop)
+	d := dispatcher.New(st, slog.Default())
+	go d.Run(stop)
+
+	lc := workers.NewLifecycle(slog.Default(), 1)
+	request := structs.PaymentRequest{DestinationAddress: "nano_1merchant", Amount: "1000"}
+	lc.Go("worker", func() {
+		workers.PaymentRequestWorker(st, d, lc, slog.Default(), config, request, "worker")
+	})
+
+	// Known blocks are recorded once the worker is listening for confirmations
+	waitFor(t, "the worker to record known blocks", func() bool { return node.Calls("pending") > 0 })
+	node.Confirm(node.Send("nano_1customer", "nano_1merchant", "1000"))
+
+	waitFor(t, "the payment to succeed", func() bool {
+		status, _ := st.Status("worker")
+		return status == "success"
+	})
+	lc.Drain(15 * time.Second)
+}
+
+func TestShutdownWithWorkersFull(t *testing.T) {
+	node := fakenode.New(t)
+	st := store.NewMemory()
+	node.Relay(t, st)
+
+	config := structs.DefaultConfig()
+	node.Configure(&config)
+	config.TimeoutDuration = 60
+
+	stop := make(chan struct{})
+	defer close(stop)
+	d := dispatcher.New(st, slog.Default())
+	go d.Run(stop)
+
+	// One worker slot, so the consumer of the second request waits in the lifecycle for the first to finish
+	lc := workers.NewLifecycle(slog.Default(), 1)
+	queues := []store.Queue{st.OpenQueue(store.PaymentRequestQueue), st.OpenQueue(store.CheckpointQueue)}
+	for _, name := range []string{store.PaymentRequestQueue, store.CheckpointQueue} {
+		queue := st.OpenQueue(name)
+		queue.StartConsuming(config.PrefetchLimit, 10*time.Millisecond)
+		queue.AddConsumer("shutdown", newConsumer(0, name, st, d, lc, slog.Default(), config, nil))
+	}
+	for _, address := range []string{"nano_1first", "nano_1second"} {
+		request, _ := codec.JSON{}.EncodePaymentRequest(structs.PaymentRequest{DestinationAddress: address, Amount: "1000"})
+		queues[0].Publish(request)
+	}
+	waitFor(t, "the first worker to record known blocks", func() bool { return node.Calls("pending") > 0 })
+	waitFor(t, "the second request to wait for a slot", func() bool { return queues[0].Depth().Unacked == 1 })
+
+	started := time.Now()
+	shutdown(slog.Default(), lc, queues, time.Second)
+	if elapsed := time.Since(started); elapsed > 4*time.Second {
+		t.Errorf("shutdown took %v, the consumer waiting for a slot held it up", elapsed)
+	}
+	if depth := queues[0].Depth(); depth.Ready != 1 {
+		t.Errorf("got queue depth %+v want the waiting request requeued", depth)
+	}
+	if depth := queues[1].Depth(); depth.Ready != 1 {
+		t.Errorf("got checkpoint queue depth %+v want the running request checkpointed", depth)
+	}
+}
+
+func TestHandBackAboveMaxUnacked(t *testing.T) {
+	st := store.NewMemory()
+	config := structs.DefaultConfig()
+	config.MaxUnacked = 1
+	config.PollDuration = 10
+
+	// The only worker slot is taken until the test releases it
+	lc := workers.NewLifecycle(slog.Default(), 1)
+	release := make(chan struct{})
+	lc.Go("running", func() { <-release })
+
+	queue := st.OpenQueue(store.PaymentRequestQueue)
+	queue.StartConsuming(config.PrefetchLimit, 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		queue.AddConsumer("backpressure", newConsumer(i, store.PaymentRequestQueue, st, nil, lc, slog.Default(), config, nil))
+	}
+	returned := testutil.ToFloat64(metrics.ReturnedDeliveries)
+	for _, address := range []string{"nano_1first", "nano_1second"} {
+		request, _ := codec.JSON{}.EncodePaymentRequest(structs.PaymentRequest{DestinationAddress: address, Amount: "1000"})
+		queue.Publish(request)
+	}
+
+	// One request waits unacked for the slot and the other is handed back to the queue rather than held too
+	waitFor(t, "a request to be handed back", func() bool { return testutil.ToFloat64(metrics.ReturnedDeliveries) > returned })
+	waitFor(t, "the request to be ready in the queue", func() bool {
+		depth := queue.Depth()
+		return depth.Ready == 1 && depth.Unacked == 1
+	})
+
+	lc.StopStarting()
+	<-queue.StopConsuming()
+	close(release)
+	if depth := queue.Depth(); depth.Ready != 2 || depth.Unacked != 0 {
+		t.Errorf("got queue depth %+v want both requests left in the queue", depth)
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	node := fakenode.New(t)
+	st, _, server := storetest.NewRedis(t, store.RedisOptions{})
+	st.SetStatus("worker-1", "pending")
+	st.SetStatus("worker-2", "success")
+	st.Watch("nano_1merchant", "worker-1", "1000")
+	st.AddKnownHashes("nano_1merchant", "worker-1", "KNOWN")
+	st.MarkConfirming("nano_1merchant", "worker-1")
+	pending := node.Send("nano_1customer", "nano_1merchant", "1000")
+
+	config := structs.DefaultConfig()
+	node.Configure(&config)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(fmt.Sprintf("rpc_host: %q\nrpc_port: %q\nredis_host: %s\nredis_port: %q\n",
+		config.RPCHost, config.RPCPort, server.Host(), server.Port())), 0o644)
+
+	var out bytes.Buffer
+	output = &out
+	defer func() { output = os.Stdout }()
+
+	run := func(run func([]string) error, args ...string) string {
+		t.Helper()
+		out.Reset()
+		if err := run(append([]string{"-config", path}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	if got := run(statusCommand, "worker-2"); got != "success\n" {
+		t.Errorf("got status '%s' want 'success'", got)
+	}
+	if got := run(listCommand, "--state=pending"); got != "worker-1\tpending\n" {
+		t.Errorf("got list '%s' want only worker-1", got)
+	}
+
+	report := run(inspectAddressCommand, "--clear-confirming", "nano_1merchant")
+	for _, want := range []string{`"worker_id": "worker-1"`, `"confirming": true`, `"KNOWN"`, pending} {
+		if !strings.Contains(report, want) {
+			t.Errorf("inspect-address report is missing %s:\n%s", want, report)
+		}
+	}
+	if confirming, _ := st.IsConfirming("nano_1merchant", "worker-1"); confirming {
+		t.Error("confirming flag was not cleared")
+	}
+}
+
+func TestLoadReport(t *testing.T) {
+	config := structs.DefaultConfig()
+	config.StoreBackend = "memory"
+
+	report, err := runLoad(config, loadOptions{Invoices: 20, PayDelay: 200 * time.Millisecond, Timeout: 20 * time.Second}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Outcomes["success"] != 20 || report.Unfinished != 0 {
+		t.Errorf("got outcomes %v with %d unfinished want 20 successes", report.Outcomes, report.Unfinished)
+	}
+	if report.Ack.Count != 20 || report.Success.Count != 20 || report.Success.Max < report.Ack.P50 {
+		t.Errorf("got latencies ack %+v success %+v", report.Ack, report.Success)
+	}
+	// Payments credited from the websocket settle well before the 5 second pending poll
+	if report.Settle.Max > 4000 {
+		t.Errorf("got payment to success %+v, payments were not credited from the websocket", report.Settle)
+	}
+}
+
+func TestGRPCPayments(t *testing.T) {
+	node := fakenode.New(t)
+	st := store.NewMemory()
+	node.Relay(t, st)
+
+	config := structs.DefaultConfig()
+	node.Configure(&config)
+	config.TimeoutDuration = 10
+	// The workers write protobuf while the API queues JSON, as during a migration
+	config.WireFormat = "protobuf"
+	config.StreamSecret = strings.Repeat("s", 32)
+	config.PriceSlippageBps = 100
+
+	stop := make(chan struct{})
+	defer close(stop)
+	d := dispatcher.New(st, slog.Default())
+	go d.Run(stop)
+
+	lc := workers.NewLifecycle(slog.Default(), 2)
+	queue := st.OpenQueue(store.PaymentRequestQueue)
+	queue.StartConsuming(config.PrefetchLimit, 10*time.Millisecond)
+	queue.AddConsumer("grpc", newConsumer(0, store.PaymentRequestQueue, st, d, lc, slog.Default(), config, pricing.Mock{Prices: map[string]string{"USD": "2"}}))
+	defer func() {
+		<-queue.StopConsuming()
+		lc.Drain(15 * time.Second)
+	}()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	paymentpb.RegisterPaymentServiceServer(server, paymentapi.NewServer(st, codec.JSON{}, slog.Default()))
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := paymentpb.NewPaymentServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	//watch creates a payment request to the address and watches it, returning its acknowledgement and updates
+	watch := func(address string) (*paymentpb.PaymentAck, paymentpb.PaymentService_WatchPaymentClient) {
+		ack, err := client.CreatePayment(ctx, &paymentpb.PaymentRequest{DestinationAddress: address, Amount: "1000"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		updates, err := client.WatchPayment(ctx, &paymentpb.PaymentRef{WorkerId: ack.WorkerId, DestinationAddress: address})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ack, updates
+	}
+	statuses := func(updates paymentpb.PaymentService_WatchPaymentClient) []string {
+		var got []string
+		for {
+			update, err := updates.Recv()
+			if err != nil {
+				return got
+			}
+			got = append(got, update.Status)
+		}
+	}
+
+	paid, updates := watch("nano_1merchant")
+	if paid.ExpectedAmount != "1000" || paid.WorkerId == "" || paid.Token == "" || paid.PaymentUri != "nano:nano_1merchant?amount=1000" {
+		t.Fatalf("unexpected acknowledgement %v", paid)
+	}
+	waitFor(t, "the worker to record known blocks", func() bool { return node.Calls("pending") > 0 })
+	node.Confirm(node.Send("nano_1customer", "nano_1merchant", "1000"))
+	if got := statuses(updates); fmt.Sprint(got) != "[pending success]" {
+		t.Errorf("got updates %v want [pending success]", got)
+	}
+	if status, err := client.GetPayment(ctx, &paymentpb.PaymentRef{WorkerId: paid.WorkerId}); err != nil || status.Status != "success" {
+		t.Errorf("got status %v, %v want success", status, err)
+	}
+
+	cancelled, updates := watch("nano_1other")
+	// The cancel reaches the worker once its pending poll is subscribed, so it is repeated until it does
+	for {
+		if _, err := client.CancelPayment(ctx, &paymentpb.PaymentRef{WorkerId: cancelled.WorkerId}); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := statuses(updates); fmt.Sprint(got) != "[pending cancelled]" {
+		t.Errorf("got updates %v want [pending cancelled]", got)
+	}
+
+	for _, request := range []*paymentpb.PaymentRequest{
+		{DestinationAddress: "nano_1forged", Amount: "1000", WorkerId: paid.WorkerId},
+		{DestinationAddress: "nano_1forged", Amount: "1000", ValidationHash: "forged"},
+	} {
+		if _, err := client.CreatePayment(ctx, request); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("got %v for %v want InvalidArgument", err, request)
+		}
+	}
+	// A request queued with the worker ID and hash of another request starts a new worker of its own
+	sub, err := st.Subscribe(store.AckChannel("nano_1forged"))
 	if err != nil {
-		fmt.Println("There was an error: ", err)
+		t.Fatal(err)
+	}
+	forged, _ := codec.JSON{}.EncodePaymentRequest(structs.PaymentRequest{DestinationAddress: "nano_1forged", Amount: "1000", WorkerID: paid.WorkerId, ValidationHash: "forged"})
+	queue.Publish(forged)
+	message := <-sub.Messages()
+	sub.Close()
+	ack, err := codec.DecodeAck(message.Payload)
+	if err != nil || ack.WorkerID == "" || ack.WorkerID == paid.WorkerId {
+		t.Fatalf("got acknowledgement %v, %v want a new worker ID", ack, err)
+	}
+	for {
+		if _, err := client.CancelPayment(ctx, &paymentpb.PaymentRef{WorkerId: ack.WorkerID}); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status, _ := st.Status(paid.WorkerId); status != "success" {
+		t.Errorf("got status %s for the paid request want success", status)
 	}
-	c.Close()
-	//got := Hello(c)
-	//want := "world!"
 
-	//if got != want {
-	//	t.Errorf("got '%s' want '%s'", got, want)
-	//}
+	// Concurrent requests for the same address and amount each get the acknowledgement of their own worker
+	acks := make(chan *paymentpb.PaymentAck, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ack, err := client.CreatePayment(ctx, &paymentpb.PaymentRequest{DestinationAddress: "nano_1same", Amount: "1000"})
+			if err != nil {
+				t.Error(err)
+			}
+			acks <- ack
+		}()
+	}
+	first, second := <-acks, <-acks
+	if first == nil || second == nil || first.WorkerId == second.WorkerId {
+		t.Fatalf("got acknowledgements %v and %v want different workers", first, second)
+	}
+	for _, ack := range []*paymentpb.PaymentAck{first, second} {
+		for {
+			if _, err := client.CancelPayment(ctx, &paymentpb.PaymentRef{WorkerId: ack.WorkerId}); err != nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	if _, err := client.CreatePayment(ctx, &paymentpb.PaymentRequest{DestinationAddress: "nano_1fiat", FiatAmount: "1", Currency: "EUR"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v for a currency without a price want FailedPrecondition", err)
+	}
+	calls := node.Calls("pending")
+	// 1 USD at 2 USD per NANO locks 0.5 NANO, and a payment 0.2% short is within the 1% slippage
+	fiat, err := client.CreatePayment(ctx, &paymentpb.PaymentRequest{DestinationAddress: "nano_1fiat", FiatAmount: "1", Currency: "usd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fiat.ExpectedAmount != "500000000000000000000000000000" || fiat.Rate != "2" || fiat.Currency != "USD" {
+		t.Fatalf("unexpected fiat acknowledgement %v", fiat)
+	}
+	updates, err = client.WatchPayment(ctx, &paymentpb.PaymentRef{WorkerId: fiat.WorkerId, DestinationAddress: "nano_1fiat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the fiat worker to poll", func() bool { return node.Calls("pending") > calls })
+	node.Confirm(node.Send("nano_1customer", "nano_1fiat", "499000000000000000000000000000"))
+	if got := statuses(updates); fmt.Sprint(got) != "[pending success]" {
+		t.Errorf("got updates %v want [pending success]", got)
+	}
 }
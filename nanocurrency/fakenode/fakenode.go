@@ -0,0 +1,398 @@
+//Package fakenode runs an in-process Nano node for offline integration tests.  It answers the RPC
+//actions used by the payment processor from a scriptable ledger and emits confirmation messages on
+//a websocket.  A test sends to an address with Send and decides when the block confirms with Confirm.
+package fakenode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"nano-pp/nanocurrency/nanostructs"
+	structs "nano-pp/paymentstructs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Block is a block in the fake ledger.  Sends are created by Send and receives by Receive.
+type Block struct {
+	Hash        string
+	Subtype     string
+	Account     string
+	Destination string
+	Link        string
+	Amount      string
+	Previous    string
+	Height      uint64
+	Confirmed   bool
+	Received    bool
+	Timestamp   time.Time
+
+	sequence int
+}
+
+type account struct {
+	blocks    []*Block
+	confirmed uint64
+}
+
+func (a *account) frontier() string {
+	if len(a.blocks) == 0 {
+		return ""
+	}
+	return a.blocks[len(a.blocks)-1].Hash
+}
+
+//Node is a fake Nano node serving RPC and websocket connections on local ports.
+type Node struct {
+	mu               sync.Mutex
+	blocks           map[string]*Block
+	accounts         map[string]*account
+	calls            map[string]int
+	clients          map[*client]bool
+	sequence         int
+	unchecked        uint64
+	confirmOnRequest bool
+	failing          bool
+
+	rpc *httptest.Server
+	ws  *httptest.Server
+}
+
+//Start starts a fake node with an empty ledger.  It runs until Close.
+func Start() *Node {
+	n := &Node{
+		blocks:   make(map[string]*Block),
+		accounts: make(map[string]*account),
+		calls:    make(map[string]int),
+		clients:  make(map[*client]bool),
+	}
+	n.rpc = httptest.NewServer(http.HandlerFunc(n.serveRPC))
+	n.ws = httptest.NewServer(http.HandlerFunc(n.serveWebsocket))
+	return n
+}
+
+//New starts a fake node with an empty ledger that is closed when the test finishes.
+func New(t testing.TB) *Node {
+	n := Start()
+	t.Cleanup(n.Close)
+	return n
+}
+
+//Close drops the websocket clients and stops the servers.
+func (n *Node) Close() {
+	n.Disconnect()
+	n.ws.Close()
+	n.rpc.Close()
+}
+
+func splitURL(url string) (string, string) {
+	split := strings.LastIndex(url, ":")
+	return url[:split], url[split+1:]
+}
+
+//RPC returns the host and port of the fake node's RPC server.
+func (n *Node) RPC() nanostructs.NanoRPC {
+	host, port := splitURL(n.rpc.URL)
+	return nanostructs.NanoRPC{Host: host, Port: port}
+}
+
+//WebsocketURL returns the address of the fake node's websocket.
+func (n *Node) WebsocketURL() string {
+	return "ws" + strings.TrimPrefix(n.ws.URL, "http")
+}
+
+//Configure points the node settings of a configuration at the fake node.
+func (n *Node) Configure(config *structs.Config) {
+	config.RPCHost, config.RPCPort = splitURL(n.rpc.URL)
+	config.NanoWebsocketHost, config.NanoWebsocketPort = splitURL(n.WebsocketURL())
+}
+
+//ConfirmOnRequest makes block_confirm confirm the block straight away instead of waiting for Confirm.
+func (n *Node) ConfirmOnRequest(enabled bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.confirmOnRequest = enabled
+}
+
+//Fail makes every RPC request fail with a server error and no body until it is called with false.
+func (n *Node) Fail(failing bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failing = failing
+}
+
+//SetUnchecked sets the unchecked block count reported by block_count.
+func (n *Node) SetUnchecked(count uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.unchecked = count
+}
+
+//Calls returns how many times an RPC action has been requested.
+func (n *Node) Calls(action string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.calls[action]
+}
+
+func (n *Node) account(address string) *account {
+	a, ok := n.accounts[address]
+	if !ok {
+		a = &account{}
+		n.accounts[address] = a
+	}
+	return a
+}
+
+func (n *Node) newBlock(subtype string, address string, link string, amount string) *Block {
+	n.sequence++
+	sum := sha256.Sum256([]byte(strconv.Itoa(n.sequence)))
+
+	a := n.account(address)
+	block := &Block{
+		Hash:      strings.ToUpper(hex.EncodeToString(sum[:])),
+		Subtype:   subtype,
+		Account:   address,
+		Link:      link,
+		Amount:    amount,
+		Previous:  a.frontier(),
+		Height:    uint64(len(a.blocks)) + 1,
+		Timestamp: time.Now(),
+		sequence:  n.sequence,
+	}
+	a.blocks = append(a.blocks, block)
+	n.blocks[block.Hash] = block
+	return block
+}
+
+//Send adds an unconfirmed send of amount raw from one account to another and returns its hash.
+//The block is pending for the destination until it is received.
+func (n *Node) Send(from string, to string, amount string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	block := n.newBlock("send", from, to, amount)
+	block.Destination = to
+	return block.Hash
+}
+
+//Receive adds a confirmed receive of a send to the destination account, removing it from pending.
+func (n *Node) Receive(hash string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	send, ok := n.blocks[hash]
+	if !ok || send.Subtype != "send" || send.Received {
+		return ""
+	}
+	send.Received = true
+
+	block := n.newBlock("receive", send.Destination, send.Hash, send.Amount)
+	n.cement(block)
+	return block.Hash
+}
+
+//Confirm cements a block, and the blocks before it on its account, and emits a confirmation
+//message for it to the websocket subscribers.
+func (n *Node) Confirm(hash string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.confirm(hash)
+}
+
+func (n *Node) confirm(hash string) bool {
+	block, ok := n.blocks[hash]
+	if !ok {
+		return false
+	}
+	if !block.Confirmed {
+		n.cement(block)
+		n.broadcast(block)
+	}
+	return true
+}
+
+func (n *Node) cement(block *Block) {
+	a := n.accounts[block.Account]
+	for _, b := range a.blocks[:block.Height] {
+		b.Confirmed = true
+	}
+	if block.Height > a.confirmed {
+		a.confirmed = block.Height
+	}
+}
+
+//Block returns a copy of a block in the ledger.
+func (n *Node) Block(hash string) (Block, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	block, ok := n.blocks[hash]
+	if !ok {
+		return Block{}, false
+	}
+	return *block, true
+}
+
+func (n *Node) serveRPC(w http.ResponseWriter, r *http.Request) {
+	var request map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, map[string]string{"error": "Unable to parse JSON"})
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n.calls[request["action"]]++
+
+	switch request["action"] {
+	case "pending":
+		writeJSON(w, n.pending(request))
+	case "account_history":
+		writeJSON(w, n.accountHistory(request))
+	case "account_info":
+		writeJSON(w, n.accountInfo(request))
+	case "block_info":
+		writeJSON(w, n.blockInfo(request))
+	case "block_confirm":
+		writeJSON(w, n.blockConfirm(request))
+	case "block_count":
+		writeJSON(w, n.blockCount())
+	default:
+		writeJSON(w, map[string]string{"error": "Unknown command"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (n *Node) pending(request map[string]string) interface{} {
+	active := request["include_active"] == "true" && request["include_only_confirmed"] != "true"
+
+	var sends []*Block
+	for _, block := range n.blocks {
+		if block.Subtype == "send" && block.Destination == request["account"] && !block.Received && (active || block.Confirmed) {
+			sends = append(sends, block)
+		}
+	}
+	sort.Slice(sends, func(i, j int) bool { return sends[i].sequence < sends[j].sequence })
+	if count, err := strconv.Atoi(request["count"]); err == nil && count < len(sends) {
+		sends = sends[:count]
+	}
+
+	blocks := make([]string, 0, len(sends))
+	for _, block := range sends {
+		blocks = append(blocks, block.Hash)
+	}
+	return nanostructs.Pending{Blocks: blocks}
+}
+
+func (n *Node) accountHistory(request map[string]string) interface{} {
+	a, ok := n.accounts[request["account"]]
+	if !ok {
+		return map[string]string{"error": "Account not found"}
+	}
+
+	count := len(a.blocks)
+	if c, err := strconv.Atoi(request["count"]); err == nil && c >= 0 && c < count {
+		count = c
+	}
+
+	history := make([]nanostructs.HistoryBlockRaw, 0, count)
+	for i := len(a.blocks) - 1; i >= len(a.blocks)-count; i-- {
+		block := a.blocks[i]
+		history = append(history, nanostructs.HistoryBlockRaw{
+			Type:           "state",
+			Subtype:        block.Subtype,
+			Account:        block.Account,
+			Amount:         block.Amount,
+			LocalTimestamp: strconv.FormatInt(block.Timestamp.Unix(), 10),
+			Height:         strconv.FormatUint(block.Height, 10),
+			Hash:           block.Hash,
+			Link:           block.Link,
+			Previous:       block.Previous,
+		})
+	}
+	return nanostructs.AccountHistoryReturnRaw{Account: request["account"], HistoryCollection: history}
+}
+
+func (n *Node) accountInfo(request map[string]string) interface{} {
+	a, ok := n.accounts[request["account"]]
+	if !ok || len(a.blocks) == 0 {
+		return map[string]string{"error": "Account not found"}
+	}
+
+	var confirmedFrontier string
+	if a.confirmed > 0 {
+		confirmedFrontier = a.blocks[a.confirmed-1].Hash
+	}
+	return map[string]string{
+		"frontier":                     a.frontier(),
+		"open_block":                   a.blocks[0].Hash,
+		"modified_timestamp":           strconv.FormatInt(a.blocks[len(a.blocks)-1].Timestamp.Unix(), 10),
+		"block_count":                  strconv.Itoa(len(a.blocks)),
+		"confirmation_height":          strconv.FormatUint(a.confirmed, 10),
+		"confirmation_height_frontier": confirmedFrontier,
+		"account_version":              "2",
+	}
+}
+
+func (n *Node) blockInfo(request map[string]string) interface{} {
+	block, ok := n.blocks[request["hash"]]
+	if !ok {
+		return map[string]string{"error": "Block not found"}
+	}
+	return nanostructs.BlockInfo{
+		BlockAccount:   block.Account,
+		Amount:         block.Amount,
+		Height:         strconv.FormatUint(block.Height, 10),
+		LocalTimestamp: strconv.FormatInt(block.Timestamp.Unix(), 10),
+		Confirmed:      strconv.FormatBool(block.Confirmed),
+		Contents:       block.contents(),
+		Subtype:        block.Subtype,
+	}
+}
+
+func (n *Node) blockConfirm(request map[string]string) interface{} {
+	if _, ok := n.blocks[request["hash"]]; !ok {
+		return map[string]string{"error": "Block not found"}
+	}
+	if n.confirmOnRequest {
+		n.confirm(request["hash"])
+	}
+	return map[string]string{"started": "1"}
+}
+
+func (n *Node) blockCount() interface{} {
+	var cemented uint64
+	for _, a := range n.accounts {
+		cemented += a.confirmed
+	}
+	return map[string]string{
+		"count":     strconv.Itoa(len(n.blocks)),
+		"unchecked": strconv.FormatUint(n.unchecked, 10),
+		"cemented":  strconv.FormatUint(cemented, 10),
+	}
+}
+
+func (b *Block) contents() nanostructs.Block {
+	contents := nanostructs.Block{
+		Type:     "state",
+		Account:  b.Account,
+		Previous: b.Previous,
+		Link:     b.Link,
+	}
+	if b.Subtype == "send" {
+		contents.LinkAsAccount = b.Destination
+	}
+	return contents
+}
@@ -0,0 +1,93 @@
+package fakenode
+
+import (
+	"encoding/json"
+	bb "nano-pp/block_broadcaster"
+	nano "nano-pp/nanocurrency"
+	"nano-pp/nanocurrency/nanostructs"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLedger(t *testing.T) {
+	node := New(t)
+	rpc := node.RPC()
+
+	hash := node.Send("nano_1sender", "nano_1merchant", "1000")
+
+	pending, _ := nano.Pending(rpc, "nano_1merchant", map[string]string{"include_active": "true"})
+	if got, want := string(pending), `{"blocks":["`+hash+`"]}`+"\n"; got != want {
+		t.Errorf("got pending '%s' want '%s'", got, want)
+	}
+	pending, _ = nano.Pending(rpc, "nano_1merchant", nil)
+	if got, want := string(pending), `{"blocks":[]}`+"\n"; got != want {
+		t.Errorf("got confirmed pending '%s' want '%s'", got, want)
+	}
+
+	info, _ := nano.AccountInformation(rpc, "nano_1sender", nil)
+	if info["confirmation_height"] != "0" {
+		t.Errorf("got confirmation height %v want 0", info["confirmation_height"])
+	}
+
+	node.ConfirmOnRequest(true)
+	nano.BlockConfirm(rpc, hash)
+	if block, _ := node.Block(hash); !block.Confirmed {
+		t.Error("block_confirm did not confirm the block")
+	}
+	info, _ = nano.AccountInformation(rpc, "nano_1sender", nil)
+	if info["confirmation_height"] != "1" {
+		t.Errorf("got confirmation height %v want 1", info["confirmation_height"])
+	}
+
+	node.Receive(hash)
+	pending, _ = nano.Pending(rpc, "nano_1merchant", map[string]string{"include_active": "true"})
+	if got, want := string(pending), `{"blocks":[]}`+"\n"; got != want {
+		t.Errorf("got pending '%s' after receive want '%s'", got, want)
+	}
+	history, _ := nano.AccountHistory(rpc, "nano_1merchant", "10", map[string]string{"raw": "true"})
+	var raw nanostructs.AccountHistoryReturnRaw
+	json.Unmarshal(history, &raw)
+	if len(raw.HistoryCollection) != 1 || raw.HistoryCollection[0].Link != hash {
+		t.Errorf("got history %+v want a receive linking %s", raw.HistoryCollection, hash)
+	}
+	if node.Calls("pending") != 3 {
+		t.Errorf("got %d pending calls want 3", node.Calls("pending"))
+	}
+}
+
+func TestConfirmationWebsocket(t *testing.T) {
+	node := New(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(node.WebsocketURL(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(map[string]interface{}{"action": "subscribe", "topic": "confirmation", "ack": true})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var ack map[string]string
+	if err := conn.ReadJSON(&ack); err != nil || ack["ack"] != "subscribe" {
+		t.Fatalf("got ack %v, %v want subscribe", ack, err)
+	}
+
+	hash := node.Send("nano_1sender", "nano_1merchant", "1000")
+	node.Confirm(hash)
+
+	var confirmation bb.WebsocketMessage
+	if err := conn.ReadJSON(&confirmation); err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Topic != "confirmation" || confirmation.Message.Hash != hash ||
+		confirmation.Message.Amount != "1000" || confirmation.Message.Block.LinkAsAccount != "nano_1merchant" ||
+		confirmation.Message.Block.Subtype != "send" {
+		t.Errorf("got confirmation %+v for %s", confirmation, hash)
+	}
+
+	node.Disconnect()
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("connection survived disconnect")
+	}
+}
@@ -0,0 +1,185 @@
+package fakenode
+
+import (
+	"encoding/json"
+	"nano-pp/store"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+//client is a websocket connection and the topics it subscribed to.  Writes are serialised by mu.
+type client struct {
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	topics map[string]bool
+}
+
+func (c *client) write(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.conn.WriteJSON(v)
+}
+
+//subscription is the message a websocket client sends to subscribe to a topic.
+type subscription struct {
+	Action string `json:"action"`
+	Topic  string `json:"topic"`
+	Ack    bool   `json:"ack"`
+}
+
+func (n *Node) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &client{conn: conn, topics: make(map[string]bool)}
+
+	n.mu.Lock()
+	n.clients[c] = true
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.clients, c)
+		n.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var message subscription
+		if json.Unmarshal(data, &message) != nil {
+			continue
+		}
+
+		n.mu.Lock()
+		switch message.Action {
+		case "subscribe":
+			c.topics[message.Topic] = true
+		case "unsubscribe":
+			delete(c.topics, message.Topic)
+		}
+		n.mu.Unlock()
+
+		if message.Ack {
+			c.write(map[string]string{"ack": message.Action, "time": timestamp(time.Now())})
+		}
+	}
+}
+
+//Subscribers returns the number of websocket clients subscribed to confirmations.
+func (n *Node) Subscribers() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	count := 0
+	for c := range n.clients {
+		if c.topics["confirmation"] {
+			count++
+		}
+	}
+	return count
+}
+
+//Disconnect drops every websocket client, as a restarting node would.
+func (n *Node) Disconnect() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for c := range n.clients {
+		c.conn.Close()
+		delete(n.clients, c)
+	}
+}
+
+//Replay emits the confirmation message for a confirmed block again, as a node may after a restart.
+func (n *Node) Replay(hash string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	block, ok := n.blocks[hash]
+	if !ok || !block.Confirmed {
+		return false
+	}
+	n.broadcast(block)
+	return true
+}
+
+//Relay follows the node's confirmations into the store, as the block broadcaster does, until the test
+//finishes.  It returns once the relay has subscribed.
+func (n *Node) Relay(t testing.TB, st store.Store) {
+	stop, err := n.RelayTo(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+}
+
+//RelayTo follows the node's confirmations into the store until the returned function is called.  It
+//returns once the relay has subscribed.
+func (n *Node) RelayTo(st store.Store) (func(), error) {
+	conn, _, err := websocket.DefaultDialer.Dial(n.WebsocketURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteJSON(subscription{Action: "subscribe", Topic: "confirmation", Ack: true}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			st.Append(store.ConfirmationStream, string(message))
+		}
+	}()
+	return func() { conn.Close() }, nil
+}
+
+func timestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+//broadcast sends the confirmation message for a block to the clients subscribed to confirmations.
+func (n *Node) broadcast(block *Block) {
+	contents := block.contents()
+	message := map[string]interface{}{
+		"topic": "confirmation",
+		"time":  timestamp(time.Now()),
+		"message": map[string]interface{}{
+			"account":           block.Account,
+			"amount":            block.Amount,
+			"hash":              block.Hash,
+			"confirmation_type": "active_quorum",
+			"block": map[string]string{
+				"type":            contents.Type,
+				"account":         contents.Account,
+				"previous":        contents.Previous,
+				"link":            contents.Link,
+				"link_as_account": contents.LinkAsAccount,
+				"subtype":         block.Subtype,
+			},
+		},
+	}
+
+	for c := range n.clients {
+		if c.topics["confirmation"] {
+			c.write(message)
+		}
+	}
+}
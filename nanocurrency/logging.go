@@ -0,0 +1,75 @@
+package nanocurrency
+
+import (
+	"nano-pp/logging"
+	"nano-pp/nanocurrency/nanostructs"
+	"time"
+)
+
+//redacted replaces sensitive values in logged requests and responses
+const redacted = "[redacted]"
+
+//sensitiveFields are the request and response fields that give access to funds
+var sensitiveFields = map[string]bool{
+	"wallet":   true,
+	"key":      true,
+	"private":  true,
+	"seed":     true,
+	"password": true,
+}
+
+//redactRequest returns a copy of the request with the sensitive values replaced
+func redactRequest(data map[string]string) map[string]string {
+	safe := make(map[string]string, len(data))
+	for k, v := range data {
+		if sensitiveFields[k] {
+			v = redacted
+		}
+		safe[k] = v
+	}
+	return safe
+}
+
+//redactResponse returns a copy of the response with the sensitive values replaced
+func redactResponse(response map[string]interface{}) map[string]interface{} {
+	if response == nil {
+		return nil
+	}
+	safe := make(map[string]interface{}, len(response))
+	for k, v := range response {
+		if sensitiveFields[k] {
+			v = redacted
+		}
+		safe[k] = v
+	}
+	return safe
+}
+
+//nodePost posts to the node and logs the call at debug level
+func nodePost(rpc nanostructs.NanoRPC, data *map[string]string) (map[string]interface{}, error) {
+	started := time.Now()
+	response, err := NodePost(rpc.Host, rpc.Port, data)
+	logging.OrDefault(rpc.Logger).Debug("node rpc",
+		"action", (*data)["action"],
+		"request", redactRequest(*data),
+		"response", redactResponse(response),
+		"duration", time.Since(started),
+		"error", err,
+	)
+	return response, err
+}
+
+//rawNodePost posts to the node and logs the call at debug level.  Raw responses can be large, so only
+//their size is logged.
+func rawNodePost(rpc nanostructs.NanoRPC, data *map[string]string) ([]byte, error) {
+	started := time.Now()
+	response, err := RawNodePost(rpc.Host, rpc.Port, data)
+	logging.OrDefault(rpc.Logger).Debug("node rpc",
+		"action", (*data)["action"],
+		"request", redactRequest(*data),
+		"response_bytes", len(response),
+		"duration", time.Since(started),
+		"error", err,
+	)
+	return response, err
+}
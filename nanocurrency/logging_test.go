@@ -0,0 +1,20 @@
+package nanocurrency
+
+import (
+	"testing"
+)
+
+func TestRedactRequest(t *testing.T) {
+	data := map[string]string{"action": "wallet_add", "wallet": "000D1BAEC8EC208142C99059B393051BAC8380F9B5A2E6B2489A277D81789F3F", "key": "34F0A37AAD20F4A260F0A5B3CB3D7FB50673212263E58A380BC10474BB039CE4"}
+	safe := redactRequest(data)
+
+	if safe["action"] != "wallet_add" {
+		t.Errorf("got action '%s' want 'wallet_add'", safe["action"])
+	}
+	if safe["wallet"] != redacted || safe["key"] != redacted {
+		t.Errorf("expected the wallet and key to be redacted, got %v", safe)
+	}
+	if data["key"] == redacted {
+		t.Error("expected the request itself to be left unchanged")
+	}
+}
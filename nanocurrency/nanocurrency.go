@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"nano-pp/metrics"
 	"nano-pp/nanocurrency/nanostructs"
 	"net/http"
 	"strconv"
@@ -15,7 +16,10 @@ import (
 
 //NodePost formats and posts to the Nano Node and returns the response
 //formatted as a map[string]interface{}.
-func NodePost(host string, port string, data *map[string]string) (map[string]interface{}, error) {
+func NodePost(host string, port string, data *map[string]string) (response map[string]interface{}, err error) {
+	//Record the latency and any error for the action
+	defer func(started time.Time) { metrics.ObserveRPC((*data)["action"], started, err) }(time.Now())
+
 	//Convert the map to JSON
 	dataJSON, _ := json.Marshal(data)
 
@@ -37,14 +41,17 @@ func NodePost(host string, port string, data *map[string]string) (map[string]int
 
 	//If there is an error in the Node, capture it and return an error
 	if val, ok := responseJSON["error"]; ok {
-		return nil, fmt.Errorf(val.(string))
+		return nil, fmt.Errorf("%v", val)
 	}
 
 	return responseJSON, nil
 }
 
 //RawNodePost returns the raw JSON value for formatting later
-func RawNodePost(host string, port string, data *map[string]string) ([]byte, error) {
+func RawNodePost(host string, port string, data *map[string]string) (body []byte, err error) {
+	//Record the latency and any error for the action
+	defer func(started time.Time) { metrics.ObserveRPC((*data)["action"], started, err) }(time.Now())
+
 	//Convert the map to JSON
 	dataJSON, _ := json.Marshal(data)
 
@@ -60,7 +67,7 @@ func RawNodePost(host string, port string, data *map[string]string) ([]byte, err
 	}
 
 	//Parse to back to map
-	body, _ := ioutil.ReadAll(r.Body)
+	body, _ = ioutil.ReadAll(r.Body)
 
 	return body, nil
 }
@@ -69,7 +76,7 @@ func RawNodePost(host string, port string, data *map[string]string) ([]byte, err
 func BlockCount(rpc nanostructs.NanoRPC) (map[string]interface{}, error) {
 	data := map[string]string{"action": "block_count"}
 
-	response, blockError := NodePost(rpc.Host, rpc.Port, &data)
+	response, blockError := nodePost(rpc, &data)
 	if blockError != nil {
 		return nil, blockError
 	}
@@ -81,7 +88,7 @@ func BlockCount(rpc nanostructs.NanoRPC) (map[string]interface{}, error) {
 func AccountBalance(rpc nanostructs.NanoRPC, account string) (map[string]interface{}, error) {
 	data := map[string]string{"action": "account_balance", "account": account}
 
-	response, accountError := NodePost(rpc.Host, rpc.Port, &data)
+	response, accountError := nodePost(rpc, &data)
 	if accountError != nil {
 		return nil, accountError
 	}
@@ -93,7 +100,7 @@ func AccountBalance(rpc nanostructs.NanoRPC, account string) (map[string]interfa
 func AccountBlocks(rpc nanostructs.NanoRPC, account string) (map[string]interface{}, error) {
 	data := map[string]string{"action": "account_block_count", "account": account}
 
-	response, accountError := NodePost(rpc.Host, rpc.Port, &data)
+	response, accountError := nodePost(rpc, &data)
 	if accountError != nil {
 		return nil, accountError
 	}
@@ -150,7 +157,7 @@ func AccountInformation(rpc nanostructs.NanoRPC, account string, optional map[st
 		}
 	}
 
-	response, accountError := NodePost(rpc.Host, rpc.Port, &data)
+	response, accountError := nodePost(rpc, &data)
 	if accountError != nil {
 		return nil, accountError
 	}
@@ -195,7 +202,7 @@ func AccountCreate(rpc nanostructs.NanoRPC, wallet string, optional map[string]s
 			}
 		}
 	}
-	response, createError := NodePost(rpc.Host, rpc.Port, &data)
+	response, createError := nodePost(rpc, &data)
 	if createError != nil {
 		return nil, createError
 	}
@@ -207,7 +214,7 @@ func AccountCreate(rpc nanostructs.NanoRPC, wallet string, optional map[string]s
 func AccountGet(rpc nanostructs.NanoRPC, key string) (map[string]interface{}, error) {
 	data := map[string]string{"action": "account_get", "key": key}
 
-	response, getError := NodePost(rpc.Host, rpc.Port, &data)
+	response, getError := nodePost(rpc, &data)
 	if getError != nil {
 		return nil, getError
 	}
@@ -292,7 +299,7 @@ func AccountHistory(rpc nanostructs.NanoRPC, account string, count string, optio
 		}
 	}
 
-	response, historyError := RawNodePost(rpc.Host, rpc.Port, &data)
+	response, historyError := rawNodePost(rpc, &data)
 	if historyError != nil {
 		return nil, historyError
 	}
@@ -375,7 +382,7 @@ func Pending(rpc nanostructs.NanoRPC, account string, optional map[string]string
 		}
 	}
 
-	response, getError := RawNodePost(rpc.Host, rpc.Port, &data)
+	response, getError := rawNodePost(rpc, &data)
 	if getError != nil {
 		return nil, getError
 	}
@@ -387,7 +394,7 @@ func Pending(rpc nanostructs.NanoRPC, account string, optional map[string]string
 func BlockConfirm(rpc nanostructs.NanoRPC, hash string) (string, error) {
 	data := map[string]string{"action": "block_confirm", "hash": hash}
 
-	_, getError := NodePost(rpc.Host, rpc.Port, &data)
+	_, getError := nodePost(rpc, &data)
 	if getError != nil {
 		return "", getError
 	}
@@ -399,7 +406,7 @@ func BlockConfirm(rpc nanostructs.NanoRPC, hash string) (string, error) {
 func BlockInfo(rpc nanostructs.NanoRPC, hash string) ([]byte, error) {
 	data := map[string]string{"action": "block_info", "hash": hash, "json_block": "true"}
 
-	response, getError := RawNodePost(rpc.Host, rpc.Port, &data)
+	response, getError := rawNodePost(rpc, &data)
 	if getError != nil {
 		return nil, getError
 	}
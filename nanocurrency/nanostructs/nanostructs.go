@@ -1,5 +1,9 @@
 package nanostructs
 
+import (
+	"log/slog"
+)
+
 //AccountHistoryReturn contains the Account, a list of blocks and the hash of the previous transaction
 type AccountHistoryReturn struct {
 	Account           string         `json:"account"`
@@ -75,4 +79,6 @@ type BlockInfo struct {
 type NanoRPC struct {
 	Host string
 	Port string
+	// Calls are logged at debug level with sensitive values redacted, nil uses the default logger
+	Logger *slog.Logger
 }
@@ -0,0 +1,24 @@
+package nanocurrency
+
+import (
+	"net/url"
+	"strings"
+)
+
+//PaymentURI returns the nano: URI wallets read to pay amount raw to the address.  The label names the
+//recipient and the message describes the payment, both are left out when empty.
+func PaymentURI(address string, amount string, label string, message string) string {
+	query := []string{"amount=" + escapeURI(amount)}
+	if label != "" {
+		query = append(query, "label="+escapeURI(label))
+	}
+	if message != "" {
+		query = append(query, "message="+escapeURI(message))
+	}
+	return "nano:" + address + "?" + strings.Join(query, "&")
+}
+
+//escapeURI percent-encodes a query value, encoding spaces as %20 rather than the form encoding's +
+func escapeURI(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
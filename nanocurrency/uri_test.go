@@ -0,0 +1,23 @@
+package nanocurrency
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPaymentURI(t *testing.T) {
+	address := "nano_1natrium1o3z5519ifou7xii8crpxpk8y65qmkih8e8bpsjri651oza8imdd"
+	uri := PaymentURI(address, "1000000000000000000000000000000", "Kite Shop", "Order #42 & tip")
+	want := "nano:" + address + "?amount=1000000000000000000000000000000&label=Kite%20Shop&message=Order%20%2342%20%26%20tip"
+	if uri != want {
+		t.Errorf("got %s want %s", uri, want)
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "nano" || parsed.Opaque != address || parsed.Query().Get("message") != "Order #42 & tip" {
+		t.Errorf("URI does not parse back: %+v, %v", parsed, err)
+	}
+	if got := PaymentURI(address, "1", "", ""); got != "nano:"+address+"?amount=1" {
+		t.Errorf("got %s", got)
+	}
+}
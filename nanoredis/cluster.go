@@ -0,0 +1,104 @@
+package nanoredis
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//maxRedirects is the number of MOVED or ASK replies followed for a single command
+const maxRedirects = 5
+
+//clusterConn is a connection to a cluster node that follows redirections for commands sent with Do.
+//Pipelined commands (Send, Flush and Receive) go to the current node unchanged.
+type clusterConn struct {
+	redis.Conn
+	options Options
+}
+
+func (c *clusterConn) Do(command string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(command, args...)
+	for i := 0; i < maxRedirects; i++ {
+		kind, addr, ok := redirection(err)
+		if !ok {
+			break
+		}
+
+		netConn, dialErr := c.options.dialAddr(addr)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		node := redis.NewConn(netConn, 0, 0)
+
+		if kind == "ASK" {
+			// The slot is migrating, only this command goes to the new node
+			if _, err := node.Do("ASKING"); err != nil {
+				node.Close()
+				return nil, err
+			}
+			reply, err = node.Do(command, args...)
+			node.Close()
+			continue
+		}
+
+		// The slot has moved, so keep using the new node
+		c.Conn.Close()
+		c.Conn = node
+		reply, err = c.Conn.Do(command, args...)
+	}
+	return reply, err
+}
+
+//redirection parses a "MOVED <slot> <addr>" or "ASK <slot> <addr>" error.
+func redirection(err error) (string, string, bool) {
+	redisErr, ok := err.(redis.Error)
+	if !ok {
+		return "", "", false
+	}
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
+
+//slotAddress returns the address of the node serving the slot of the provided key.
+func (o Options) slotAddress(key string) (string, error) {
+	c, err := o.Dial()
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	slot, err := redis.Int(c.Do("CLUSTER", "KEYSLOT", key))
+	if err != nil {
+		return "", err
+	}
+	ranges, err := redis.Values(c.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return "", err
+	}
+	for _, r := range ranges {
+		// Each range is [start, end, [host, port, ...] of the master, replicas...]
+		values, err := redis.Values(r, nil)
+		if err != nil || len(values) < 3 {
+			continue
+		}
+		start, _ := redis.Int(values[0], nil)
+		end, _ := redis.Int(values[1], nil)
+		if slot < start || slot > end {
+			continue
+		}
+		master, err := redis.Values(values[2], nil)
+		if err != nil || len(master) < 2 {
+			break
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+	return "", fmt.Errorf("no cluster node serves slot %d", slot)
+}
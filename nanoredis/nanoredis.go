@@ -1,28 +1,285 @@
 package nanoredis
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"os"
+	"io/ioutil"
+	structs "nano-pp/paymentstructs"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/adjust/rmq"
 	"github.com/gomodule/redigo/redis"
+	redisv3 "gopkg.in/redis.v3"
 )
 
-//NewPool returns a redis pool for connections using the configured host and port.
-func NewPool() *redis.Pool {
-	host := os.Getenv("REDISHOST")
-	port := os.Getenv("REDISPORT")
+//Options describes how to reach and authenticate to the redis server.  The pool, the rmq connection
+//and everything built on them dial through the same options.
+type Options struct {
+	// Address of the server, or of a seed node in cluster mode
+	Host string
+	Port string
+	// ACL user, leave empty to AUTH with the password only
+	Username string
+	Password string
+	// Database selected on each connection, must be 0 in cluster mode
+	DB int
+
+	// Connect with TLS, verifying the server against the CA file if provided or the system roots if not
+	TLS           bool
+	TLSCAFile     string
+	TLSServerName string
+	TLSSkipVerify bool
+
+	// Sentinel addresses (host:port) used to discover the current master
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+
+	// Follow MOVED and ASK redirections from a redis cluster
+	Cluster bool
+	// Prefix of the processor's keys, used to place the rmq connection in cluster mode
+	KeyPrefix string
+
+	ConnectTimeout time.Duration
+
+	// Most connections the pool opens, callers wait for a free connection beyond this
+	MaxActive int
+	// Most idle connections the pool keeps
+	MaxIdle int
+
+	tlsConfig *tls.Config
+}
+
+//NewOptions returns the connection options from the configuration.
+func NewOptions(config structs.Config) Options {
+	options := Options{
+		Host:             config.RedisHost,
+		Port:             config.RedisPort,
+		Username:         config.RedisUsername,
+		Password:         config.RedisPassword,
+		DB:               config.RedisDB,
+		TLS:              config.RedisTLS,
+		TLSCAFile:        config.RedisTLSCAFile,
+		TLSServerName:    config.RedisTLSServerName,
+		TLSSkipVerify:    config.RedisTLSSkipVerify,
+		SentinelMaster:   config.RedisSentinelMaster,
+		SentinelPassword: config.RedisSentinelPassword,
+		Cluster:          config.RedisCluster,
+		KeyPrefix:        config.KeyPrefix,
+		ConnectTimeout:   5 * time.Second,
+		MaxActive:        config.RedisMaxActive,
+		MaxIdle:          config.RedisMaxIdle,
+	}
+	for _, addr := range strings.Split(config.RedisSentinels, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			options.SentinelAddrs = append(options.SentinelAddrs, addr)
+		}
+	}
+	return options
+}
+
+//prepare validates the options and loads the TLS configuration.
+func (o *Options) prepare() error {
+	if o.Cluster && len(o.SentinelAddrs) > 0 {
+		return fmt.Errorf("redis cluster and sentinel cannot be used together")
+	}
+	if o.Cluster && o.DB != 0 {
+		return fmt.Errorf("redis cluster only supports database 0, got %d", o.DB)
+	}
+	if len(o.SentinelAddrs) > 0 && o.SentinelMaster == "" {
+		return fmt.Errorf("a sentinel master name is required with sentinel addresses")
+	}
+	if !o.TLS || o.tlsConfig != nil {
+		return nil
+	}
+
+	o.tlsConfig = &tls.Config{ServerName: o.TLSServerName, InsecureSkipVerify: o.TLSSkipVerify}
+	if o.TLSCAFile != "" {
+		ca, err := ioutil.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading redis CA file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in redis CA file %s", o.TLSCAFile)
+		}
+		o.tlsConfig.RootCAs = roots
+	}
+	return nil
+}
+
+//address returns the address to dial, asking the sentinels for the master when configured.
+func (o Options) address() (string, error) {
+	if len(o.SentinelAddrs) == 0 {
+		return net.JoinHostPort(o.Host, o.Port), nil
+	}
+
+	var lastErr error
+	for _, sentinel := range o.SentinelAddrs {
+		addr, err := o.queryMaster(sentinel)
+		if err == nil {
+			return addr, nil
+		}
+		lastErr = err
+	}
+	return "", fmt.Errorf("no sentinel returned a master for %s: %v", o.SentinelMaster, lastErr)
+}
+
+func (o Options) queryMaster(sentinel string) (string, error) {
+	options := []redis.DialOption{redis.DialConnectTimeout(o.ConnectTimeout)}
+	if o.SentinelPassword != "" {
+		options = append(options, redis.DialPassword(o.SentinelPassword))
+	}
+	c, err := redis.Dial("tcp", sentinel, options...)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	master, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", o.SentinelMaster))
+	if err != nil {
+		return "", err
+	}
+	if len(master) != 2 {
+		return "", fmt.Errorf("unexpected sentinel reply: %v", master)
+	}
+	return net.JoinHostPort(master[0], master[1]), nil
+}
+
+//dialAddr opens an authenticated connection to the address with the database selected.  The
+//returned net.Conn has no unread data, so it can be handed to any redis client.
+func (o Options) dialAddr(addr string) (net.Conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, o.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if o.TLS {
+		config := o.tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(netConn, config)
+		tlsConn.SetDeadline(time.Now().Add(o.ConnectTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("error in TLS handshake with %s: %v", addr, err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+
+	c := redis.NewConn(netConn, o.ConnectTimeout, o.ConnectTimeout)
+	if o.Password != "" {
+		args := redis.Args{}
+		if o.Username != "" {
+			args = args.Add(o.Username)
+		}
+		if _, err := c.Do("AUTH", args.Add(o.Password)...); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("error authenticating to %s: %v", addr, err)
+		}
+	}
+	if o.DB != 0 {
+		if _, err := c.Do("SELECT", o.DB); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("error selecting database %d: %v", o.DB, err)
+		}
+	}
+	if len(o.SentinelAddrs) > 0 {
+		// The sentinels may not have noticed a failover yet, so make sure this is still the master
+		role, err := redis.Values(c.Do("ROLE"))
+		if err != nil || len(role) == 0 {
+			netConn.Close()
+			return nil, fmt.Errorf("error checking role of %s: %v", addr, err)
+		}
+		if r, _ := redis.String(role[0], nil); r != "master" {
+			netConn.Close()
+			return nil, fmt.Errorf("%s is a %s, not the master", addr, r)
+		}
+	}
+
+	// The handshake commands leave a deadline on the connection, which would fail every later command
+	netConn.SetDeadline(time.Time{})
+	return netConn, nil
+}
+
+//DialNet opens an authenticated network connection to the server, for clients other than redigo.
+func (o Options) DialNet() (net.Conn, error) {
+	if err := o.prepare(); err != nil {
+		return nil, err
+	}
+	addr, err := o.address()
+	if err != nil {
+		return nil, err
+	}
+	return o.dialAddr(addr)
+}
+
+//Dial opens a redigo connection to the server.  In cluster mode the connection follows redirections
+//to the node serving each key.
+func (o Options) Dial() (redis.Conn, error) {
+	netConn, err := o.DialNet()
+	if err != nil {
+		return nil, err
+	}
+	c := redis.NewConn(netConn, 0, 0)
+	if o.Cluster {
+		return &clusterConn{Conn: c, options: o}, nil
+	}
+	return c, nil
+}
+
+//NewPool returns the redis pool shared by the processor, using the provided options.  Once MaxActive
+//connections are checked out callers wait for one to be returned.  Dial failures are returned to the
+//caller of Get rather than stopping the process.
+func NewPool(o Options) (*redis.Pool, error) {
+	if err := o.prepare(); err != nil {
+		return nil, err
+	}
 	return &redis.Pool{
 		// Maximum number of idle connections in the pool.
-		MaxIdle: 80,
+		MaxIdle: o.MaxIdle,
 		// max number of connections
-		MaxActive: 12000,
+		MaxActive: o.MaxActive,
+		Wait:      true,
+
+		Dial: o.Dial,
 
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
-			if err != nil {
-				panic(err.Error())
+		// Idle connections may point at a master that has since failed over
+		TestOnBorrow: func(c redis.Conn, idleSince time.Time) error {
+			if time.Since(idleSince) < time.Minute {
+				return nil
 			}
-			return c, err
+			_, err := c.Do("PING")
+			return err
 		},
+	}, nil
+}
+
+//NewRMQConnection opens the rmq connection for the queues through the same options as the pool.  rmq
+//does not follow cluster redirections, so in cluster mode it connects to the node serving the key
+//prefix's slot; give the prefix a hash tag such as "{nano-pp}:" so the queue keys live there.
+func NewRMQConnection(tag string, o Options) (rmq.Connection, error) {
+	if err := o.prepare(); err != nil {
+		return nil, err
 	}
+
+	dial := o.DialNet
+	if o.Cluster {
+		addr, err := o.slotAddress(o.KeyPrefix)
+		if err != nil {
+			return nil, err
+		}
+		dial = func() (net.Conn, error) { return o.dialAddr(addr) }
+	}
+
+	client := redisv3.NewClient(&redisv3.Options{
+		Network: "tcp",
+		Addr:    net.JoinHostPort(o.Host, o.Port),
+		Dialer:  dial,
+	})
+	return rmq.OpenConnectionWithRedisClient(tag, client), nil
 }
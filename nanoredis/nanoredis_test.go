@@ -0,0 +1,25 @@
+package nanoredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestDialClearsHandshakeDeadline(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	options := Options{Host: server.Host(), Port: server.Port(), Password: "secret", ConnectTimeout: 100 * time.Millisecond}
+
+	c, err := options.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Commands long after the handshake must not hit its deadline
+	time.Sleep(3 * options.ConnectTimeout)
+	if _, err := c.Do("SET", "key", "value"); err != nil {
+		t.Errorf("got %v issuing a command after the connect timeout", err)
+	}
+}
@@ -0,0 +1,78 @@
+package paymentapi
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+//The limits of the QR code endpoint.  A nano: URI with a label and message fits well within maxURI.
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+	maxURI        = 1024
+)
+
+//ServeQR renders the nano: URI in the uri parameter as a QR code, a PNG or, with format=svg, an SVG of
+//size pixels square.  Nothing is stored, so any payment URI can be rendered without a token.
+func ServeQR(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	uri := query.Get("uri")
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "nano" || len(uri) > maxURI {
+		http.Error(w, fmt.Sprintf("uri must be a nano: payment URI of at most %d characters", maxURI), http.StatusBadRequest)
+		return
+	}
+	size := defaultQRSize
+	if s := query.Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil || size < minQRSize || size > maxQRSize {
+			http.Error(w, fmt.Sprintf("size must be %d to %d pixels", minQRSize, maxQRSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	code, err := qrcode.New(uri, qrcode.Medium)
+	if err != nil {
+		http.Error(w, "error encoding the QR code", http.StatusInternalServerError)
+		return
+	}
+
+	var image []byte
+	switch query.Get("format") {
+	case "", "png":
+		if image, err = code.PNG(size); err != nil {
+			http.Error(w, "error rendering the QR code", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+	case "svg":
+		image = svg(code.Bitmap(), size)
+		w.Header().Set("Content-Type", "image/svg+xml")
+	default:
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	// The image depends only on the parameters
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(image)
+}
+
+//svg draws the modules of a QR code, quiet zone included, as one path scaled to size pixels
+func svg(bitmap [][]bool, size int) []byte {
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		size, size, len(bitmap), len(bitmap), path.String()))
+}
@@ -0,0 +1,208 @@
+//Package paymentapi serves the gRPC payment service and the payment streams of browser checkout pages.
+//Requests go through the same queue, workers and payment events as the Redis clients use, so the
+//processors serving the API need no state of their own.
+package paymentapi
+
+import (
+	"context"
+	"log/slog"
+	"nano-pp/codec"
+	"nano-pp/paymentpb"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//DefaultAckTimeout is how long CreatePayment waits for a worker to acknowledge a request when the call
+//has no deadline
+const DefaultAckTimeout = 30 * time.Second
+
+//Server implements paymentpb.PaymentServiceServer on a store
+type Server struct {
+	paymentpb.UnimplementedPaymentServiceServer
+
+	store      store.Store
+	wire       codec.Codec
+	logger     *slog.Logger
+	ackTimeout time.Duration
+}
+
+//NewServer returns the payment service backed by the store, queueing requests in the wire format of the codec
+func NewServer(st store.Store, wire codec.Codec, logger *slog.Logger) *Server {
+	return &Server{store: st, wire: wire, logger: logger.With("component", "grpc"), ackTimeout: DefaultAckTimeout}
+}
+
+//Serve registers the payment service on a new gRPC server and serves it on the address until stop is
+//closed, letting running calls finish
+func Serve(st store.Store, wire codec.Codec, logger *slog.Logger, address string, stop <-chan struct{}) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	paymentpb.RegisterPaymentServiceServer(server, NewServer(st, wire, logger))
+
+	go func() {
+		<-stop
+		server.GracefulStop()
+	}()
+
+	logger.Info("serving the gRPC payment service", "address", address)
+	return server.Serve(listener)
+}
+
+//CreatePayment queues the payment request and waits for the acknowledgement of the worker that takes
+//it.  Acknowledgements are published by address, so the request is given a request ID and only the
+//acknowledgement echoing it is taken.
+func (s *Server) CreatePayment(ctx context.Context, request *paymentpb.PaymentRequest) (*paymentpb.PaymentAck, error) {
+	fiat := request.GetAmount() == "" && request.GetFiatAmount() != ""
+	if request.GetDestinationAddress() == "" || (request.GetAmount() == "" && !fiat) {
+		return nil, status.Error(codes.InvalidArgument, "destination_address and amount or fiat_amount are required")
+	}
+	if fiat && request.GetCurrency() == "" {
+		return nil, status.Error(codes.InvalidArgument, "currency is required with fiat_amount")
+	}
+	if request.GetWorkerId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "worker_id is assigned by the processor")
+	}
+	if request.GetValidationHash() != "" {
+		return nil, status.Error(codes.InvalidArgument, "validation_hash is set by the processor on checkpointed requests")
+	}
+	if request.GetRequestId() != "" {
+		return nil, status.Error(codes.InvalidArgument, "request_id is assigned by the processor")
+	}
+	requestID := uuid.New().String()
+
+	// Subscribed before queueing so the acknowledgement can't be missed
+	sub, err := s.store.Subscribe(store.AckChannel(request.GetDestinationAddress()))
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "error subscribing to acknowledgements: %v", err)
+	}
+	defer sub.Close()
+
+	data, err := s.wire.EncodePaymentRequest(structs.PaymentRequest{
+		DestinationAddress: request.GetDestinationAddress(),
+		Amount:             request.GetAmount(),
+		Merchant:           request.GetMerchant(),
+		Message:            request.GetMessage(),
+		FiatAmount:         request.GetFiatAmount(),
+		Currency:           request.GetCurrency(),
+		Tolerance:          request.GetTolerance(),
+		RequestID:          requestID,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error encoding the payment request: %v", err)
+	}
+	if err := s.store.OpenQueue(store.PaymentRequestQueue).Publish(data); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "error queueing the payment request: %v", err)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ackTimeout)
+		defer cancel()
+	}
+	for {
+		select {
+		case message, ok := <-sub.Messages():
+			if !ok {
+				return nil, status.Error(codes.Unavailable, "acknowledgement subscription closed")
+			}
+			ack, err := codec.DecodeAck(message.Payload)
+			if err != nil {
+				s.logger.Error("error decoding acknowledgement", "error", err)
+				continue
+			}
+			if ack.RequestID != requestID {
+				continue
+			}
+			if ack.Error != "" {
+				return nil, status.Errorf(codes.FailedPrecondition, "payment request rejected: %s", ack.Error)
+			}
+			s.logger.Info("payment request created", "worker_id", ack.WorkerID, "destination_address", ack.DestinationAddress)
+			return &paymentpb.PaymentAck{
+				DestinationAddress: ack.DestinationAddress,
+				ExpectedAmount:     ack.ExpectedAmount,
+				WorkerId:           ack.WorkerID,
+				Token:              ack.Token,
+				PaymentUri:         ack.PaymentURI,
+				FiatAmount:         ack.FiatAmount,
+				Currency:           ack.Currency,
+				Rate:               ack.Rate,
+				RequestedAmount:    ack.RequestedAmount,
+				RequestId:          ack.RequestID,
+			}, nil
+		case <-ctx.Done():
+			return nil, status.Error(codes.DeadlineExceeded, "payment request queued but not acknowledged in time")
+		}
+	}
+}
+
+//GetPayment returns the status recorded for the worker
+func (s *Server) GetPayment(ctx context.Context, ref *paymentpb.PaymentRef) (*paymentpb.PaymentStatus, error) {
+	current, err := s.status(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &paymentpb.PaymentStatus{WorkerId: ref.GetWorkerId(), Status: current}, nil
+}
+
+//CancelPayment publishes to the worker's cancel channel.  Only a pending request can be cancelled, the
+//worker then publishes the cancelled payment event.
+func (s *Server) CancelPayment(ctx context.Context, ref *paymentpb.PaymentRef) (*paymentpb.CancelPaymentResponse, error) {
+	current, err := s.status(ref)
+	if err != nil {
+		return nil, err
+	}
+	if current != "pending" {
+		return nil, status.Errorf(codes.FailedPrecondition, "payment is %s, only pending payments can be cancelled", current)
+	}
+	if err := s.store.Publish(store.CancelChannel(ref.GetWorkerId()), "true"); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "error publishing the cancel: %v", err)
+	}
+	return &paymentpb.CancelPaymentResponse{}, nil
+}
+
+//WatchPayment sends the current status of the worker, then an update for each of its payment events that
+//changes the status, until the status is final or the call ends
+func (s *Server) WatchPayment(ref *paymentpb.PaymentRef, stream paymentpb.PaymentService_WatchPaymentServer) error {
+	if ref.GetDestinationAddress() == "" {
+		return status.Error(codes.InvalidArgument, "destination_address is required to watch a payment")
+	}
+
+	ctx := stream.Context()
+	err := watch(ctx, s.store, s.logger, ref.GetWorkerId(), ref.GetDestinationAddress(),
+		func() (string, error) { return s.status(ref) },
+		func(current string, payment *structs.Payment) error {
+			update := &paymentpb.PaymentUpdate{Status: current}
+			if payment != nil {
+				update.Payment = codec.PaymentProto(*payment)
+			}
+			return stream.Send(update)
+		})
+	if _, ok := status.FromError(err); ok || ctx.Err() != nil {
+		return err
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+//status returns the recorded status of the referenced worker, or a gRPC error
+func (s *Server) status(ref *paymentpb.PaymentRef) (string, error) {
+	if ref.GetWorkerId() == "" {
+		return "", status.Error(codes.InvalidArgument, "worker_id is required")
+	}
+	current, err := s.store.Status(ref.GetWorkerId())
+	if err != nil {
+		return "", status.Errorf(codes.Unavailable, "error reading the payment status: %v", err)
+	}
+	if current == "" {
+		return "", status.Errorf(codes.NotFound, "no payment with worker_id %s", ref.GetWorkerId())
+	}
+	return current, nil
+}
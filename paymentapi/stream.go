@@ -0,0 +1,219 @@
+package paymentapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//keepaliveInterval is how often an idle stream is written to, so proxies don't close it
+const keepaliveInterval = 15 * time.Second
+
+//checkoutEvents names the event sent to checkout pages for each worker status, any other status is an
+//error
+var checkoutEvents = map[string]string{
+	"pending":      "pending",
+	"requeued":     "pending",
+	"confirming":   "confirming",
+	"underpayment": "partially_paid",
+	"success":      "success",
+	// Paid as far as the customer is concerned, though the merchant has it reported as an error
+	"within_tolerance": "success",
+}
+
+//errorCodes are the payment error codes of the error statuses
+var errorCodes = map[string]int{"timeout": 0, "overpayment": 1, "underpayment": 2, "cancelled": 3, "within_tolerance": 4}
+
+//checkoutEvent returns the event name of a worker status
+func checkoutEvent(status string) string {
+	if event, ok := checkoutEvents[status]; ok {
+		return event
+	}
+	return "error"
+}
+
+//StreamEvent is a WebSocket message, the SSE event name and data sent as one JSON object
+type StreamEvent struct {
+	Event   string          `json:"event"`
+	Payment structs.Payment `json:"payment"`
+}
+
+//Streams serves the payment stream of each payment request to browser checkout pages, as Server-Sent
+//Events and over WebSocket.  A stream is opened with the token issued in the request's Ack.
+type Streams struct {
+	store    store.Store
+	logger   *slog.Logger
+	secret   []byte
+	upgrader websocket.Upgrader
+}
+
+//NewStreams returns the payment streams on the store, accepting tokens signed with the secret
+func NewStreams(st store.Store, logger *slog.Logger, secret []byte) *Streams {
+	return &Streams{
+		store:  st,
+		logger: logger.With("component", "streams"),
+		secret: secret,
+		// Any checkout page may connect, the token is the credential
+		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+	}
+}
+
+//Register adds the stream routes to the mux
+func (s *Streams) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /payments/{workerID}/events", s.serveEvents)
+	mux.HandleFunc("GET /payments/{workerID}/ws", s.serveWebsocket)
+}
+
+//authorize checks the request's token for the worker in the path and that the worker exists, writing the
+//error response if not
+func (s *Streams) authorize(w http.ResponseWriter, r *http.Request) (claims, bool) {
+	token := r.URL.Query().Get("token")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	c, err := verifyToken(s.secret, token)
+	if err != nil || c.WorkerID != r.PathValue("workerID") {
+		http.Error(w, errInvalidToken.Error(), http.StatusUnauthorized)
+		return c, false
+	}
+	current, err := s.store.Status(c.WorkerID)
+	if err != nil {
+		http.Error(w, "error reading the payment status", http.StatusServiceUnavailable)
+		return c, false
+	}
+	if current == "" {
+		http.Error(w, "payment not found", http.StatusNotFound)
+		return c, false
+	}
+	return c, true
+}
+
+//event returns the stream event of a status transition.  The status current when the stream opened has no
+//payment event, so its body is made from the status.
+func event(c claims, current string, payment *structs.Payment) StreamEvent {
+	if payment != nil {
+		return StreamEvent{Event: checkoutEvent(current), Payment: *payment}
+	}
+	body := structs.Payment{Status: current, DestinationAddress: c.Address, WorkerID: c.WorkerID}
+	if code, ok := errorCodes[current]; ok {
+		body.Status, body.ErrorCode = "error", code
+	} else if current == "requeued" {
+		body.Status = "pending"
+	}
+	return StreamEvent{Event: checkoutEvent(current), Payment: body}
+}
+
+//keepalive calls ping every keepaliveInterval until ctx is done
+func keepalive(ctx context.Context, ping func()) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ping()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Streams) serveEvents(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var mu sync.Mutex
+	go keepalive(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, ": keepalive\n\n")
+		flusher.Flush()
+	})
+
+	err := watch(ctx, s.store, s.logger, c.WorkerID, c.Address, func() (string, error) { return s.store.Status(c.WorkerID) },
+		func(current string, payment *structs.Payment) error {
+			e := event(c, current, payment)
+			data, _ := json.Marshal(e.Payment)
+			mu.Lock()
+			defer mu.Unlock()
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		})
+	if err != nil && ctx.Err() == nil {
+		s.logger.Warn("payment event stream ended", "worker_id", c.WorkerID, "error", err)
+	}
+}
+
+func (s *Streams) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// The page sends nothing, reading only notices it going away
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	go keepalive(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+	})
+
+	err = watch(ctx, s.store, s.logger, c.WorkerID, c.Address, func() (string, error) { return s.store.Status(c.WorkerID) },
+		func(current string, payment *structs.Payment) error {
+			mu.Lock()
+			defer mu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			return conn.WriteJSON(event(c, current, payment))
+		})
+	closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "payment finished")
+	if err != nil && ctx.Err() == nil {
+		s.logger.Warn("payment websocket ended", "worker_id", c.WorkerID, "error", err)
+		closing = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "payment events unavailable")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(time.Second))
+}
@@ -0,0 +1,243 @@
+package paymentapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"log/slog"
+	"nano-pp/eventlog"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
+)
+
+const address = "nano_1merchant"
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+//streamServer serves the streams of a pending worker and returns its URL, the store and a token for it
+func streamServer(t *testing.T) (string, store.Store, string) {
+	st := store.NewMemory()
+	st.SetStatus("worker", "pending")
+	mux := http.NewServeMux()
+	NewStreams(st, slog.Default(), secret).Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL, st, IssueToken(secret, "worker", address, time.Minute)
+}
+
+//pay appends a confirming event and then an underpayment for the worker, once the stream is following
+func pay(st store.Store) {
+	time.Sleep(100 * time.Millisecond)
+	for _, payment := range []structs.Payment{
+		{Status: "confirming", Hash: "HASH", DestinationAddress: address, WorkerID: "other"},
+		{Status: "confirming", Hash: "HASH", DestinationAddress: address, WorkerID: "worker"},
+		{Status: "error", ErrorCode: 2, Hash: "HASH", DestinationAddress: address, ValidatedAmount: "500", WorkerID: "worker"},
+	} {
+		event, _ := json.Marshal(payment)
+		st.Append(store.PaymentStream(address), string(event))
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	url, st, token := streamServer(t)
+	response, err := http.Get(fmt.Sprintf("%s/payments/worker/events?token=%s", url, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got content type %s", response.Header.Get("Content-Type"))
+	}
+	go pay(st)
+
+	// The stream ends after the final status
+	var events []string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, event)
+		}
+	}
+	if fmt.Sprint(events) != "[pending confirming partially_paid]" {
+		t.Errorf("got events %v", events)
+	}
+}
+
+//statusHook calls onStatus after each status read, with the number of reads so far
+type statusHook struct {
+	store.Store
+	reads    int
+	onStatus func(reads int)
+}
+
+func (s *statusHook) Status(workerID string) (string, error) {
+	status, err := s.Store.Status(workerID)
+	s.reads++
+	s.onStatus(s.reads)
+	return status, err
+}
+
+//slowReads delays each stream read, as if the reading goroutine were scheduled late
+type slowReads struct {
+	redis.Conn
+}
+
+func (c slowReads) Do(command string, args ...interface{}) (interface{}, error) {
+	if command == "XREAD" {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return c.Conn.Do(command, args...)
+}
+
+func TestServerSentEventsFinalRightAfterStatus(t *testing.T) {
+	server := miniredis.RunT(t)
+	newPool := func(slow bool) *redis.Pool {
+		pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", server.Addr())
+			if slow && err == nil {
+				return slowReads{c}, nil
+			}
+			return c, err
+		}}
+		t.Cleanup(func() { pool.Close() })
+		return pool
+	}
+	publisher := eventlog.Publisher{Mode: eventlog.ModeStreams}
+	st := store.NewRedis(newPool(false), nil, publisher, store.RedisOptions{})
+	st.SetStatus("worker", "pending")
+
+	// The stream's reads are slow, and the final event is appended as soon as the watch has read the
+	// status, the first read being the token check
+	served := &statusHook{Store: store.NewRedis(newPool(true), nil, publisher, store.RedisOptions{})}
+	served.onStatus = func(reads int) {
+		if reads == 2 {
+			event, _ := json.Marshal(structs.Payment{Status: "error", ErrorCode: 2, Hash: "HASH", DestinationAddress: address, ValidatedAmount: "500", WorkerID: "worker"})
+			st.Append(store.PaymentStream(address), string(event))
+		}
+	}
+	mux := http.NewServeMux()
+	NewStreams(served, slog.Default(), secret).Register(mux)
+	api := httptest.NewServer(mux)
+	defer api.Close()
+
+	client := http.Client{Timeout: 3 * time.Second}
+	response, err := client.Get(fmt.Sprintf("%s/payments/worker/events?token=%s", api.URL, IssueToken(secret, "worker", address, time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var events []string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, event)
+		}
+	}
+	if fmt.Sprint(events) != "[pending partially_paid]" {
+		t.Errorf("got events %v", events)
+	}
+}
+
+func TestWebsocketEvents(t *testing.T) {
+	url, st, token := streamServer(t)
+	wsURL := strings.Replace(url, "http", "ws", 1) + "/payments/worker/ws?token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go pay(st)
+
+	var events []string
+	for {
+		var event StreamEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("got %v want a normal close", err)
+			}
+			break
+		}
+		events = append(events, event.Event)
+		if event.Event == "partially_paid" && event.Payment.ValidatedAmount != "500" {
+			t.Errorf("got payment %+v", event.Payment)
+		}
+	}
+	if fmt.Sprint(events) != "[pending confirming partially_paid]" {
+		t.Errorf("got events %v", events)
+	}
+}
+
+func TestStreamTokens(t *testing.T) {
+	url, _, token := streamServer(t)
+	for name, tc := range map[string]struct {
+		path  string
+		token string
+		code  int
+	}{
+		"missing":        {"worker", "", http.StatusUnauthorized},
+		"expired":        {"worker", IssueToken(secret, "worker", address, -time.Second), http.StatusUnauthorized},
+		"forged":         {"worker", IssueToken([]byte("another secret"), "worker", address, time.Minute), http.StatusUnauthorized},
+		"another worker": {"other", token, http.StatusUnauthorized},
+		"unknown worker": {"gone", IssueToken(secret, "gone", address, time.Minute), http.StatusNotFound},
+	} {
+		response, err := http.Get(fmt.Sprintf("%s/payments/%s/events?token=%s", url, tc.path, tc.token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != tc.code {
+			t.Errorf("%s: got %d want %d", name, response.StatusCode, tc.code)
+		}
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ServeQR))
+	defer server.Close()
+	uri := url.QueryEscape("nano:" + address + "?amount=1000&label=Kite%20Shop")
+
+	for query, want := range map[string]string{
+		"uri=" + uri:                          "image/png",
+		"uri=" + uri + "&size=512&format=svg": "image/svg+xml",
+		"uri=https://example.com":             "",
+		"uri=" + uri + "&size=10":             "",
+		"uri=" + uri + "&format=gif":          "",
+	} {
+		response, err := http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if want == "" {
+			if response.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s: got %d want 400", query, response.StatusCode)
+			}
+			continue
+		}
+		if got := response.Header.Get("Content-Type"); got != want || response.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d %s want %s", query, response.StatusCode, got, want)
+		}
+		if want == "image/png" {
+			if img, err := png.Decode(bytes.NewReader(body)); err != nil || img.Bounds().Dx() != 256 {
+				t.Errorf("got an invalid PNG: %v", err)
+			}
+		} else if !strings.Contains(string(body), `width="512"`) {
+			t.Errorf("got SVG %s", body)
+		}
+	}
+}
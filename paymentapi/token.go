@@ -0,0 +1,56 @@
+package paymentapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+//errInvalidToken is returned for a stream token that is malformed, forged, expired or for another worker
+var errInvalidToken = errors.New("invalid or expired stream token")
+
+//claims are the payment a stream token grants access to and when it expires
+type claims struct {
+	WorkerID string `json:"w"`
+	Address  string `json:"a"`
+	Expires  int64  `json:"e"`
+}
+
+//IssueToken returns a token opening the payment stream of the worker until ttl has passed.  The token is
+//signed with the secret, so any processor sharing it can verify the token.
+func IssueToken(secret []byte, workerID string, address string, ttl time.Duration) string {
+	payload, _ := json.Marshal(claims{WorkerID: workerID, Address: address, Expires: time.Now().Add(ttl).Unix()})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sign(secret, encoded))
+}
+
+//verifyToken returns the claims of a token signed with the secret that hasn't expired
+func verifyToken(secret []byte, token string) (claims, error) {
+	var c claims
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, sign(secret, encoded)) {
+		return c, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, &c) != nil {
+		return c, errInvalidToken
+	}
+	if time.Now().Unix() >= c.Expires {
+		return c, errInvalidToken
+	}
+	return c, nil
+}
+
+func sign(secret []byte, encoded string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,54 @@
+package paymentapi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"nano-pp/codec"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+)
+
+//watch calls send with the current status of the worker, then with each of its payment events that
+//changes the status, until the status is final or ctx is done.  The status is read with readStatus once
+//the payment events are followed, so no transition falls between them.  The payment is nil for the
+//status current when the watch started.
+func watch(ctx context.Context, st store.Store, logger *slog.Logger, workerID string, address string, readStatus func() (string, error), send func(status string, payment *structs.Payment) error) error {
+	sub, err := st.Follow(store.PaymentStream(address), logger)
+	if err != nil {
+		return fmt.Errorf("error following the payment events: %v", err)
+	}
+	defer sub.Close()
+
+	current, err := readStatus()
+	if err != nil {
+		return err
+	}
+	if err := send(current, nil); err != nil {
+		return err
+	}
+
+	for !structs.Final(current) {
+		select {
+		case message, ok := <-sub.Messages():
+			if !ok {
+				return fmt.Errorf("payment event subscription closed")
+			}
+			payment, err := codec.DecodePayment(message.Payload)
+			if err != nil {
+				logger.Error("error decoding payment event", "error", err)
+				continue
+			}
+			if payment.WorkerID != workerID || payment.Outcome() == current {
+				continue
+			}
+			current = payment.Outcome()
+			if err := send(current, &payment); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
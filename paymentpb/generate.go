@@ -0,0 +1,5 @@
+//Package paymentpb holds the protobuf payment messages and the gRPC payment service generated from
+//payment.proto.  Regenerate with go generate after editing it.
+package paymentpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative payment.proto
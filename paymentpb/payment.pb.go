@@ -0,0 +1,774 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: payment.proto
+
+// The payment messages of the processor steps doc and the gRPC API serving them.  Amounts are raw, as
+// decimal strings.
+
+package paymentpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// PaymentRequest asks the processor to watch for a payment
+type PaymentRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Hash being confirmed by a checkpointed request, set by the processor
+	ValidationHash string `protobuf:"bytes,1,opt,name=validation_hash,json=validationHash,proto3" json:"validation_hash,omitempty"`
+	// The Nano address where the payment is expected
+	DestinationAddress string `protobuf:"bytes,2,opt,name=destination_address,json=destinationAddress,proto3" json:"destination_address,omitempty"`
+	// The amount expected at the destination address
+	Amount string `protobuf:"bytes,3,opt,name=amount,proto3" json:"amount,omitempty"`
+	// Worker ID of a checkpointed request, assigned by the processor
+	WorkerId string `protobuf:"bytes,4,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	// Optional: the merchant whose policy applies, found from the destination address if empty
+	Merchant string `protobuf:"bytes,5,opt,name=merchant,proto3" json:"merchant,omitempty"`
+	// Optional: describes the payment in the payment URI, e.g. an order number
+	Message string `protobuf:"bytes,6,opt,name=message,proto3" json:"message,omitempty"`
+	// Optional: the price in currency, used instead of amount.  Amount is then locked at rate.
+	FiatAmount string `protobuf:"bytes,7,opt,name=fiat_amount,json=fiatAmount,proto3" json:"fiat_amount,omitempty"`
+	Currency   string `protobuf:"bytes,8,opt,name=currency,proto3" json:"currency,omitempty"`
+	// Price of one NANO in currency that amount was locked at
+	Rate string `protobuf:"bytes,9,opt,name=rate,proto3" json:"rate,omitempty"`
+	// Optional: the difference from amount accepted as paid, e.g. "1000raw", "0.1%" or "6dp"
+	Tolerance string `protobuf:"bytes,10,opt,name=tolerance,proto3" json:"tolerance,omitempty"`
+	// Optional: correlates the acknowledgement with the request, assigned by CreatePayment
+	RequestId     string `protobuf:"bytes,11,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PaymentRequest) Reset() {
+	*x = PaymentRequest{}
+	mi := &file_payment_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PaymentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentRequest) ProtoMessage() {}
+
+func (x *PaymentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_payment_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentRequest.ProtoReflect.Descriptor instead.
+func (*PaymentRequest) Descriptor() ([]byte, []int) {
+	return file_payment_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PaymentRequest) GetValidationHash() string {
+	if x != nil {
+		return x.ValidationHash
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetDestinationAddress() string {
+	if x != nil {
+		return x.DestinationAddress
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetAmount() string {
+	if x != nil {
+		return x.Amount
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetMerchant() string {
+	if x != nil {
+		return x.Merchant
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetFiatAmount() string {
+	if x != nil {
+		return x.FiatAmount
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetRate() string {
+	if x != nil {
+		return x.Rate
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetTolerance() string {
+	if x != nil {
+		return x.Tolerance
+	}
+	return ""
+}
+
+func (x *PaymentRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+// PaymentAck confirms the payment request was taken by a worker
+type PaymentAck struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	DestinationAddress string                 `protobuf:"bytes,1,opt,name=destination_address,json=destinationAddress,proto3" json:"destination_address,omitempty"`
+	ExpectedAmount     string                 `protobuf:"bytes,2,opt,name=expected_amount,json=expectedAmount,proto3" json:"expected_amount,omitempty"`
+	// Worker ID for status reference
+	WorkerId string `protobuf:"bytes,3,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	// Token opening the payment stream for checkout pages, when stream tokens are configured
+	Token string `protobuf:"bytes,4,opt,name=token,proto3" json:"token,omitempty"`
+	// nano: URI for wallets to pay the request with, also rendered by the QR code endpoint
+	PaymentUri string `protobuf:"bytes,5,opt,name=payment_uri,json=paymentUri,proto3" json:"payment_uri,omitempty"`
+	// Fiat price of a fiat request and the rate expected_amount was locked at
+	FiatAmount string `protobuf:"bytes,6,opt,name=fiat_amount,json=fiatAmount,proto3" json:"fiat_amount,omitempty"`
+	Currency   string `protobuf:"bytes,7,opt,name=currency,proto3" json:"currency,omitempty"`
+	Rate       string `protobuf:"bytes,8,opt,name=rate,proto3" json:"rate,omitempty"`
+	// Why the request was refused, no worker was started
+	Error string `protobuf:"bytes,9,opt,name=error,proto3" json:"error,omitempty"`
+	// Amount of the request when expected_amount has a unique suffix added
+	RequestedAmount string `protobuf:"bytes,10,opt,name=requested_amount,json=requestedAmount,proto3" json:"requested_amount,omitempty"`
+	// Request ID of the request acknowledged
+	RequestId     string `protobuf:"bytes,11,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PaymentAck) Reset() {
+	*x = PaymentAck{}
+	mi := &file_payment_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PaymentAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentAck) ProtoMessage() {}
+
+func (x *PaymentAck) ProtoReflect() protoreflect.Message {
+	mi := &file_payment_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentAck.ProtoReflect.Descriptor instead.
+func (*PaymentAck) Descriptor() ([]byte, []int) {
+	return file_payment_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PaymentAck) GetDestinationAddress() string {
+	if x != nil {
+		return x.DestinationAddress
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetExpectedAmount() string {
+	if x != nil {
+		return x.ExpectedAmount
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetPaymentUri() string {
+	if x != nil {
+		return x.PaymentUri
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetFiatAmount() string {
+	if x != nil {
+		return x.FiatAmount
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetRate() string {
+	if x != nil {
+		return x.Rate
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetRequestedAmount() string {
+	if x != nil {
+		return x.RequestedAmount
+	}
+	return ""
+}
+
+func (x *PaymentAck) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+// Payment is an update on the payment during confirmation
+type Payment struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// "confirming", "success" or "error"
+	Status string `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	// Hash of the transaction that completed the payment
+	Hash string `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+	// 0 timeout, 1 overpayment, 2 underpayment, 3 cancelled, 4 within tolerance
+	ErrorCode          int32  `protobuf:"varint,3,opt,name=error_code,json=errorCode,proto3" json:"error_code,omitempty"`
+	ErrorMessage       string `protobuf:"bytes,4,opt,name=error_message,json=errorMessage,proto3" json:"error_message,omitempty"`
+	DestinationAddress string `protobuf:"bytes,5,opt,name=destination_address,json=destinationAddress,proto3" json:"destination_address,omitempty"`
+	// Address that made the payment
+	SendingAddress string `protobuf:"bytes,6,opt,name=sending_address,json=sendingAddress,proto3" json:"sending_address,omitempty"`
+	ExpectedAmount string `protobuf:"bytes,7,opt,name=expected_amount,json=expectedAmount,proto3" json:"expected_amount,omitempty"`
+	// Amount validated on the transaction hash
+	ValidatedAmount string `protobuf:"bytes,8,opt,name=validated_amount,json=validatedAmount,proto3" json:"validated_amount,omitempty"`
+	WorkerId        string `protobuf:"bytes,9,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	// Fiat price of a fiat request and the rate expected_amount was locked at
+	FiatAmount string `protobuf:"bytes,10,opt,name=fiat_amount,json=fiatAmount,proto3" json:"fiat_amount,omitempty"`
+	Currency   string `protobuf:"bytes,11,opt,name=currency,proto3" json:"currency,omitempty"`
+	Rate       string `protobuf:"bytes,12,opt,name=rate,proto3" json:"rate,omitempty"`
+	// Difference from expected_amount on a success within the tolerance
+	Note          string `protobuf:"bytes,13,opt,name=note,proto3" json:"note,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Payment) Reset() {
+	*x = Payment{}
+	mi := &file_payment_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Payment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Payment) ProtoMessage() {}
+
+func (x *Payment) ProtoReflect() protoreflect.Message {
+	mi := &file_payment_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Payment.ProtoReflect.Descriptor instead.
+func (*Payment) Descriptor() ([]byte, []int) {
+	return file_payment_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Payment) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *Payment) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+func (x *Payment) GetErrorCode() int32 {
+	if x != nil {
+		return x.ErrorCode
+	}
+	return 0
+}
+
+func (x *Payment) GetErrorMessage() string {
+	if x != nil {
+		return x.ErrorMessage
+	}
+	return ""
+}
+
+func (x *Payment) GetDestinationAddress() string {
+	if x != nil {
+		return x.DestinationAddress
+	}
+	return ""
+}
+
+func (x *Payment) GetSendingAddress() string {
+	if x != nil {
+		return x.SendingAddress
+	}
+	return ""
+}
+
+func (x *Payment) GetExpectedAmount() string {
+	if x != nil {
+		return x.ExpectedAmount
+	}
+	return ""
+}
+
+func (x *Payment) GetValidatedAmount() string {
+	if x != nil {
+		return x.ValidatedAmount
+	}
+	return ""
+}
+
+func (x *Payment) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
+func (x *Payment) GetFiatAmount() string {
+	if x != nil {
+		return x.FiatAmount
+	}
+	return ""
+}
+
+func (x *Payment) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
+func (x *Payment) GetRate() string {
+	if x != nil {
+		return x.Rate
+	}
+	return ""
+}
+
+func (x *Payment) GetNote() string {
+	if x != nil {
+		return x.Note
+	}
+	return ""
+}
+
+// PaymentRef identifies a payment request by the fields of its PaymentAck
+type PaymentRef struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId string                 `protobuf:"bytes,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	// Required by WatchPayment, whose updates are read from the events for the address
+	DestinationAddress string `protobuf:"bytes,2,opt,name=destination_address,json=destinationAddress,proto3" json:"destination_address,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *PaymentRef) Reset() {
+	*x = PaymentRef{}
+	mi := &file_payment_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PaymentRef) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentRef) ProtoMessage() {}
+
+func (x *PaymentRef) ProtoReflect() protoreflect.Message {
+	mi := &file_payment_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentRef.ProtoReflect.Descriptor instead.
+func (*PaymentRef) Descriptor() ([]byte, []int) {
+	return file_payment_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PaymentRef) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
+func (x *PaymentRef) GetDestinationAddress() string {
+	if x != nil {
+		return x.DestinationAddress
+	}
+	return ""
+}
+
+// PaymentStatus is the status of a payment worker: "pending", "confirming", "success", "overpayment",
+// "underpayment", "timeout" or "cancelled"
+type PaymentStatus struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId      string                 `protobuf:"bytes,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	Status        string                 `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PaymentStatus) Reset() {
+	*x = PaymentStatus{}
+	mi := &file_payment_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PaymentStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentStatus) ProtoMessage() {}
+
+func (x *PaymentStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_payment_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentStatus.ProtoReflect.Descriptor instead.
+func (*PaymentStatus) Descriptor() ([]byte, []int) {
+	return file_payment_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PaymentStatus) GetWorkerId() string {
+	if x != nil {
+		return x.WorkerId
+	}
+	return ""
+}
+
+func (x *PaymentStatus) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+// PaymentUpdate is a status transition of a watched payment
+type PaymentUpdate struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Status string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	// The payment event behind the transition, unset for the status current when the watch started
+	Payment       *Payment `protobuf:"bytes,2,opt,name=payment,proto3" json:"payment,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PaymentUpdate) Reset() {
+	*x = PaymentUpdate{}
+	mi := &file_payment_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PaymentUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PaymentUpdate) ProtoMessage() {}
+
+func (x *PaymentUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_payment_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PaymentUpdate.ProtoReflect.Descriptor instead.
+func (*PaymentUpdate) Descriptor() ([]byte, []int) {
+	return file_payment_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PaymentUpdate) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *PaymentUpdate) GetPayment() *Payment {
+	if x != nil {
+		return x.Payment
+	}
+	return nil
+}
+
+type CancelPaymentResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CancelPaymentResponse) Reset() {
+	*x = CancelPaymentResponse{}
+	mi := &file_payment_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CancelPaymentResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CancelPaymentResponse) ProtoMessage() {}
+
+func (x *CancelPaymentResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_payment_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CancelPaymentResponse.ProtoReflect.Descriptor instead.
+func (*CancelPaymentResponse) Descriptor() ([]byte, []int) {
+	return file_payment_proto_rawDescGZIP(), []int{6}
+}
+
+var File_payment_proto protoreflect.FileDescriptor
+
+const file_payment_proto_rawDesc = "" +
+	"\n" +
+	"\rpayment.proto\x12\tnanopp.v1\"\xe3\x02\n" +
+	"\x0ePaymentRequest\x12'\n" +
+	"\x0fvalidation_hash\x18\x01 \x01(\tR\x0evalidationHash\x12/\n" +
+	"\x13destination_address\x18\x02 \x01(\tR\x12destinationAddress\x12\x16\n" +
+	"\x06amount\x18\x03 \x01(\tR\x06amount\x12\x1b\n" +
+	"\tworker_id\x18\x04 \x01(\tR\bworkerId\x12\x1a\n" +
+	"\bmerchant\x18\x05 \x01(\tR\bmerchant\x12\x18\n" +
+	"\amessage\x18\x06 \x01(\tR\amessage\x12\x1f\n" +
+	"\vfiat_amount\x18\a \x01(\tR\n" +
+	"fiatAmount\x12\x1a\n" +
+	"\bcurrency\x18\b \x01(\tR\bcurrency\x12\x12\n" +
+	"\x04rate\x18\t \x01(\tR\x04rate\x12\x1c\n" +
+	"\ttolerance\x18\n" +
+	" \x01(\tR\ttolerance\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\v \x01(\tR\trequestId\"\xeb\x02\n" +
+	"\n" +
+	"PaymentAck\x12/\n" +
+	"\x13destination_address\x18\x01 \x01(\tR\x12destinationAddress\x12'\n" +
+	"\x0fexpected_amount\x18\x02 \x01(\tR\x0eexpectedAmount\x12\x1b\n" +
+	"\tworker_id\x18\x03 \x01(\tR\bworkerId\x12\x14\n" +
+	"\x05token\x18\x04 \x01(\tR\x05token\x12\x1f\n" +
+	"\vpayment_uri\x18\x05 \x01(\tR\n" +
+	"paymentUri\x12\x1f\n" +
+	"\vfiat_amount\x18\x06 \x01(\tR\n" +
+	"fiatAmount\x12\x1a\n" +
+	"\bcurrency\x18\a \x01(\tR\bcurrency\x12\x12\n" +
+	"\x04rate\x18\b \x01(\tR\x04rate\x12\x14\n" +
+	"\x05error\x18\t \x01(\tR\x05error\x12)\n" +
+	"\x10requested_amount\x18\n" +
+	" \x01(\tR\x0frequestedAmount\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\v \x01(\tR\trequestId\"\xa9\x03\n" +
+	"\aPayment\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x12\n" +
+	"\x04hash\x18\x02 \x01(\tR\x04hash\x12\x1d\n" +
+	"\n" +
+	"error_code\x18\x03 \x01(\x05R\terrorCode\x12#\n" +
+	"\rerror_message\x18\x04 \x01(\tR\ferrorMessage\x12/\n" +
+	"\x13destination_address\x18\x05 \x01(\tR\x12destinationAddress\x12'\n" +
+	"\x0fsending_address\x18\x06 \x01(\tR\x0esendingAddress\x12'\n" +
+	"\x0fexpected_amount\x18\a \x01(\tR\x0eexpectedAmount\x12)\n" +
+	"\x10validated_amount\x18\b \x01(\tR\x0fvalidatedAmount\x12\x1b\n" +
+	"\tworker_id\x18\t \x01(\tR\bworkerId\x12\x1f\n" +
+	"\vfiat_amount\x18\n" +
+	" \x01(\tR\n" +
+	"fiatAmount\x12\x1a\n" +
+	"\bcurrency\x18\v \x01(\tR\bcurrency\x12\x12\n" +
+	"\x04rate\x18\f \x01(\tR\x04rate\x12\x12\n" +
+	"\x04note\x18\r \x01(\tR\x04note\"Z\n" +
+	"\n" +
+	"PaymentRef\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\tR\bworkerId\x12/\n" +
+	"\x13destination_address\x18\x02 \x01(\tR\x12destinationAddress\"D\n" +
+	"\rPaymentStatus\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\tR\bworkerId\x12\x16\n" +
+	"\x06status\x18\x02 \x01(\tR\x06status\"U\n" +
+	"\rPaymentUpdate\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12,\n" +
+	"\apayment\x18\x02 \x01(\v2\x12.nanopp.v1.PaymentR\apayment\"\x17\n" +
+	"\x15CancelPaymentResponse2\x9f\x02\n" +
+	"\x0ePaymentService\x12A\n" +
+	"\rCreatePayment\x12\x19.nanopp.v1.PaymentRequest\x1a\x15.nanopp.v1.PaymentAck\x12=\n" +
+	"\n" +
+	"GetPayment\x12\x15.nanopp.v1.PaymentRef\x1a\x18.nanopp.v1.PaymentStatus\x12H\n" +
+	"\rCancelPayment\x12\x15.nanopp.v1.PaymentRef\x1a .nanopp.v1.CancelPaymentResponse\x12A\n" +
+	"\fWatchPayment\x12\x15.nanopp.v1.PaymentRef\x1a\x18.nanopp.v1.PaymentUpdate0\x01B,\n" +
+	"\x15com.kitepay.nanopp.v1P\x01Z\x11nano-pp/paymentpbb\x06proto3"
+
+var (
+	file_payment_proto_rawDescOnce sync.Once
+	file_payment_proto_rawDescData []byte
+)
+
+func file_payment_proto_rawDescGZIP() []byte {
+	file_payment_proto_rawDescOnce.Do(func() {
+		file_payment_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_payment_proto_rawDesc), len(file_payment_proto_rawDesc)))
+	})
+	return file_payment_proto_rawDescData
+}
+
+var file_payment_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_payment_proto_goTypes = []any{
+	(*PaymentRequest)(nil),        // 0: nanopp.v1.PaymentRequest
+	(*PaymentAck)(nil),            // 1: nanopp.v1.PaymentAck
+	(*Payment)(nil),               // 2: nanopp.v1.Payment
+	(*PaymentRef)(nil),            // 3: nanopp.v1.PaymentRef
+	(*PaymentStatus)(nil),         // 4: nanopp.v1.PaymentStatus
+	(*PaymentUpdate)(nil),         // 5: nanopp.v1.PaymentUpdate
+	(*CancelPaymentResponse)(nil), // 6: nanopp.v1.CancelPaymentResponse
+}
+var file_payment_proto_depIdxs = []int32{
+	2, // 0: nanopp.v1.PaymentUpdate.payment:type_name -> nanopp.v1.Payment
+	0, // 1: nanopp.v1.PaymentService.CreatePayment:input_type -> nanopp.v1.PaymentRequest
+	3, // 2: nanopp.v1.PaymentService.GetPayment:input_type -> nanopp.v1.PaymentRef
+	3, // 3: nanopp.v1.PaymentService.CancelPayment:input_type -> nanopp.v1.PaymentRef
+	3, // 4: nanopp.v1.PaymentService.WatchPayment:input_type -> nanopp.v1.PaymentRef
+	1, // 5: nanopp.v1.PaymentService.CreatePayment:output_type -> nanopp.v1.PaymentAck
+	4, // 6: nanopp.v1.PaymentService.GetPayment:output_type -> nanopp.v1.PaymentStatus
+	6, // 7: nanopp.v1.PaymentService.CancelPayment:output_type -> nanopp.v1.CancelPaymentResponse
+	5, // 8: nanopp.v1.PaymentService.WatchPayment:output_type -> nanopp.v1.PaymentUpdate
+	5, // [5:9] is the sub-list for method output_type
+	1, // [1:5] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_payment_proto_init() }
+func file_payment_proto_init() {
+	if File_payment_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_payment_proto_rawDesc), len(file_payment_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_payment_proto_goTypes,
+		DependencyIndexes: file_payment_proto_depIdxs,
+		MessageInfos:      file_payment_proto_msgTypes,
+	}.Build()
+	File_payment_proto = out.File
+	file_payment_proto_goTypes = nil
+	file_payment_proto_depIdxs = nil
+}
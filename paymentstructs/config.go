@@ -0,0 +1,462 @@
+package structs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//Config holds the processor configuration.  It is read once at startup from the defaults, an optional
+//YAML file and the environment, in that order, and then passed to everything that needs it.
+type Config struct {
+	RPCHost           string `yaml:"rpc_host"`
+	RPCPort           string `yaml:"rpc_port"`
+	NanoWebsocketHost string `yaml:"websocket_host"`
+	NanoWebsocketPort string `yaml:"websocket_port"`
+
+	RedisHost             string `yaml:"redis_host"`
+	RedisPort             string `yaml:"redis_port"`
+	RedisUsername         string `yaml:"redis_username"`
+	RedisPassword         string `yaml:"redis_password"`
+	RedisDB               int    `yaml:"redis_db"`
+	RedisTLS              bool   `yaml:"redis_tls"`
+	RedisTLSCAFile        string `yaml:"redis_tls_ca"`
+	RedisTLSServerName    string `yaml:"redis_tls_server_name"`
+	RedisTLSSkipVerify    bool   `yaml:"redis_tls_skip_verify"`
+	RedisSentinels        string `yaml:"redis_sentinels"`
+	RedisSentinelMaster   string `yaml:"redis_sentinel_master"`
+	RedisSentinelPassword string `yaml:"redis_sentinel_password"`
+	RedisCluster          bool   `yaml:"redis_cluster"`
+	RedisMaxActive        int    `yaml:"redis_max_active"`
+	RedisMaxIdle          int    `yaml:"redis_max_idle"`
+
+	TimeoutDuration int `yaml:"timeout_duration"`
+	Consumers       int `yaml:"consumers"`
+	MaxWorkers      int `yaml:"max_workers"`
+	MaxUnacked      int `yaml:"max_unacked"`
+	PrefetchLimit   int `yaml:"prefetch_limit"`
+	PollDuration    int `yaml:"poll_duration_ms"`
+
+	EventMode        string `yaml:"event_mode"`
+	WireFormat       string `yaml:"wire_format"`
+	StreamMaxLen     int    `yaml:"stream_max_len"`
+	StoreBackend     string `yaml:"store_backend"`
+	KeyPrefix        string `yaml:"redis_key_prefix"`
+	WorkingRetention int    `yaml:"working_retention"`
+	ResultRetention  int    `yaml:"result_retention"`
+	JanitorInterval  int    `yaml:"janitor_interval"`
+	JanitorDryRun    bool   `yaml:"janitor_dry_run"`
+
+	ShutdownGrace      int    `yaml:"shutdown_grace"`
+	MetricsAddress     string `yaml:"metrics_address"`
+	GRPCAddress        string `yaml:"grpc_address"`
+	HTTPAddress        string `yaml:"http_address"`
+	StreamSecret       string `yaml:"stream_secret"`
+	StreamTokenTTL     int    `yaml:"stream_token_ttl"`
+	LogLevel           string `yaml:"log_level"`
+	WebsocketDownLimit int    `yaml:"websocket_down_limit"`
+	NodeMaxUnchecked   int    `yaml:"node_max_unchecked"`
+	NodeMaxCementedLag int    `yaml:"node_max_cemented_lag"`
+
+	PriceOracle       string `yaml:"price_oracle"`
+	PriceFile         string `yaml:"price_file"`
+	PriceURL          string `yaml:"price_url"`
+	PricePath         string `yaml:"price_path"`
+	PriceCacheSeconds int    `yaml:"price_cache_seconds"`
+	PriceSlippageBps  int    `yaml:"price_slippage_bps"`
+
+	Tolerance       string `yaml:"tolerance"`
+	ToleranceReport string `yaml:"tolerance_report"`
+
+	UniqueAmountRange int    `yaml:"unique_amount_range"`
+	Attribution       string `yaml:"attribution"`
+
+	WebsocketRecord         string `yaml:"websocket_record"`
+	WebsocketRecordMaxBytes int    `yaml:"websocket_record_max_bytes"`
+	WebsocketRecordBackups  int    `yaml:"websocket_record_backups"`
+
+	// Policies by merchant name, only set from the file
+	Merchants map[string]MerchantPolicy `yaml:"merchants"`
+}
+
+//MerchantPolicy holds the settings that can differ per merchant
+type MerchantPolicy struct {
+	// Destination addresses belonging to the merchant
+	Addresses []string `yaml:"addresses"`
+	// Seconds a payment request waits for a payment, 0 uses the global timeout_duration
+	TimeoutDuration int `yaml:"timeout_duration"`
+	// Recipient named in the payment URI, the merchant name if empty
+	Label string `yaml:"label"`
+	// Slippage accepted on fiat payments in hundredths of a percent, 0 uses the global price_slippage_bps
+	PriceSlippageBps int `yaml:"price_slippage_bps"`
+	// Difference from the expected amount accepted as paid and how it is reported, empty uses the global
+	// tolerance and tolerance_report
+	Tolerance       string `yaml:"tolerance"`
+	ToleranceReport string `yaml:"tolerance_report"`
+	// Add a unique suffix of raw to each amount so requests can share a static address, matching sends by
+	// exact amount.  The suffix is at most unique_amount_range, 0 uses the global value.
+	UniqueAmounts     bool `yaml:"unique_amounts"`
+	UniqueAmountRange int  `yaml:"unique_amount_range"`
+	// Which of several requests watching an address a send is credited to, empty uses the global attribution
+	Attribution string `yaml:"attribution"`
+}
+
+//DefaultConfig returns the configuration used when neither the file nor the environment set a value.
+func DefaultConfig() Config {
+	return Config{
+		RPCHost:           "http://[::1]",
+		RPCPort:           "55000",
+		NanoWebsocketHost: "ws://[::1]",
+		NanoWebsocketPort: "57000",
+		RedisHost:         "localhost",
+		RedisPort:         "22000",
+		RedisMaxActive:    200,
+		RedisMaxIdle:      80,
+		TimeoutDuration:   60,
+		Consumers:         3,
+		MaxWorkers:        100,
+		MaxUnacked:        50,
+		PrefetchLimit:     10,
+		PollDuration:      500,
+		// EVENTMODE is "streams", "pubsub" or "both"
+		EventMode: "both",
+		// WIREFORMAT is "json" or "protobuf", the format queue and pub/sub payloads are written in.  Both
+		// are read whatever it is set to.
+		WireFormat:   "json",
+		StreamMaxLen: 10000,
+		// STOREBACKEND is "redis" or "memory"
+		StoreBackend: "redis",
+		// Retentions are in seconds after the request deadline
+		WorkingRetention: 3600,
+		ResultRetention:  86400,
+		// JANITORINTERVAL is in seconds, 0 disables the janitor
+		JanitorInterval: 3600,
+		// SHUTDOWNGRACE is the seconds running workers have to finish before they are checkpointed
+		ShutdownGrace: 30,
+		// METRICSADDRESS is where /metrics, /healthz and /readyz are served, leave empty to disable
+		MetricsAddress: ":9090",
+		// GRPCADDRESS is where the gRPC payment service is served, leave empty to disable
+		GRPCAddress: "",
+		// HTTPADDRESS is where the payment streams for checkout pages are served, leave empty to disable.
+		// STREAMSECRET signs the stream tokens issued with each Ack, which expire after STREAMTOKENTTL
+		// seconds.  Processors sharing a queue need the same secret.
+		HTTPAddress:    "",
+		StreamTokenTTL: 900,
+		// LOGLEVEL is "debug", "info", "warn" or "error"
+		LogLevel: "info",
+		// Readiness fails after the websocket is down WEBSOCKETDOWNLIMIT seconds, or while the node has
+		// more than NODEMAXUNCHECKED unchecked blocks or its cemented count trails by more than
+		// NODEMAXCEMENTEDLAG
+		WebsocketDownLimit: 30,
+		NodeMaxUnchecked:   10000,
+		NodeMaxCementedLag: 1000,
+		// PRICEORACLE is "static" (PRICEFILE) or "http" (PRICEURL and PRICEPATH), leave empty to refuse fiat
+		// requests.  Feed prices are cached PRICECACHESECONDS.  Fiat payments within PRICESLIPPAGEBPS
+		// hundredths of a percent of the locked amount are accepted.
+		PriceCacheSeconds: 60,
+		// Payments within TOLERANCE of the expected amount, e.g. "1000raw", "0.1%" or "6dp", count as paid
+		// and are reported as a success with a note, or with TOLERANCEREPORT "error" as error code 4
+		ToleranceReport: "success",
+		// Merchants with unique_amounts add a suffix of 1 to UNIQUEAMOUNTRANGE raw to each amount, which is
+		// also the most requests open at once to one of their addresses
+		UniqueAmountRange: 1000,
+		// A send to an address several requests watch is credited to one of them, the oldest with ATTRIBUTION
+		// "fifo" or the oldest expecting its amount, else the oldest, with "amount"
+		Attribution: "fifo",
+		// WEBSOCKETRECORD is a file the raw websocket frames are recorded to, leave empty to disable.  It is
+		// rotated at WEBSOCKETRECORDMAXBYTES keeping WEBSOCKETRECORDBACKUPS older files
+		WebsocketRecordMaxBytes: 64 << 20,
+		WebsocketRecordBackups:  5,
+	}
+}
+
+//LoadConfig returns the configuration from the YAML file at path, if path is not empty, with any ENV
+//values overriding it.  Values set in neither use the defaults.  Unknown keys in the file, malformed
+//ENV values and a configuration that fails validation are returned as errors.
+func LoadConfig(path string) (Config, error) {
+	configuration := DefaultConfig()
+
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return configuration, fmt.Errorf("error opening config file: %v", err)
+		}
+		defer file.Close()
+
+		d := yaml.NewDecoder(file)
+		d.KnownFields(true)
+		if err := d.Decode(&configuration); err != nil {
+			return configuration, fmt.Errorf("error reading config file %s: %v", path, err)
+		}
+	}
+
+	if err := applyEnv(&configuration); err != nil {
+		return configuration, err
+	}
+	if err := configuration.Validate(); err != nil {
+		return configuration, err
+	}
+	return configuration, nil
+}
+
+//envOverrides sets configuration fields from the ENV values that are present, collecting any that
+//cannot be converted
+type envOverrides struct {
+	errs []string
+}
+
+func (e *envOverrides) string(key string, field *string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*field = value
+	}
+}
+
+func (e *envOverrides) int(key string, field *int) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return
+	}
+	converted, err := strconv.Atoi(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s must be an integer, got %q", key, value))
+		return
+	}
+	*field = converted
+}
+
+func (e *envOverrides) bool(key string, field *bool) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return
+	}
+	converted, err := strconv.ParseBool(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("%s must be true or false, got %q", key, value))
+		return
+	}
+	*field = converted
+}
+
+func applyEnv(configuration *Config) error {
+	var env envOverrides
+
+	env.string("RPCHOST", &configuration.RPCHost)
+	env.string("RPCPORT", &configuration.RPCPort)
+	env.string("NANOWEBSOCKETHOST", &configuration.NanoWebsocketHost)
+	env.string("NANOWEBSOCKETPORT", &configuration.NanoWebsocketPort)
+	env.string("REDISHOST", &configuration.RedisHost)
+	env.string("REDISPORT", &configuration.RedisPort)
+	env.string("REDISUSERNAME", &configuration.RedisUsername)
+	env.string("REDISPASSWORD", &configuration.RedisPassword)
+	env.int("REDISDB", &configuration.RedisDB)
+	env.bool("REDISTLS", &configuration.RedisTLS)
+	env.string("REDISTLSCA", &configuration.RedisTLSCAFile)
+	env.string("REDISTLSSERVERNAME", &configuration.RedisTLSServerName)
+	env.bool("REDISTLSSKIPVERIFY", &configuration.RedisTLSSkipVerify)
+	// REDISSENTINELS is a comma separated list of sentinel host:port addresses
+	env.string("REDISSENTINELS", &configuration.RedisSentinels)
+	env.string("REDISSENTINELMASTER", &configuration.RedisSentinelMaster)
+	env.string("REDISSENTINELPASSWORD", &configuration.RedisSentinelPassword)
+	env.bool("REDISCLUSTER", &configuration.RedisCluster)
+	// REDISMAXACTIVE caps the connections of the shared pool, REDISMAXIDLE the idle ones kept open
+	env.int("REDISMAXACTIVE", &configuration.RedisMaxActive)
+	env.int("REDISMAXIDLE", &configuration.RedisMaxIdle)
+	env.int("TIMEOUTDURATION", &configuration.TimeoutDuration)
+	env.int("CONSUMERS", &configuration.Consumers)
+	// MAXWORKERS limits the payment requests worked at once, further requests wait unacked in the queue
+	env.int("MAXWORKERS", &configuration.MaxWorkers)
+	// MAXUNACKED is the unacked depth of a queue above which a processor with no free worker slot hands
+	// deliveries back to the queue instead of holding them
+	env.int("MAXUNACKED", &configuration.MaxUnacked)
+	env.int("PREFETCHLIMIT", &configuration.PrefetchLimit)
+	env.int("POLLDURATION", &configuration.PollDuration)
+	env.string("EVENTMODE", &configuration.EventMode)
+	env.string("WIREFORMAT", &configuration.WireFormat)
+	env.int("STREAMMAXLEN", &configuration.StreamMaxLen)
+	env.string("STOREBACKEND", &configuration.StoreBackend)
+	// REDISKEYPREFIX namespaces every key, channel and queue, e.g. "staging:"
+	env.string("REDISKEYPREFIX", &configuration.KeyPrefix)
+	env.int("WORKINGRETENTION", &configuration.WorkingRetention)
+	env.int("RESULTRETENTION", &configuration.ResultRetention)
+	env.int("JANITORINTERVAL", &configuration.JanitorInterval)
+	env.bool("JANITORDRYRUN", &configuration.JanitorDryRun)
+	env.int("SHUTDOWNGRACE", &configuration.ShutdownGrace)
+	env.string("METRICSADDRESS", &configuration.MetricsAddress)
+	env.string("GRPCADDRESS", &configuration.GRPCAddress)
+	env.string("HTTPADDRESS", &configuration.HTTPAddress)
+	env.string("STREAMSECRET", &configuration.StreamSecret)
+	env.int("STREAMTOKENTTL", &configuration.StreamTokenTTL)
+	env.string("LOGLEVEL", &configuration.LogLevel)
+	env.int("WEBSOCKETDOWNLIMIT", &configuration.WebsocketDownLimit)
+	env.int("NODEMAXUNCHECKED", &configuration.NodeMaxUnchecked)
+	env.int("NODEMAXCEMENTEDLAG", &configuration.NodeMaxCementedLag)
+	env.string("PRICEORACLE", &configuration.PriceOracle)
+	env.string("PRICEFILE", &configuration.PriceFile)
+	env.string("PRICEURL", &configuration.PriceURL)
+	env.string("PRICEPATH", &configuration.PricePath)
+	env.int("PRICECACHESECONDS", &configuration.PriceCacheSeconds)
+	env.int("PRICESLIPPAGEBPS", &configuration.PriceSlippageBps)
+	env.string("TOLERANCE", &configuration.Tolerance)
+	env.string("TOLERANCEREPORT", &configuration.ToleranceReport)
+	env.int("UNIQUEAMOUNTRANGE", &configuration.UniqueAmountRange)
+	env.string("ATTRIBUTION", &configuration.Attribution)
+	env.string("WEBSOCKETRECORD", &configuration.WebsocketRecord)
+	env.int("WEBSOCKETRECORDMAXBYTES", &configuration.WebsocketRecordMaxBytes)
+	env.int("WEBSOCKETRECORDBACKUPS", &configuration.WebsocketRecordBackups)
+
+	if len(env.errs) > 0 {
+		return fmt.Errorf("invalid environment: %s", strings.Join(env.errs, "; "))
+	}
+	return nil
+}
+
+//Validate checks the configuration and returns every problem found in one error.
+func (c Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	port := func(name string, value string) {
+		p, err := strconv.Atoi(value)
+		check(err == nil && p > 0 && p < 65536, "%s must be a port number, got %q", name, value)
+	}
+
+	check(c.RPCHost != "", "rpc_host is required")
+	port("rpc_port", c.RPCPort)
+	check(c.NanoWebsocketHost != "", "websocket_host is required")
+	port("websocket_port", c.NanoWebsocketPort)
+
+	check(c.StoreBackend == "redis" || c.StoreBackend == "memory", "store_backend must be redis or memory, got %q", c.StoreBackend)
+	if c.StoreBackend == "redis" {
+		if c.RedisSentinels == "" {
+			check(c.RedisHost != "", "redis_host is required")
+			port("redis_port", c.RedisPort)
+		} else {
+			check(c.RedisSentinelMaster != "", "redis_sentinel_master is required with redis_sentinels")
+		}
+		check(!(c.RedisCluster && c.RedisSentinels != ""), "redis_cluster and redis_sentinels cannot be used together")
+		check(!(c.RedisCluster && c.RedisDB != 0), "redis_db must be 0 with redis_cluster")
+	}
+	check(c.RedisDB >= 0, "redis_db must not be negative")
+	check(c.RedisMaxActive > 0, "redis_max_active must be positive")
+	check(c.RedisMaxIdle >= 0, "redis_max_idle must not be negative")
+
+	check(c.TimeoutDuration > 0, "timeout_duration must be positive")
+	check(c.Consumers > 0, "consumers must be positive")
+	check(c.MaxWorkers > 0, "max_workers must be positive")
+	check(c.MaxUnacked > 0, "max_unacked must be positive")
+	check(c.PrefetchLimit > 0, "prefetch_limit must be positive")
+	check(c.PollDuration > 0, "poll_duration_ms must be positive")
+
+	check(c.EventMode == "streams" || c.EventMode == "pubsub" || c.EventMode == "both", "event_mode must be streams, pubsub or both, got %q", c.EventMode)
+	check(c.WireFormat == "json" || c.WireFormat == "protobuf", "wire_format must be json or protobuf, got %q", c.WireFormat)
+	check(c.StreamMaxLen >= 0, "stream_max_len must not be negative")
+	check(c.WorkingRetention >= 0, "working_retention must not be negative")
+	check(c.ResultRetention >= 0, "result_retention must not be negative")
+	check(c.JanitorInterval >= 0, "janitor_interval must not be negative")
+	check(c.ShutdownGrace >= 0, "shutdown_grace must not be negative")
+	check(c.GRPCAddress == "" || c.GRPCAddress != c.MetricsAddress, "grpc_address and metrics_address must differ")
+	check(c.HTTPAddress == "" || (c.HTTPAddress != c.MetricsAddress && c.HTTPAddress != c.GRPCAddress), "http_address must differ from metrics_address and grpc_address")
+	check(c.HTTPAddress == "" || c.StreamSecret != "", "stream_secret is required with http_address")
+	check(c.StreamSecret == "" || len(c.StreamSecret) >= 32, "stream_secret must be at least 32 characters")
+	check(c.StreamTokenTTL > 0, "stream_token_ttl must be positive")
+
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		errs = append(errs, fmt.Sprintf("log_level must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	check(c.WebsocketDownLimit > 0, "websocket_down_limit must be positive")
+	check(c.NodeMaxUnchecked >= 0, "node_max_unchecked must not be negative")
+	check(c.NodeMaxCementedLag >= 0, "node_max_cemented_lag must not be negative")
+	check(c.PriceOracle == "" || c.PriceOracle == "static" || c.PriceOracle == "http", "price_oracle must be static or http, got %q", c.PriceOracle)
+	check(c.PriceOracle != "static" || c.PriceFile != "", "price_file is required with price_oracle static")
+	check(c.PriceOracle != "http" || (c.PriceURL != "" && c.PricePath != ""), "price_url and price_path are required with price_oracle http")
+	check(c.PriceCacheSeconds >= 0, "price_cache_seconds must not be negative")
+	check(c.PriceSlippageBps >= 0 && c.PriceSlippageBps <= 10000, "price_slippage_bps must be 0 to 10000")
+	_, err := ParseTolerance(c.Tolerance)
+	check(err == nil, "%v", err)
+	check(c.ToleranceReport == "success" || c.ToleranceReport == "error", "tolerance_report must be success or error, got %q", c.ToleranceReport)
+	check(c.UniqueAmountRange > 0, "unique_amount_range must be positive")
+	check(c.Attribution == "fifo" || c.Attribution == "amount", "attribution must be fifo or amount, got %q", c.Attribution)
+	check(c.WebsocketRecordMaxBytes > 0, "websocket_record_max_bytes must be positive")
+	check(c.WebsocketRecordBackups >= 0, "websocket_record_backups must not be negative")
+
+	owners := make(map[string]string)
+	for name, policy := range c.Merchants {
+		check(policy.TimeoutDuration >= 0, "merchants.%s.timeout_duration must not be negative", name)
+		check(policy.PriceSlippageBps >= 0 && policy.PriceSlippageBps <= 10000, "merchants.%s.price_slippage_bps must be 0 to 10000", name)
+		_, err := ParseTolerance(policy.Tolerance)
+		check(err == nil, "merchants.%s: %v", name, err)
+		check(policy.UniqueAmountRange >= 0, "merchants.%s.unique_amount_range must not be negative", name)
+		check(policy.Attribution == "" || policy.Attribution == "fifo" || policy.Attribution == "amount", "merchants.%s.attribution must be fifo or amount, got %q", name, policy.Attribution)
+		check(policy.ToleranceReport == "" || policy.ToleranceReport == "success" || policy.ToleranceReport == "error", "merchants.%s.tolerance_report must be success or error, got %q", name, policy.ToleranceReport)
+		for _, address := range policy.Addresses {
+			if owner, ok := owners[address]; ok && owner != name {
+				errs = append(errs, fmt.Sprintf("address %s is listed for merchants %s and %s", address, owner, name))
+			}
+			owners[address] = name
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//Policy returns the policy for a payment request, found by merchant name or else by destination
+//address, with unset values filled from the global configuration.
+func (c Config) Policy(merchant string, destinationAddress string) MerchantPolicy {
+	policy, ok := c.Merchants[merchant]
+	if !ok {
+		merchant = ""
+		for name, p := range c.Merchants {
+			for _, address := range p.Addresses {
+				if address == destinationAddress {
+					policy, merchant = p, name
+				}
+			}
+		}
+	}
+
+	if policy.Label == "" {
+		policy.Label = merchant
+	}
+	if policy.PriceSlippageBps == 0 {
+		policy.PriceSlippageBps = c.PriceSlippageBps
+	}
+	if policy.Tolerance == "" {
+		policy.Tolerance = c.Tolerance
+	}
+	if policy.ToleranceReport == "" {
+		policy.ToleranceReport = c.ToleranceReport
+	}
+	if policy.UniqueAmountRange == 0 {
+		policy.UniqueAmountRange = c.UniqueAmountRange
+	}
+	if policy.Attribution == "" {
+		policy.Attribution = c.Attribution
+	}
+
+	if policy.TimeoutDuration == 0 {
+		policy.TimeoutDuration = c.TimeoutDuration
+	}
+	return policy
+}
+
+//MaxTimeout returns the longest payment request timeout of any policy, in seconds.
+func (c Config) MaxTimeout() int {
+	timeout := c.TimeoutDuration
+	for _, policy := range c.Merchants {
+		if policy.TimeoutDuration > timeout {
+			timeout = policy.TimeoutDuration
+		}
+	}
+	return timeout
+}
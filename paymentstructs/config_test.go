@@ -0,0 +1,68 @@
+package structs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFileAndEnv(t *testing.T) {
+	path := writeConfig(t, `
+rpc_port: "7076"
+consumers: 5
+merchants:
+  shop:
+    addresses: [nano_1shop]
+    timeout_duration: 300
+`)
+	os.Setenv("CONSUMERS", "8")
+	defer os.Unsetenv("CONSUMERS")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RPCPort != "7076" {
+		t.Errorf("got rpc port '%s' want '7076'", config.RPCPort)
+	}
+	if config.Consumers != 8 {
+		t.Errorf("got %d consumers want the ENV value 8", config.Consumers)
+	}
+	if config.RPCHost != DefaultConfig().RPCHost {
+		t.Errorf("got rpc host '%s' want the default", config.RPCHost)
+	}
+
+	if timeout := config.Policy("", "nano_1shop").TimeoutDuration; timeout != 300 {
+		t.Errorf("got merchant timeout %d want 300", timeout)
+	}
+	if timeout := config.Policy("", "nano_1other").TimeoutDuration; timeout != config.TimeoutDuration {
+		t.Errorf("got timeout %d want the global %d", timeout, config.TimeoutDuration)
+	}
+}
+
+func TestLoadConfigFailsFast(t *testing.T) {
+	if _, err := LoadConfig(writeConfig(t, "rpc_hots: localhost\n")); err == nil {
+		t.Error("expected an unknown key to fail")
+	}
+
+	_, err := LoadConfig(writeConfig(t, "consumers: 0\nevent_mode: kafka\n"))
+	if err == nil || !strings.Contains(err.Error(), "consumers") || !strings.Contains(err.Error(), "event_mode") {
+		t.Errorf("expected both validation errors, got %v", err)
+	}
+
+	os.Setenv("TIMEOUTDURATION", "sixty")
+	defer os.Unsetenv("TIMEOUTDURATION")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("expected a malformed ENV value to fail")
+	}
+}
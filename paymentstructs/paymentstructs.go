@@ -1,21 +1,30 @@
 package structs
 
-import (
-	"fmt"
-	"os"
-	"strconv"
-)
+import "fmt"
 
 //PaymentRequest contains the data for validating a payment
 type PaymentRequest struct {
-	// Optional: the hash of the send transaction to confirm
+	// Hash of the send transaction being confirmed, set only on a checkpointed request
 	ValidationHash string `json:"validation_hash,omitempty"`
 	// The Nano address where the payment is expected
 	DestinationAddress string `json:"destination_address"`
 	// The amount expected at the Destination Address
 	Amount string `json:"amount"`
-	// Worker ID for status reference
+	// Worker ID for status reference, set only on a checkpointed request
 	WorkerID string `json:"worker_id"`
+	// Optional: the merchant whose policy applies, found from the destination address if empty
+	Merchant string `json:"merchant,omitempty"`
+	// Optional: describes the payment in the payment URI, e.g. an order number
+	Message string `json:"message,omitempty"`
+	// Optional: the price in Currency, used instead of Amount.  Amount is then locked at Rate.
+	FiatAmount string `json:"fiat_amount,omitempty"`
+	Currency   string `json:"currency,omitempty"`
+	// Price of one NANO in Currency that Amount was locked at
+	Rate string `json:"rate,omitempty"`
+	// Optional: the difference from Amount accepted as paid, see Tolerance, instead of the merchant's
+	Tolerance string `json:"tolerance,omitempty"`
+	// Optional: correlates the acknowledgement with the request, echoed in the Ack
+	RequestID string `json:"request_id,omitempty"`
 }
 
 //Payment contains data on the payment during confirmation
@@ -38,6 +47,12 @@ type Payment struct {
 	ValidatedAmount string `json:"validated_amount,omitempty"`
 	// Worker ID for status reference
 	WorkerID string `json:"worker_id"`
+	// Fiat price of a fiat request and the rate Expected Amount was locked at
+	FiatAmount string `json:"fiat_amount,omitempty"`
+	Currency   string `json:"currency,omitempty"`
+	Rate       string `json:"rate,omitempty"`
+	// Difference from the expected amount on a success within the tolerance
+	Note string `json:"note,omitempty"`
 }
 
 //Ack is sent to confirm receipt of the payment request
@@ -48,43 +63,49 @@ type Ack struct {
 	ExpectedAmount string `json:"expected_amount"`
 	// Worker ID for status reference
 	WorkerID string
+	// Token opening the payment stream for checkout pages, when stream tokens are configured
+	Token string `json:"token,omitempty"`
+	// nano: URI for wallets to pay the request with, also rendered by the QR code endpoint
+	PaymentURI string `json:"payment_uri,omitempty"`
+	// Fiat price of a fiat request and the rate Expected Amount was locked at
+	FiatAmount string `json:"fiat_amount,omitempty"`
+	Currency   string `json:"currency,omitempty"`
+	Rate       string `json:"rate,omitempty"`
+	// Why the request was refused, no worker was started
+	Error string `json:"error,omitempty"`
+	// Amount of the request when Expected Amount has a unique suffix added
+	RequestedAmount string `json:"requested_amount,omitempty"`
+	// Request ID of the request acknowledged
+	RequestID string `json:"request_id,omitempty"`
 }
 
-//Config retrieves the configuration variables from the config.json file
-type Config struct {
-	RPCHost           string
-	RPCPort           string
-	RedisHost         string
-	RedisPort         string
-	TimeoutDuration   int
-	NanoWebsocketHost string
-	NanoWebsocketPort string
-}
-
-func configEnv(key string, fallback string) string {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return fallback
+//Outcome returns the worker status a payment event leads to, which is the event status except for
+//errors, named by their error code
+func (p Payment) Outcome() string {
+	if p.Status != "error" {
+		return p.Status
 	}
-	return value
+	switch p.ErrorCode {
+	case 0:
+		return "timeout"
+	case 1:
+		return "overpayment"
+	case 2:
+		return "underpayment"
+	case 3:
+		return "cancelled"
+	case 4:
+		return "within_tolerance"
+	}
+	return fmt.Sprintf("error %d", p.ErrorCode)
 }
 
-//LoadConfig returns a configuration structure populated with the ENV values provided.  If no ENV
-//values are present, defaults are used.
-func LoadConfig() Config {
-	var configuration Config
-
-	configuration.RPCHost = configEnv("RPCHOST", "http://[::1]")
-	configuration.RPCPort = configEnv("RPCPORT", "55000")
-	configuration.RedisHost = configEnv("REDISHOST", "localhost")
-	configuration.RedisPort = configEnv("REDISPORT", "22000")
-	var timeoutErr error
-	configuration.TimeoutDuration, timeoutErr = strconv.Atoi(configEnv("TIMEOUTDURATION", "60"))
-	if timeoutErr != nil {
-		fmt.Println("Error converting timeout duration to int:", timeoutErr)
+//Final reports whether a worker status is the last of its payment request.  A requeued request is resumed
+//by another processor.
+func Final(status string) bool {
+	switch status {
+	case "", "pending", "confirming", "requeued":
+		return false
 	}
-	configuration.NanoWebsocketHost = configEnv("NANOWEBSOCKETHOST", "ws://[::1]")
-	configuration.NanoWebsocketPort = configEnv("NANOWEBSOCKETPORT", "57000")
-
-	return configuration
+	return true
 }
@@ -0,0 +1,68 @@
+package structs
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//Tolerance is how far a payment may be from the expected amount and still count as paid in full.  It is
+//written as a raw amount ("1000000raw"), a percentage of the expected amount ("0.1%") or the number of
+//NANO decimal places that count, ignoring any difference below the last of them ("6dp").  The zero
+//Tolerance, written "", demands the exact amount.
+type Tolerance struct {
+	raw     *big.Int
+	percent *big.Rat
+}
+
+//ParseTolerance reads a tolerance written as described by Tolerance
+func ParseTolerance(spec string) (Tolerance, error) {
+	var t Tolerance
+	switch {
+	case spec == "":
+		return t, nil
+	case strings.HasSuffix(spec, "raw"):
+		raw, ok := new(big.Int).SetString(strings.TrimSuffix(spec, "raw"), 10)
+		if !ok || raw.Sign() < 0 {
+			return t, fmt.Errorf("tolerance %q must be a whole number of raw", spec)
+		}
+		t.raw = raw
+	case strings.HasSuffix(spec, "%"):
+		percent, ok := new(big.Rat).SetString(strings.TrimSuffix(spec, "%"))
+		if !ok || percent.Sign() < 0 || percent.Cmp(big.NewRat(100, 1)) > 0 {
+			return t, fmt.Errorf("tolerance %q must be a percentage from 0 to 100", spec)
+		}
+		t.percent = percent
+	case strings.HasSuffix(spec, "dp"):
+		places, err := strconv.Atoi(strings.TrimSuffix(spec, "dp"))
+		if err != nil || places < 0 || places > 30 {
+			return t, fmt.Errorf("tolerance %q must be 0 to 30 decimal places", spec)
+		}
+		// Any difference short of one unit in the last place, e.g. under 10^24 raw for 6dp
+		t.raw = new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(30-places)), nil)
+		t.raw.Sub(t.raw, big.NewInt(1))
+	default:
+		return t, fmt.Errorf("tolerance %q must end in raw, %% or dp", spec)
+	}
+	return t, nil
+}
+
+//PercentTolerance returns the tolerance of basis points, hundredths of a percent, of the expected amount
+func PercentTolerance(bps int) Tolerance {
+	return Tolerance{percent: big.NewRat(int64(bps), 100)}
+}
+
+//Allowance returns the largest difference from the expected amount the tolerance accepts, in raw
+func (t Tolerance) Allowance(expected *big.Int) *big.Int {
+	switch {
+	case t.raw != nil:
+		return new(big.Int).Set(t.raw)
+	case t.percent != nil:
+		allowed := new(big.Rat).Mul(new(big.Rat).SetInt(expected), t.percent)
+		allowed.Quo(allowed, big.NewRat(100, 1))
+		// Rounded down, so a percentage never accepts more than it says
+		return new(big.Int).Quo(allowed.Num(), allowed.Denom())
+	}
+	return new(big.Int)
+}
@@ -0,0 +1,33 @@
+package structs
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestTolerance(t *testing.T) {
+	// 1.5 NANO
+	expected, _ := new(big.Int).SetString("1500000000000000000000000000000", 10)
+	for spec, want := range map[string]string{
+		"":           "0",
+		"1000raw":    "1000",
+		"0.1%":       "1500000000000000000000000000",
+		"6dp":        "999999999999999999999999",
+		"30dp":       "0",
+		"0.0000001%": "1500000000000000000000",
+	} {
+		tolerance, err := ParseTolerance(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+			continue
+		}
+		if got := tolerance.Allowance(expected).String(); got != want {
+			t.Errorf("%q: got %s want %s", spec, got, want)
+		}
+	}
+	for _, spec := range []string{"1000", "-1raw", "101%", "31dp", "1.5raw", "6 dp"} {
+		if _, err := ParseTolerance(spec); err == nil {
+			t.Errorf("got no error parsing %q", spec)
+		}
+	}
+}
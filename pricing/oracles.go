@@ -0,0 +1,128 @@
+package pricing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//Static quotes the prices listed in a file, a YAML or JSON map of currency to price read at startup
+type Static struct {
+	prices map[string]string
+}
+
+//NewStatic reads the prices in the file at path
+func NewStatic(path string) (*Static, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading price file: %v", err)
+	}
+	var prices map[string]string
+	if err := yaml.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("error reading price file %s: %v", path, err)
+	}
+	s := &Static{prices: make(map[string]string, len(prices))}
+	for currency, price := range prices {
+		s.prices[strings.ToUpper(currency)] = price
+	}
+	return s, nil
+}
+
+func (s *Static) Price(currency string) (string, error) {
+	price, ok := s.prices[currency]
+	if !ok {
+		return "", fmt.Errorf("no price for %s in the price file", currency)
+	}
+	return price, nil
+}
+
+//Feed quotes prices from an HTTP JSON feed.  "{currency}" in the URL and path is replaced with the lower
+//case currency, and the path names the price in the response as dot separated keys, e.g. the URL
+//https://api.coingecko.com/api/v3/simple/price?ids=nano&vs_currencies={currency} with the path
+//nano.{currency}.  Prices are cached for the TTL.
+type Feed struct {
+	url    string
+	path   string
+	ttl    time.Duration
+	client *http.Client
+
+	mu     sync.Mutex
+	quotes map[string]quote
+}
+
+//quote is a cached price and when it was fetched
+type quote struct {
+	price   string
+	fetched time.Time
+}
+
+//NewFeed returns the feed at the URL, caching prices for ttl
+func NewFeed(url string, path string, ttl time.Duration) *Feed {
+	return &Feed{url: url, path: path, ttl: ttl, client: &http.Client{Timeout: 5 * time.Second}, quotes: make(map[string]quote)}
+}
+
+func (f *Feed) Price(currency string) (string, error) {
+	f.mu.Lock()
+	cached, ok := f.quotes[currency]
+	f.mu.Unlock()
+	if ok && time.Since(cached.fetched) < f.ttl {
+		return cached.price, nil
+	}
+
+	price, err := f.fetch(currency)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	f.quotes[currency] = quote{price: price, fetched: time.Now()}
+	f.mu.Unlock()
+	return price, nil
+}
+
+func (f *Feed) fetch(currency string) (string, error) {
+	lower := strings.ToLower(currency)
+	response, err := f.client.Get(strings.ReplaceAll(f.url, "{currency}", url.QueryEscape(lower)))
+	if err != nil {
+		return "", fmt.Errorf("error requesting the price feed: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("price feed returned %s", response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("error reading the price feed: %v", err)
+	}
+
+	// Numbers are kept as written so no precision is lost
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var value interface{}
+	if err := d.Decode(&value); err != nil {
+		return "", fmt.Errorf("error decoding the price feed: %v", err)
+	}
+	for _, key := range strings.Split(strings.ReplaceAll(f.path, "{currency}", lower), ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("price feed has no %s", f.path)
+		}
+		value = object[key]
+	}
+
+	switch price := value.(type) {
+	case json.Number:
+		return price.String(), nil
+	case string:
+		return price, nil
+	}
+	return "", fmt.Errorf("price feed has no %s price at %s", currency, f.path)
+}
@@ -0,0 +1,80 @@
+//Package pricing converts fiat payment requests to raw.  An Oracle quotes the price of one NANO in a fiat
+//currency and Lock fixes the raw amount at that price when the request is created, so the amount a
+//customer is asked for doesn't move while they pay.
+package pricing
+
+import (
+	"fmt"
+	"math/big"
+	structs "nano-pp/paymentstructs"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//rawPerNano is the number of raw in one NANO
+var rawPerNano = new(big.Int).Exp(big.NewInt(10), big.NewInt(30), nil)
+
+//currencyCode matches a three letter ISO 4217 currency code in either case
+var currencyCode = regexp.MustCompile(`^[A-Za-z]{3}$`)
+
+//Oracle quotes the price of one NANO in a fiat currency, as a decimal string such as "1.2345"
+type Oracle interface {
+	Price(currency string) (string, error)
+}
+
+//New returns the oracle configured by price_oracle, or nil if fiat requests are disabled
+func New(config structs.Config) (Oracle, error) {
+	switch config.PriceOracle {
+	case "":
+		return nil, nil
+	case "static":
+		return NewStatic(config.PriceFile)
+	case "http":
+		return NewFeed(config.PriceURL, config.PricePath, time.Duration(config.PriceCacheSeconds)*time.Second), nil
+	}
+	return nil, fmt.Errorf("unknown price_oracle %q", config.PriceOracle)
+}
+
+//Lock returns the raw amount of fiatAmount in the currency at the oracle's current price, rounded to the
+//nearest raw, and the price it used.
+func Lock(oracle Oracle, fiatAmount string, currency string) (string, string, error) {
+	if oracle == nil {
+		return "", "", fmt.Errorf("fiat payment requests need a price_oracle")
+	}
+	if !currencyCode.MatchString(currency) {
+		return "", "", fmt.Errorf("currency must be a three letter ISO 4217 code, got %q", currency)
+	}
+	fiat, ok := new(big.Rat).SetString(fiatAmount)
+	if !ok || fiat.Sign() <= 0 {
+		return "", "", fmt.Errorf("fiat_amount must be a positive decimal, got %q", fiatAmount)
+	}
+
+	rate, err := oracle.Price(strings.ToUpper(currency))
+	if err != nil {
+		return "", "", fmt.Errorf("error pricing %s: %v", currency, err)
+	}
+	price, ok := new(big.Rat).SetString(rate)
+	if !ok || price.Sign() <= 0 {
+		return "", "", fmt.Errorf("price oracle returned an invalid %s price %q", currency, rate)
+	}
+
+	// raw = fiat / price * 10^30, rounded half up
+	raw := new(big.Rat).Quo(fiat, price)
+	raw.Mul(raw, new(big.Rat).SetInt(rawPerNano))
+	rounded := new(big.Int).Quo(new(big.Int).Add(new(big.Int).Mul(raw.Num(), big.NewInt(2)), raw.Denom()), new(big.Int).Mul(raw.Denom(), big.NewInt(2)))
+	return rounded.String(), rate, nil
+}
+
+//Mock is an in-process oracle with prices set by the caller, for tests and load tests
+type Mock struct {
+	Prices map[string]string
+}
+
+func (m Mock) Price(currency string) (string, error) {
+	price, ok := m.Prices[currency]
+	if !ok {
+		return "", fmt.Errorf("no price for %s", currency)
+	}
+	return price, nil
+}
@@ -0,0 +1,81 @@
+package pricing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	oracle := Mock{Prices: map[string]string{"USD": "1.5", "EUR": "3"}}
+	for _, tc := range []struct {
+		fiat     string
+		currency string
+		raw      string
+	}{
+		{"3", "usd", "2000000000000000000000000000000"},
+		// 1/3 NANO rounds down and 2/3 NANO rounds up to the nearest raw
+		{"1", "EUR", "333333333333333333333333333333"},
+		{"2", "EUR", "666666666666666666666666666667"},
+	} {
+		raw, rate, err := Lock(oracle, tc.fiat, tc.currency)
+		if err != nil || raw != tc.raw || rate != oracle.Prices[strings.ToUpper(tc.currency)] {
+			t.Errorf("%s %s: got %s at %s, %v want %s", tc.fiat, tc.currency, raw, rate, err, tc.raw)
+		}
+	}
+	for _, fiat := range []string{"", "-1", "0", "ten"} {
+		if _, _, err := Lock(oracle, fiat, "USD"); err == nil {
+			t.Errorf("got no error locking %q", fiat)
+		}
+	}
+	for _, currency := range []string{"", "US", "EURO", "usd&vs=eur", "U$D"} {
+		if _, _, err := Lock(oracle, "1", currency); err == nil {
+			t.Errorf("got no error locking in %q", currency)
+		}
+	}
+	if _, _, err := Lock(oracle, "1", "GBP"); err == nil {
+		t.Error("got no error for a currency without a price")
+	}
+	if _, _, err := Lock(nil, "1", "USD"); err == nil {
+		t.Error("got no error without an oracle")
+	}
+}
+
+func TestStatic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.yaml")
+	os.WriteFile(path, []byte("usd: \"1.25\"\nEUR: \"1.10\"\n"), 0o600)
+	oracle, err := NewStatic(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price, err := oracle.Price("USD"); err != nil || price != "1.25" {
+		t.Errorf("got %s, %v want 1.25", price, err)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"nano": {"` + r.URL.Query().Get("vs") + `": 1.23456789012345678901}}`))
+	}))
+	defer server.Close()
+
+	feed := NewFeed(server.URL+"?vs={currency}", "nano.{currency}", time.Minute)
+	for i := 0; i < 2; i++ {
+		// The price keeps every digit of the response
+		if price, err := feed.Price("USD"); err != nil || price != "1.23456789012345678901" {
+			t.Errorf("got %s, %v", price, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests want 1 cached", requests)
+	}
+	if _, err := NewFeed(server.URL, "nano.btc", time.Minute).Price("USD"); err == nil {
+		t.Error("got no error for a missing path")
+	}
+}
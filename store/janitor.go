@@ -0,0 +1,103 @@
+package store
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//JanitorReport lists the orphaned keys found by a sweep
+type JanitorReport struct {
+	// Keys written by the store that have no expiry, by key class
+	Orphaned map[string][]string
+	// Number of orphaned keys deleted
+	Removed int
+}
+
+//Janitor finds keys of the store's classes under its prefix that will never expire.  These are left
+//behind by workers that died before expiry was applied, or by older versions of the processor.
+type Janitor struct {
+	pool   *redis.Pool
+	prefix string
+	// When true orphaned keys are reported but not deleted
+	DryRun bool
+	// Logger for the reports of Run
+	Logger *slog.Logger
+}
+
+//NewJanitor returns a janitor for the keys under the prefix, logging to the default logger.
+func NewJanitor(pool *redis.Pool, prefix string) *Janitor {
+	return &Janitor{pool: pool, prefix: prefix, Logger: slog.Default()}
+}
+
+//Sweep scans every key class for keys without an expiry and deletes them unless DryRun is set.
+func (j *Janitor) Sweep() (JanitorReport, error) {
+	report := JanitorReport{Orphaned: make(map[string][]string)}
+
+	c := j.pool.Get()
+	defer c.Close()
+
+	for _, class := range keyClasses {
+		cursor := 0
+		for {
+			values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", j.prefix+class, "COUNT", 1000))
+			if err != nil {
+				return report, err
+			}
+			cursor, _ = redis.Int(values[0], nil)
+			keys, _ := redis.Strings(values[1], nil)
+
+			for _, key := range keys {
+				ttl, err := redis.Int(c.Do("TTL", key))
+				if err != nil {
+					return report, err
+				}
+				// -1 is a key without an expiry, -2 a key removed since the scan
+				if ttl != -1 {
+					continue
+				}
+				report.Orphaned[class] = append(report.Orphaned[class], key)
+				if j.DryRun {
+					continue
+				}
+				if _, err := c.Do("DEL", key); err != nil {
+					return report, err
+				}
+				report.Removed++
+			}
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+
+	return report, nil
+}
+
+//Run sweeps on the provided interval until stop is closed, logging each report with orphans.
+func (j *Janitor) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		report, err := j.Sweep()
+		if err != nil {
+			j.Logger.Error("error sweeping orphaned keys", "error", err)
+			continue
+		}
+		for class, keys := range report.Orphaned {
+			j.Logger.Warn("janitor found orphaned keys", "class", class, "count", len(keys), "dry_run", j.DryRun)
+		}
+		if report.Removed > 0 {
+			j.Logger.Info("janitor removed orphaned keys", "count", report.Removed)
+		}
+	}
+}
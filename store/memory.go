@@ -0,0 +1,463 @@
+package store
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/adjust/rmq"
+)
+
+//memorySubscriptionBuffer is the amount of messages held for a memory subscriber
+const memorySubscriptionBuffer = 64
+
+//memoryStore keeps the processor state in process so it can run without a redis server
+type memoryStore struct {
+	mu         sync.Mutex
+	known      map[string]map[string]bool
+	statuses   map[string]string
+	confirming map[string]bool
+	amounts    map[string]string
+	// Watching workers by address, oldest first, when they started watching and the amounts of those
+	// still eligible for a send
+	watchers map[string][]string
+	watched  map[string]map[string]time.Time
+	eligible map[string]map[string]string
+	// Owners of the sends to an address by hash, kept while the address has watchers
+	attributed  map[string]map[string]string
+	subscribers map[string]map[*memorySubscription]bool
+	queues      map[string]*memoryQueue
+	ttl         TTLPolicy
+}
+
+//NewMemory returns an empty in-memory store that keeps watchers until they unwatch.
+func NewMemory() Store {
+	return NewMemoryWithTTL(TTLPolicy{})
+}
+
+//NewMemoryWithTTL returns an empty in-memory store dropping watchers older than the policy's working
+//expiry, as the redis store does.
+func NewMemoryWithTTL(ttl TTLPolicy) Store {
+	return &memoryStore{
+		known:       make(map[string]map[string]bool),
+		statuses:    make(map[string]string),
+		confirming:  make(map[string]bool),
+		amounts:     make(map[string]string),
+		watchers:    make(map[string][]string),
+		watched:     make(map[string]map[string]time.Time),
+		eligible:    make(map[string]map[string]string),
+		attributed:  make(map[string]map[string]string),
+		subscribers: make(map[string]map[*memorySubscription]bool),
+		queues:      make(map[string]*memoryQueue),
+		ttl:         ttl,
+	}
+}
+
+func (s *memoryStore) ResetKnownHashes(address string, workerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.known, knownPendingKey(address, workerID))
+	return nil
+}
+
+func (s *memoryStore) AddKnownHashes(address string, workerID string, hashes ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := knownPendingKey(address, workerID)
+	if _, ok := s.known[key]; !ok {
+		s.known[key] = make(map[string]bool)
+	}
+	for _, hash := range hashes {
+		s.known[key][hash] = true
+	}
+	return nil
+}
+
+func (s *memoryStore) KnownHashes(address string, workerID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := knownPendingKey(address, workerID)
+	hashes := make([]string, 0, len(s.known[key]))
+	for hash := range s.known[key] {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func (s *memoryStore) SetStatus(workerID string, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[workerID] = status
+	return nil
+}
+
+func (s *memoryStore) Status(workerID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statuses[workerID], nil
+}
+
+func (s *memoryStore) Statuses() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[string]string, len(s.statuses))
+	for workerID, status := range s.statuses {
+		statuses[workerID] = status
+	}
+	return statuses, nil
+}
+
+func (s *memoryStore) MarkConfirming(address string, workerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.confirming[confirmingKey(address, workerID)] = true
+	return nil
+}
+
+func (s *memoryStore) IsConfirming(address string, workerID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.confirming[confirmingKey(address, workerID)], nil
+}
+
+func (s *memoryStore) ClearConfirming(address string, workerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.confirming, confirmingKey(address, workerID))
+	return nil
+}
+
+//Watch orders the worker by when it first watched the address.  Watchers older than the working TTL are
+//dropped, so a worker that died without unwatching is not attributed sends forever.
+func (s *memoryStore) Watch(address string, workerID string, amount string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.eligible[address]; !ok {
+		s.eligible[address] = make(map[string]string)
+		s.watched[address] = make(map[string]time.Time)
+	}
+	s.eligible[address][workerID] = amount
+	if _, ok := s.watched[address][workerID]; !ok {
+		s.watched[address][workerID] = time.Now()
+		s.watchers[address] = append(s.watchers[address], workerID)
+	}
+
+	if ttl := s.ttl.working(); ttl > 0 {
+		stale := time.Now().Add(-ttl)
+		for _, watcher := range s.watchers[address] {
+			if s.watched[address][watcher].Before(stale) {
+				s.unwatch(address, watcher)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Unwatch(address string, workerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unwatch(address, workerID)
+	return nil
+}
+
+//unwatch removes the watcher, and the address's attributions with its last watcher
+func (s *memoryStore) unwatch(address string, workerID string) {
+	delete(s.eligible[address], workerID)
+	delete(s.watched[address], workerID)
+	var watchers []string
+	for _, watcher := range s.watchers[address] {
+		if watcher != workerID {
+			watchers = append(watchers, watcher)
+		}
+	}
+	if len(watchers) == 0 {
+		delete(s.watchers, address)
+		delete(s.watched, address)
+		delete(s.eligible, address)
+		delete(s.attributed, address)
+		return
+	}
+	s.watchers[address] = watchers
+}
+
+func (s *memoryStore) Watchers(address string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.watchers[address]...), nil
+}
+
+func (s *memoryStore) AttributeSend(address string, hash string, amount string, policy string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.attributed[address][hash]; ok {
+		return owner, nil
+	}
+
+	var first, chosen string
+	for _, watcher := range s.watchers[address] {
+		expected, ok := s.eligible[address][watcher]
+		if !ok || s.known[knownPendingKey(address, watcher)][hash] {
+			continue
+		}
+		if first == "" {
+			first = watcher
+		}
+		if policy != "amount" || expected == amount {
+			chosen = watcher
+			break
+		}
+	}
+	if chosen == "" {
+		chosen = first
+	}
+	if chosen == "" {
+		return "", nil
+	}
+	if _, ok := s.attributed[address]; !ok {
+		s.attributed[address] = make(map[string]string)
+	}
+	s.attributed[address][hash] = chosen
+	delete(s.eligible[address], chosen)
+	return chosen, nil
+}
+
+func (s *memoryStore) ReserveAmount(address string, amount string, workerID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := amountKey(address, amount)
+	if _, ok := s.amounts[key]; ok {
+		return false, nil
+	}
+	s.amounts[key] = workerID
+	return true, nil
+}
+
+func (s *memoryStore) AmountOwner(address string, amount string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.amounts[amountKey(address, amount)], nil
+}
+
+func (s *memoryStore) ReleaseAmount(address string, amount string, workerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key := amountKey(address, amount); s.amounts[key] == workerID {
+		delete(s.amounts, key)
+	}
+	return nil
+}
+
+func (s *memoryStore) Publish(channel string, payload string) error {
+	s.mu.Lock()
+	subs := make([]*memorySubscription, 0, len(s.subscribers[channel]))
+	for sub := range s.subscribers[channel] {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.messages <- Message{Channel: channel, Payload: payload}:
+		case <-sub.done:
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Subscribe(channels ...string) (Subscription, error) {
+	sub := &memorySubscription{
+		store:    s,
+		channels: channels,
+		messages: make(chan Message, memorySubscriptionBuffer),
+		done:     make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range channels {
+		if _, ok := s.subscribers[channel]; !ok {
+			s.subscribers[channel] = make(map[*memorySubscription]bool)
+		}
+		s.subscribers[channel][sub] = true
+	}
+	return sub, nil
+}
+
+//Append delivers the event to the current followers of the stream.  Events are not retained.
+func (s *memoryStore) Append(stream string, payload string) error {
+	return s.Publish(stream, payload)
+}
+
+func (s *memoryStore) Follow(stream string, logger *slog.Logger) (Subscription, error) {
+	return s.Subscribe(stream)
+}
+
+func (s *memoryStore) OpenQueue(name string) Queue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.queues[name]; !ok {
+		s.queues[name] = &memoryQueue{ready: make(chan string, 1024), stop: make(chan struct{})}
+	}
+	return s.queues[name]
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+//memorySubscription receives messages published to a memory store
+type memorySubscription struct {
+	store    *memoryStore
+	channels []string
+	messages chan Message
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (sub *memorySubscription) Messages() <-chan Message {
+	return sub.messages
+}
+
+//Close stops delivery to the subscription.  The messages channel is left open, as a concurrent publish
+//may still hold it.
+func (sub *memorySubscription) Close() error {
+	sub.once.Do(func() {
+		s := sub.store
+		s.mu.Lock()
+		for _, channel := range sub.channels {
+			delete(s.subscribers[channel], sub)
+			if len(s.subscribers[channel]) == 0 {
+				delete(s.subscribers, channel)
+			}
+		}
+		s.mu.Unlock()
+		close(sub.done)
+	})
+	return nil
+}
+
+//memoryQueue is a work queue held in a buffered channel
+type memoryQueue struct {
+	ready     chan string
+	stop      chan struct{}
+	consumers sync.WaitGroup
+	mu        sync.Mutex
+	rejected  []string
+	unacked   int
+	started   bool
+	stopped   bool
+}
+
+func (q *memoryQueue) Publish(payload string) error {
+	q.ready <- payload
+	return nil
+}
+
+func (q *memoryQueue) StartConsuming(prefetchLimit int, pollDuration time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started {
+		return false
+	}
+	q.started = true
+	return true
+}
+
+//AddConsumer starts a goroutine handing each ready payload to the consumer.
+func (q *memoryQueue) AddConsumer(tag string, consumer rmq.Consumer) string {
+	q.consumers.Add(1)
+	go func() {
+		defer q.consumers.Done()
+		for {
+			select {
+			case <-q.stop:
+				return
+			case payload := <-q.ready:
+				q.mu.Lock()
+				q.unacked++
+				q.mu.Unlock()
+				consumer.Consume(&memoryDelivery{payload: payload, queue: q})
+			}
+		}
+	}()
+	return tag
+}
+
+func (q *memoryQueue) StopConsuming() <-chan struct{} {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		q.consumers.Wait()
+		close(finished)
+	}()
+	return finished
+}
+
+func (q *memoryQueue) ReturnRejected() (int, error) {
+	q.mu.Lock()
+	rejected := q.rejected
+	q.rejected = nil
+	q.mu.Unlock()
+
+	for _, payload := range rejected {
+		q.ready <- payload
+	}
+	return len(rejected), nil
+}
+
+func (q *memoryQueue) Depth() QueueDepth {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueDepth{Ready: len(q.ready), Unacked: q.unacked, Rejected: len(q.rejected)}
+}
+
+//memoryDelivery is a payload handed to a consumer of a memory queue
+type memoryDelivery struct {
+	payload string
+	queue   *memoryQueue
+	handled bool
+}
+
+func (d *memoryDelivery) Payload() string {
+	return d.payload
+}
+
+//settle marks the delivery as no longer unacked, returning false if it already was
+func (d *memoryDelivery) settle() bool {
+	if d.handled {
+		return false
+	}
+	d.handled = true
+	d.queue.unacked--
+	return true
+}
+
+func (d *memoryDelivery) Ack() bool {
+	d.queue.mu.Lock()
+	defer d.queue.mu.Unlock()
+	return d.settle()
+}
+
+func (d *memoryDelivery) Reject() bool {
+	d.queue.mu.Lock()
+	defer d.queue.mu.Unlock()
+	if !d.settle() {
+		return false
+	}
+	d.queue.rejected = append(d.queue.rejected, d.payload)
+	return true
+}
+
+func (d *memoryDelivery) Push() bool {
+	return d.Reject()
+}
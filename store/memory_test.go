@@ -0,0 +1,170 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adjust/rmq"
+)
+
+func TestMemoryKnownHashes(t *testing.T) {
+	st := NewMemory()
+
+	st.AddKnownHashes("nano_1abc", "worker", "A", "B")
+	st.AddKnownHashes("nano_1abc", "worker", "B", "C")
+	st.AddKnownHashes("nano_1abc", "other", "D")
+
+	hashes, _ := st.KnownHashes("nano_1abc", "worker")
+	if len(hashes) != 3 {
+		t.Errorf("got %d known hashes want 3", len(hashes))
+	}
+
+	// Another request to the address keeps its hashes
+	st.ResetKnownHashes("nano_1abc", "worker")
+	hashes, _ = st.KnownHashes("nano_1abc", "worker")
+	if len(hashes) != 0 {
+		t.Errorf("got %d known hashes after reset want 0", len(hashes))
+	}
+	if hashes, _ = st.KnownHashes("nano_1abc", "other"); len(hashes) != 1 {
+		t.Errorf("got %d known hashes for the other request want 1", len(hashes))
+	}
+}
+
+func TestMemoryStatusAndConfirming(t *testing.T) {
+	st := NewMemory()
+
+	if status, _ := st.Status("worker"); status != "" {
+		t.Errorf("got status '%s' want ''", status)
+	}
+	st.SetStatus("worker", "pending")
+	st.SetStatus("worker", "success")
+	if status, _ := st.Status("worker"); status != "success" {
+		t.Errorf("got status '%s' want 'success'", status)
+	}
+
+	st.MarkConfirming("nano_1abc", "worker")
+	if confirming, _ := st.IsConfirming("nano_1abc", "worker"); !confirming {
+		t.Error("expected the request to be confirming")
+	}
+	if confirming, _ := st.IsConfirming("nano_1abc", "other"); confirming {
+		t.Error("expected another request to the address not to be confirming")
+	}
+	st.ClearConfirming("nano_1abc", "worker")
+	if confirming, _ := st.IsConfirming("nano_1abc", "worker"); confirming {
+		t.Error("expected the confirming flag to be cleared")
+	}
+}
+
+func TestMemoryPublishSubscribe(t *testing.T) {
+	st := NewMemory()
+
+	sub, _ := st.Subscribe(CancelChannel("worker"))
+	st.Publish(CancelChannel("other"), "ignored")
+	st.Publish(CancelChannel("worker"), "true")
+
+	select {
+	case message := <-sub.Messages():
+		if message.Channel != CancelChannel("worker") || message.Payload != "true" {
+			t.Errorf("got message %v", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	sub.Close()
+	// Publishing after close must not block
+	st.Publish(CancelChannel("worker"), "true")
+}
+
+type testConsumer chan string
+
+func (c testConsumer) Consume(delivery rmq.Delivery) {
+	delivery.Ack()
+	c <- delivery.Payload()
+}
+
+func TestMemoryQueue(t *testing.T) {
+	st := NewMemory()
+	queue := st.OpenQueue(PaymentRequestQueue)
+
+	consumed := make(testConsumer, 1)
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("test", consumed)
+	queue.Publish(`{"amount":"1"}`)
+
+	select {
+	case payload := <-consumed:
+		if payload != `{"amount":"1"}` {
+			t.Errorf("got payload '%s'", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+
+	if depth := queue.Depth(); depth.Ready != 0 || depth.Unacked != 0 {
+		t.Errorf("got depth %+v after the delivery was acked", depth)
+	}
+}
+
+//rejectOnce rejects the first delivery and acks the rest, sending each payload it acks
+type rejectOnce struct {
+	rejected bool
+	acked    chan string
+}
+
+func (c *rejectOnce) Consume(delivery rmq.Delivery) {
+	if !c.rejected {
+		c.rejected = true
+		delivery.Reject()
+		return
+	}
+	delivery.Ack()
+	c.acked <- delivery.Payload()
+}
+
+func TestMemoryQueueReturnRejected(t *testing.T) {
+	st := NewMemory()
+	queue := st.OpenQueue(PaymentRequestQueue)
+
+	consumer := &rejectOnce{acked: make(chan string, 1)}
+	queue.StartConsuming(10, time.Millisecond)
+	queue.AddConsumer("test", consumer)
+	queue.Publish(`{"amount":"1"}`)
+
+	deadline := time.Now().Add(time.Second)
+	for queue.Depth().Rejected != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the rejection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if returned, _ := queue.ReturnRejected(); returned != 1 {
+		t.Errorf("got %d returned want 1", returned)
+	}
+	select {
+	case payload := <-consumer.acked:
+		if payload != `{"amount":"1"}` {
+			t.Errorf("got payload '%s'", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the returned delivery")
+	}
+}
+
+func TestMemoryUnwatchClearsAttributions(t *testing.T) {
+	st := NewMemory().(*memoryStore)
+	st.Watch("nano_1abc", "w1", "1000")
+	st.Watch("nano_1abc", "w2", "1000")
+	st.AttributeSend("nano_1abc", "A", "1000", "fifo")
+
+	// The attribution is kept while another watcher may ask about the send
+	st.Unwatch("nano_1abc", "w1")
+	if owner, _ := st.AttributeSend("nano_1abc", "A", "1000", "fifo"); owner != "w1" {
+		t.Errorf("got owner '%s' want 'w1'", owner)
+	}
+	st.Unwatch("nano_1abc", "w2")
+	if len(st.attributed) != 0 || len(st.watched) != 0 || len(st.eligible) != 0 {
+		t.Errorf("got attributions %v, watched %v and eligible %v left", st.attributed, st.watched, st.eligible)
+	}
+}
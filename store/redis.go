@@ -0,0 +1,484 @@
+package store
+
+import (
+	"fmt"
+	"log/slog"
+	"nano-pp/eventlog"
+	"nano-pp/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adjust/rmq"
+	"github.com/gomodule/redigo/redis"
+)
+
+//RedisOptions controls the naming and expiry of the keys written by a redis store
+type RedisOptions struct {
+	// Prefix applied to every key, channel, stream and queue name so environments can share a server
+	Prefix string
+	// Expiry applied to each class of key
+	TTL TTLPolicy
+}
+
+//redisStore keeps the processor state in redis and uses rmq for the work queues
+type redisStore struct {
+	pool      *redis.Pool
+	queues    rmq.Connection
+	publisher eventlog.Publisher
+	prefix    string
+	ttl       TTLPolicy
+}
+
+//NewRedis returns a store backed by the redis pool.  Events are appended according to the publisher's
+//mode and work queues are opened on the rmq connection.
+func NewRedis(pool *redis.Pool, queues rmq.Connection, publisher eventlog.Publisher, options RedisOptions) Store {
+	return &redisStore{pool: pool, queues: queues, publisher: publisher, prefix: options.Prefix, ttl: options.TTL}
+}
+
+//key applies the namespace prefix to a key, channel, stream or queue name
+func (s *redisStore) key(name string) string {
+	return s.prefix + name
+}
+
+func (s *redisStore) do(command string, args ...interface{}) (interface{}, error) {
+	c := s.pool.Get()
+	defer c.Close()
+	return c.Do(command, args...)
+}
+
+//seconds converts a TTL to whole seconds, rounding up so short TTLs do not become 0
+func seconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+func (s *redisStore) ResetKnownHashes(address string, workerID string) error {
+	_, err := s.do("DEL", s.key(knownPendingKey(address, workerID)))
+	return err
+}
+
+func (s *redisStore) AddKnownHashes(address string, workerID string, hashes ...string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	key := s.key(knownPendingKey(address, workerID))
+
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := addKnownScript.Do(c, redis.Args{key, seconds(s.ttl.working())}.AddFlat(hashes)...)
+	return err
+}
+
+//addKnownScript adds hashes to a set and sets its expiry in one step, so the janitor never finds the set
+//without one
+var addKnownScript = redis.NewScript(1, `
+redis.call("SADD", KEYS[1], unpack(ARGV, 2))
+if tonumber(ARGV[1]) > 0 then
+  redis.call("EXPIRE", KEYS[1], ARGV[1])
+end
+return redis.status_reply("OK")`)
+
+func (s *redisStore) KnownHashes(address string, workerID string) ([]string, error) {
+	return redis.Strings(s.do("SMEMBERS", s.key(knownPendingKey(address, workerID))))
+}
+
+//set writes a string key, expiring it after the TTL when one is set
+func (s *redisStore) set(key string, value string, ttl time.Duration) error {
+	var err error
+	if ttl > 0 {
+		_, err = s.do("SET", key, value, "EX", seconds(ttl))
+	} else {
+		_, err = s.do("SET", key, value)
+	}
+	return err
+}
+
+func (s *redisStore) SetStatus(workerID string, status string) error {
+	return s.set(s.key(statusKey(workerID)), status, s.ttl.result())
+}
+
+func (s *redisStore) Status(workerID string) (string, error) {
+	status, err := redis.String(s.do("GET", s.key(statusKey(workerID))))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return status, err
+}
+
+//Statuses scans the status keys under the prefix.  With redis_cluster only the node the pool connects to
+//is scanned.
+func (s *redisStore) Statuses() (map[string]string, error) {
+	c := s.pool.Get()
+	defer c.Close()
+
+	prefix := s.key(statusKey(""))
+	statuses := make(map[string]string)
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+
+		for _, key := range keys {
+			status, err := redis.String(c.Do("GET", key))
+			if err == redis.ErrNil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			statuses[strings.TrimPrefix(key, prefix)] = status
+		}
+
+		if cursor == 0 {
+			return statuses, nil
+		}
+	}
+}
+
+func (s *redisStore) MarkConfirming(address string, workerID string) error {
+	return s.set(s.key(confirmingKey(address, workerID)), "confirming", s.ttl.working())
+}
+
+func (s *redisStore) IsConfirming(address string, workerID string) (bool, error) {
+	confirming, err := redis.String(s.do("GET", s.key(confirmingKey(address, workerID))))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return confirming == "confirming", err
+}
+
+func (s *redisStore) ClearConfirming(address string, workerID string) error {
+	_, err := s.do("DEL", s.key(confirmingKey(address, workerID)))
+	return err
+}
+
+//Watch scores the worker by when it first watched the address.  Watchers older than the working TTL are
+//dropped, so a worker that died without unwatching is not attributed sends forever.
+func (s *redisStore) Watch(address string, workerID string, amount string) error {
+	watchers, eligible := s.key(watchersKey(address)), s.key(eligibleKey(address))
+	now := time.Now().UnixMicro()
+
+	ttl := s.ttl.working()
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := watchScript.Do(c, watchers, eligible, workerID, amount, now, now-ttl.Microseconds(), seconds(ttl))
+	return err
+}
+
+//watchScript adds a watcher of an address with the amount it expects, dropping watchers older than the
+//TTL with their amounts and setting the expiry of both keys in one step
+var watchScript = redis.NewScript(2, `
+redis.call("ZADD", KEYS[1], "NX", ARGV[3], ARGV[1])
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+if tonumber(ARGV[5]) > 0 then
+  local stale = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[4])
+  if #stale > 0 then
+    redis.call("HDEL", KEYS[2], unpack(stale))
+    redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[4])
+  end
+  redis.call("EXPIRE", KEYS[1], ARGV[5])
+  redis.call("EXPIRE", KEYS[2], ARGV[5])
+end
+return redis.status_reply("OK")`)
+
+func (s *redisStore) Unwatch(address string, workerID string) error {
+	c := s.pool.Get()
+	defer c.Close()
+	if _, err := c.Do("ZREM", s.key(watchersKey(address)), workerID); err != nil {
+		return err
+	}
+	_, err := c.Do("HDEL", s.key(eligibleKey(address)), workerID)
+	return err
+}
+
+func (s *redisStore) Watchers(address string) ([]string, error) {
+	return redis.Strings(s.do("ZRANGE", s.key(watchersKey(address)), 0, -1))
+}
+
+//attributeScript picks the worker a send is attributed to and records it in one step, so workers racing
+//for the send all get the same answer.  The watchers are passed oldest first after the arguments, each
+//with its known hashes key after the first two keys.  A watcher that has stopped since is no longer
+//eligible and one that started since is not passed, as the send came before it.
+var attributeScript = redis.NewScript(-1, `
+local owner = redis.call("GET", KEYS[1])
+if owner then return owner end
+local first, chosen = false, false
+for i = 5, #ARGV do
+  local worker = ARGV[i]
+  local expected = redis.call("HGET", KEYS[2], worker)
+  if expected and redis.call("SISMEMBER", KEYS[i - 2], ARGV[1]) == 0 then
+    first = first or worker
+    if ARGV[3] ~= "amount" or expected == ARGV[2] then
+      chosen = worker
+      break
+    end
+  end
+end
+chosen = chosen or first
+if not chosen then return "" end
+if tonumber(ARGV[4]) > 0 then
+  redis.call("SET", KEYS[1], chosen, "EX", ARGV[4])
+else
+  redis.call("SET", KEYS[1], chosen)
+end
+redis.call("HDEL", KEYS[2], chosen)
+return chosen`)
+
+func (s *redisStore) AttributeSend(address string, hash string, amount string, policy string) (string, error) {
+	c := s.pool.Get()
+	defer c.Close()
+	watchers, err := redis.Strings(c.Do("ZRANGE", s.key(watchersKey(address)), 0, -1))
+	if err != nil {
+		return "", err
+	}
+
+	keys := redis.Args{s.key(attributedKey(address, hash)), s.key(eligibleKey(address))}
+	for _, workerID := range watchers {
+		keys = keys.Add(s.key(knownPendingKey(address, workerID)))
+	}
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(hash, amount, policy, seconds(s.ttl.working())).AddFlat(watchers)
+	return redis.String(attributeScript.Do(c, args...))
+}
+
+//reserveTTL is the expiry of a reserved amount, which must outlive the request even without a TTL policy
+func (s *redisStore) reserveTTL() time.Duration {
+	if ttl := s.ttl.working(); ttl > 0 {
+		return ttl
+	}
+	return 24 * time.Hour
+}
+
+func (s *redisStore) ReserveAmount(address string, amount string, workerID string) (bool, error) {
+	_, err := redis.String(s.do("SET", s.key(amountKey(address, amount)), workerID, "NX", "EX", seconds(s.reserveTTL())))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *redisStore) AmountOwner(address string, amount string) (string, error) {
+	owner, err := redis.String(s.do("GET", s.key(amountKey(address, amount))))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return owner, err
+}
+
+//releaseScript deletes a key only while it holds the expected value
+var releaseScript = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+func (s *redisStore) ReleaseAmount(address string, amount string, workerID string) error {
+	c := s.pool.Get()
+	defer c.Close()
+	_, err := releaseScript.Do(c, s.key(amountKey(address, amount)), workerID)
+	return err
+}
+
+func (s *redisStore) Publish(channel string, payload string) error {
+	_, err := s.do("PUBLISH", s.key(channel), payload)
+	if err != nil {
+		metrics.PublishFailures.WithLabelValues("publish").Inc()
+	}
+	return err
+}
+
+//Subscribe subscribes to the prefixed channels.  Messages carry the channel name without the prefix.
+func (s *redisStore) Subscribe(channels ...string) (Subscription, error) {
+	prefixed := make([]string, len(channels))
+	for i, channel := range channels {
+		prefixed[i] = s.key(channel)
+	}
+
+	c := s.pool.Get()
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(redis.Args{}.AddFlat(prefixed)...); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Closing only sends the unsubscribe.  The connection is read and returned to the pool by the
+	// receiving goroutine alone, once the unsubscribe is confirmed or the connection fails.
+	unsubscribed := make(chan struct{})
+	sub := newRedisSubscription(func() {
+		psc.Unsubscribe()
+		close(unsubscribed)
+	})
+	go func() {
+		defer func() {
+			// Wait for the unsubscribe to be written before the connection is reused
+			<-unsubscribed
+			c.Close()
+		}()
+		defer close(sub.messages)
+		for {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				// Messages arriving after the subscription is closed are dropped
+				channel := strings.TrimPrefix(v.Channel, s.prefix)
+				sub.send(Message{Channel: channel, Payload: string(v.Data)})
+			case redis.Subscription:
+				if v.Kind == "unsubscribe" && v.Count == 0 {
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+//Append adds the event to the prefixed stream.  Payment streams expire the result retention after their
+//last event, while the confirmation stream is only trimmed to its maximum length.
+func (s *redisStore) Append(stream string, payload string) error {
+	c := s.pool.Get()
+	defer c.Close()
+	// The confirmation stream is shared by every request and kept at its length limit instead
+	ttl := s.ttl.result()
+	if stream == ConfirmationStream {
+		ttl = 0
+	}
+	if err := s.publisher.Publish(c, s.key(stream), payload, ttl); err != nil {
+		metrics.PublishFailures.WithLabelValues("append").Inc()
+		return err
+	}
+	return nil
+}
+
+//Follow reads the stream when events are appended to streams, resuming from the last entry read if the
+//connection fails, and otherwise subscribes to the channel of the same name.
+func (s *redisStore) Follow(stream string, logger *slog.Logger) (Subscription, error) {
+	if !s.publisher.Streams() {
+		return s.Subscribe(stream)
+	}
+
+	// The last entry is looked up before returning, so entries appended once Follow returns are all read
+	c := s.pool.Get()
+	lastID, err := eventlog.LastID(c, s.key(stream))
+	c.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	sub := newRedisSubscription(nil)
+	go func() {
+		defer close(sub.messages)
+		for {
+			err := s.readStream(sub, stream, &lastID)
+			if err == nil {
+				return
+			}
+			logger.Error("error reading stream, retrying", "stream", stream, "error", err)
+			select {
+			case <-sub.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+//readStream delivers stream entries after lastID to the subscription.  It returns nil once the subscription
+//is closed.
+func (s *redisStore) readStream(sub *redisSubscription, stream string, lastID *string) error {
+	c := s.pool.Get()
+	defer c.Close()
+
+	for {
+		entries, err := eventlog.Read(c, s.key(stream), *lastID, 100, 1000)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !sub.send(Message{Channel: stream, Payload: entry.Payload}) {
+				return nil
+			}
+			*lastID = entry.ID
+		}
+		select {
+		case <-sub.done:
+			return nil
+		default:
+		}
+	}
+}
+
+func (s *redisStore) OpenQueue(name string) Queue {
+	return rmqQueue{Queue: s.queues.OpenQueue(s.key(name)), connection: s.queues, name: s.key(name)}
+}
+
+func (s *redisStore) Ping() error {
+	_, err := s.do("PING")
+	return err
+}
+
+func (s *redisStore) Close() error {
+	return s.pool.Close()
+}
+
+//redisSubscription forwards messages read by a goroutine until it is closed
+type redisSubscription struct {
+	messages chan Message
+	done     chan struct{}
+	once     sync.Once
+	stop     func()
+}
+
+func newRedisSubscription(stop func()) *redisSubscription {
+	return &redisSubscription{messages: make(chan Message), done: make(chan struct{}), stop: stop}
+}
+
+//send hands a message to the subscriber, returning false if the subscription was closed
+func (sub *redisSubscription) send(message Message) bool {
+	select {
+	case sub.messages <- message:
+		return true
+	case <-sub.done:
+		return false
+	}
+}
+
+func (sub *redisSubscription) Messages() <-chan Message {
+	return sub.messages
+}
+
+func (sub *redisSubscription) Close() error {
+	sub.once.Do(func() {
+		close(sub.done)
+		if sub.stop != nil {
+			sub.stop()
+		}
+	})
+	return nil
+}
+
+//rmqQueue adapts an rmq queue to the Queue interface
+type rmqQueue struct {
+	rmq.Queue
+	connection rmq.Connection
+	name       string
+}
+
+func (q rmqQueue) Publish(payload string) error {
+	if !q.Queue.Publish(payload) {
+		metrics.PublishFailures.WithLabelValues("queue").Inc()
+		return fmt.Errorf("error publishing to queue")
+	}
+	return nil
+}
+
+func (q rmqQueue) ReturnRejected() (int, error) {
+	return q.Queue.ReturnAllRejected(), nil
+}
+
+func (q rmqQueue) Depth() QueueDepth {
+	stats := q.connection.CollectStats([]string{q.name}).QueueStats[q.name]
+	return QueueDepth{Ready: stats.ReadyCount, Unacked: stats.UnackedCount(), Rejected: stats.RejectedCount}
+}
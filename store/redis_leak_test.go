@@ -0,0 +1,53 @@
+package store_test
+
+import (
+	"log/slog"
+	"nano-pp/store"
+	"nano-pp/store/storetest"
+	"testing"
+	"time"
+)
+
+func TestRedisReleasesConnections(t *testing.T) {
+	st, pool, _ := storetest.NewRedis(t, store.RedisOptions{Prefix: "test:"})
+
+	st.AddKnownHashes("nano_1abc", "worker", "A", "B")
+	st.KnownHashes("nano_1abc", "worker")
+	st.ResetKnownHashes("nano_1abc", "worker")
+	st.SetStatus("worker", "pending")
+	st.Status("worker")
+	st.Status("missing")
+	st.MarkConfirming("nano_1abc", "worker")
+	st.IsConfirming("nano_1abc", "worker")
+	st.ClearConfirming("nano_1abc", "worker")
+	st.Watch("nano_1abc", "worker", "1000")
+	st.AttributeSend("nano_1abc", "HASH", "1000", "fifo")
+	st.Watchers("nano_1abc")
+	st.Unwatch("nano_1abc", "worker")
+	st.ReserveAmount("nano_1abc", "1001", "worker")
+	st.AmountOwner("nano_1abc", "1001")
+	st.ReleaseAmount("nano_1abc", "1001", "worker")
+	st.Publish(store.CancelChannel("worker"), "true")
+	st.Append(store.PaymentStream("nano_1abc"), "{}")
+	st.Ping()
+
+	sub, err := st.Subscribe(store.CancelChannel("worker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Publish(store.CancelChannel("worker"), "true")
+	select {
+	case <-sub.Messages():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	sub.Close()
+
+	follow, err := st.Follow(store.ConfirmationStream, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	follow.Close()
+
+	storetest.CheckLeaks(t, pool)
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"log/slog"
+	"nano-pp/eventlog"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Pool) {
+	server := miniredis.RunT(t)
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+	return server, pool
+}
+
+func TestRedisPrefixAndTTL(t *testing.T) {
+	server, pool := newTestRedis(t)
+	st := NewRedis(pool, nil, eventlog.Publisher{Mode: eventlog.ModeStreams}, RedisOptions{
+		Prefix: "staging:",
+		TTL:    TTLPolicy{RequestTimeout: time.Minute, WorkingRetention: time.Minute, ResultRetention: time.Hour},
+	})
+
+	st.SetStatus("worker", "pending")
+	st.MarkConfirming("nano_1abc", "worker")
+	st.AddKnownHashes("nano_1abc", "worker", "A")
+	st.Append(PaymentStream("nano_1abc"), "{}")
+	st.Watch("nano_1abc", "worker", "1000")
+
+	for key, want := range map[string]time.Duration{
+		"staging:status/worker":                    61 * time.Minute,
+		"staging:confirming/{nano_1abc}/worker":    2 * time.Minute,
+		"staging:known_pending/{nano_1abc}/worker": 2 * time.Minute,
+		"staging:payment.nano_1abc":                61 * time.Minute,
+		"staging:watchers/{nano_1abc}":             2 * time.Minute,
+		"staging:eligible/{nano_1abc}":             2 * time.Minute,
+	} {
+		if got := server.TTL(key); got != want {
+			t.Errorf("got TTL %v for %s want %v", got, key, want)
+		}
+	}
+
+	if status, _ := st.Status("worker"); status != "pending" {
+		t.Errorf("got status '%s' want 'pending'", status)
+	}
+	if server.Exists("status/worker") {
+		t.Error("expected keys to be written under the prefix only")
+	}
+}
+
+func TestJanitorRemovesKeysWithoutExpiry(t *testing.T) {
+	server, pool := newTestRedis(t)
+	server.Set("staging:status/old", "success")
+	server.Set("staging:status/new", "pending")
+	server.SetTTL("staging:status/new", time.Hour)
+	server.Set("production:status/old", "success")
+
+	janitor := NewJanitor(pool, "staging:")
+	janitor.DryRun = true
+	report, err := janitor.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphaned["status/*"]) != 1 || report.Removed != 0 {
+		t.Errorf("got report %+v from dry run", report)
+	}
+
+	janitor.DryRun = false
+	report, _ = janitor.Sweep()
+	if report.Removed != 1 || server.Exists("staging:status/old") {
+		t.Errorf("got report %+v, expected staging:status/old to be removed", report)
+	}
+	if !server.Exists("staging:status/new") || !server.Exists("production:status/old") {
+		t.Error("expected keys with an expiry or another prefix to be kept")
+	}
+}
+
+func TestRedisReservedAmounts(t *testing.T) {
+	_, pool := newTestRedis(t)
+	st := NewRedis(pool, nil, eventlog.Publisher{Mode: eventlog.ModeStreams}, RedisOptions{})
+
+	if ok, err := st.ReserveAmount("nano_1abc", "1001", "first"); !ok || err != nil {
+		t.Fatalf("got %v, %v reserving a free amount", ok, err)
+	}
+	if ok, _ := st.ReserveAmount("nano_1abc", "1001", "second"); ok {
+		t.Error("expected a held amount not to be reserved again")
+	}
+	// Only the holder releases the amount
+	st.ReleaseAmount("nano_1abc", "1001", "second")
+	if owner, _ := st.AmountOwner("nano_1abc", "1001"); owner != "first" {
+		t.Errorf("got owner '%s' want 'first'", owner)
+	}
+	st.ReleaseAmount("nano_1abc", "1001", "first")
+	if owner, _ := st.AmountOwner("nano_1abc", "1001"); owner != "" {
+		t.Errorf("got owner '%s' after release", owner)
+	}
+}
+
+//testAttribution checks that each send is attributed to exactly one eligible request watching the address
+func testAttribution(t *testing.T, st Store) {
+	st.Watch("nano_1abc", "w1", "1000")
+	st.Watch("nano_1abc", "w2", "2000")
+	st.Watch("nano_1abc", "w3", "2000")
+	st.Watch("nano_1abc", "w1", "1000")
+	st.AddKnownHashes("nano_1abc", "w2", "KNOWN")
+
+	for _, tc := range []struct {
+		hash   string
+		amount string
+		policy string
+		want   string
+	}{
+		{"A", "2000", "amount", "w2"},
+		// Every worker asking about a send gets the same answer
+		{"A", "2000", "fifo", "w2"},
+		{"KNOWN", "2000", "amount", "w3"},
+		// Without a request expecting the amount the oldest eligible takes it
+		{"B", "500", "amount", "w1"},
+		{"C", "1000", "fifo", ""},
+	} {
+		if got, err := st.AttributeSend("nano_1abc", tc.hash, tc.amount, tc.policy); err != nil || got != tc.want {
+			t.Errorf("send %s of %s by %s: got '%s', %v want '%s'", tc.hash, tc.amount, tc.policy, got, err, tc.want)
+		}
+	}
+
+	st.Unwatch("nano_1abc", "w1")
+	if watchers, _ := st.Watchers("nano_1abc"); len(watchers) != 2 || watchers[0] != "w2" {
+		t.Errorf("got watchers %v want [w2 w3]", watchers)
+	}
+}
+
+func TestRedisAttribution(t *testing.T) {
+	_, pool := newTestRedis(t)
+	testAttribution(t, NewRedis(pool, nil, eventlog.Publisher{Mode: eventlog.ModeStreams}, RedisOptions{
+		Prefix: "test:",
+		TTL:    TTLPolicy{RequestTimeout: time.Minute, WorkingRetention: time.Minute},
+	}))
+}
+
+func TestMemoryAttribution(t *testing.T) {
+	testAttribution(t, NewMemory())
+}
+
+//testStaleWatchers checks that watching drops the watchers older than the working TTL.  backdate makes
+//the watcher look like it started watching an hour ago.
+func testStaleWatchers(t *testing.T, st Store, backdate func(address string, workerID string)) {
+	// A worker that died without unwatching
+	st.Watch("nano_1abc", "dead", "1000")
+	backdate("nano_1abc", "dead")
+	st.Watch("nano_1abc", "live", "1000")
+	st.Watch("nano_1abc", "live", "1000")
+
+	if watchers, _ := st.Watchers("nano_1abc"); len(watchers) != 1 || watchers[0] != "live" {
+		t.Errorf("got watchers %v want [live]", watchers)
+	}
+	if owner, _ := st.AttributeSend("nano_1abc", "A", "1000", "fifo"); owner != "live" {
+		t.Errorf("got owner '%s' want 'live'", owner)
+	}
+}
+
+func TestRedisWatchDropsStaleWatchers(t *testing.T) {
+	server, pool := newTestRedis(t)
+	st := NewRedis(pool, nil, eventlog.Publisher{Mode: eventlog.ModeStreams}, RedisOptions{
+		Prefix: "test:",
+		TTL:    TTLPolicy{RequestTimeout: time.Minute, WorkingRetention: time.Minute},
+	})
+	testStaleWatchers(t, st, func(address string, workerID string) {
+		server.ZAdd("test:"+watchersKey(address), float64(time.Now().Add(-time.Hour).UnixMicro()), workerID)
+	})
+	if server.HGet("test:eligible/{nano_1abc}", "dead") != "" {
+		t.Error("expected the stale watcher's amount to be dropped")
+	}
+}
+
+func TestMemoryWatchDropsStaleWatchers(t *testing.T) {
+	st := NewMemoryWithTTL(TTLPolicy{RequestTimeout: time.Minute, WorkingRetention: time.Minute}).(*memoryStore)
+	testStaleWatchers(t, st, func(address string, workerID string) {
+		st.watched[address][workerID] = time.Now().Add(-time.Hour)
+	})
+	if _, ok := st.eligible["nano_1abc"]["dead"]; ok {
+		t.Error("expected the stale watcher's amount to be dropped")
+	}
+}
+
+func TestRedisFollowReadsEntriesAppendedOnReturn(t *testing.T) {
+	server, pool := newTestRedis(t)
+	st := NewRedis(pool, nil, eventlog.Publisher{Mode: eventlog.ModeStreams}, RedisOptions{Prefix: "test:"})
+	st.Append(PaymentStream("nano_1abc"), "before")
+
+	// The follower's connections are slow to open, so its first read runs well after the append below
+	slow := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			time.Sleep(100 * time.Millisecond)
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	t.Cleanup(func() { slow.Close() })
+	follower := NewRedis(slow, nil, eventlog.Publisher{Mode: eventlog.ModeStreams}, RedisOptions{Prefix: "test:"})
+
+	sub, err := follower.Follow(PaymentStream("nano_1abc"), slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	st.Append(PaymentStream("nano_1abc"), "after")
+
+	select {
+	case message := <-sub.Messages():
+		if message.Payload != "after" {
+			t.Errorf("got %q want the entry appended after Follow returned", message.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the entry appended after Follow returned was not read")
+	}
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/adjust/rmq"
+)
+
+//ConfirmationStream is the stream the BlockBroadcaster appends node confirmations to
+const ConfirmationStream = "nano-websocket-confirmations"
+
+//PaymentRequestQueue is the queue payment requests are read from
+const PaymentRequestQueue = "PaymentRequestQueue"
+
+//CheckpointQueue is the queue processors leave the requests of unfinished workers on at shutdown.  Only
+//requests read from it are resumed, so a worker ID in a new request is never trusted.
+const CheckpointQueue = "PaymentCheckpointQueue"
+
+//TTLPolicy sets how long each class of key is kept.  Keys written for a request expire the retention
+//period after the request deadline.
+type TTLPolicy struct {
+	// Time a payment request is watched for before it times out
+	RequestTimeout time.Duration
+	// Retention after the deadline for known hashes and confirming markers
+	WorkingRetention time.Duration
+	// Retention after the deadline for worker statuses and payment event streams
+	ResultRetention time.Duration
+}
+
+//working returns the expiry for known hashes and confirming markers
+func (p TTLPolicy) working() time.Duration {
+	return p.RequestTimeout + p.WorkingRetention
+}
+
+//result returns the expiry for worker statuses and payment event streams
+func (p TTLPolicy) result() time.Duration {
+	return p.RequestTimeout + p.ResultRetention
+}
+
+//Message is an event received from a subscription
+type Message struct {
+	Channel string
+	Payload string
+}
+
+//Subscription delivers the messages published to the subscribed channels.  The Messages channel is
+//closed when the subscription is closed or the connection behind it fails.
+type Subscription interface {
+	Messages() <-chan Message
+	Close() error
+}
+
+//Queue is a work queue of payloads consumed by rmq style consumers
+type Queue interface {
+	Publish(payload string) error
+	StartConsuming(prefetchLimit int, pollDuration time.Duration) bool
+	AddConsumer(tag string, consumer rmq.Consumer) string
+	// StopConsuming stops fetching deliveries.  The returned channel is closed once the consumers have
+	// finished their current delivery.
+	StopConsuming() <-chan struct{}
+	// Depth counts the queue's deliveries
+	Depth() QueueDepth
+	// ReturnRejected moves the rejected deliveries back to ready and returns how many were moved
+	ReturnRejected() (int, error)
+}
+
+//QueueDepth counts the deliveries of a queue by state
+type QueueDepth struct {
+	// Waiting to be fetched by a consumer
+	Ready int
+	// Fetched and not yet acked
+	Unacked int
+	// Rejected by a consumer
+	Rejected int
+}
+
+//Store holds the state shared by the payment workers and carries the events between them.  The state of
+//a request is kept by its address and worker ID, so requests sharing an address don't touch each other's.
+type Store interface {
+	// ResetKnownHashes removes the block hashes recorded for the worker's request to the address
+	ResetKnownHashes(address string, workerID string) error
+	// AddKnownHashes records block hashes that must not be credited to the worker's request to the address
+	AddKnownHashes(address string, workerID string, hashes ...string) error
+	// KnownHashes returns the block hashes recorded for the worker's request to the address
+	KnownHashes(address string, workerID string) ([]string, error)
+
+	// SetStatus records the status of a payment worker
+	SetStatus(workerID string, status string) error
+	// Status returns the status of a payment worker, or "" if none is recorded
+	Status(workerID string) (string, error)
+	// Statuses returns the recorded status of every payment worker by worker ID
+	Statuses() (map[string]string, error)
+
+	// MarkConfirming flags that a block for the worker's request to the address is being confirmed
+	MarkConfirming(address string, workerID string) error
+	// IsConfirming reports whether a block for the worker's request to the address is being confirmed
+	IsConfirming(address string, workerID string) (bool, error)
+	// ClearConfirming removes the confirming flag of the worker's request to the address
+	ClearConfirming(address string, workerID string) error
+
+	// Watch adds the worker's request for the amount to the requests eligible for sends to the address.
+	// A worker watching again keeps its place.
+	Watch(address string, workerID string, amount string) error
+	// Unwatch removes the worker's request from those watching the address
+	Unwatch(address string, workerID string) error
+	// Watchers returns the workers watching the address, oldest first
+	Watchers(address string) ([]string, error)
+	// AttributeSend assigns the send of the amount to exactly one eligible request watching the address and
+	// returns its worker, the same one on every call for the hash, or "" if none is eligible.  A request
+	// is eligible until a send is attributed to it, if the hash isn't one of its known hashes.  With the
+	// "amount" policy the oldest request expecting the amount is chosen, otherwise or failing that the oldest.
+	AttributeSend(address string, hash string, amount string, policy string) (string, error)
+
+	// ReserveAmount claims the amount at the address for the worker, returning false if it is held
+	ReserveAmount(address string, amount string, workerID string) (bool, error)
+	// AmountOwner returns the worker holding the amount at the address, or "" if none does
+	AmountOwner(address string, amount string) (string, error)
+	// ReleaseAmount frees the amount at the address if the worker holds it
+	ReleaseAmount(address string, amount string, workerID string) error
+
+	// Publish sends a message to the subscribers of a channel
+	Publish(channel string, payload string) error
+	// Subscribe returns a subscription to messages published to the channels from now on
+	Subscribe(channels ...string) (Subscription, error)
+	// Append adds an event to the named event log
+	Append(stream string, payload string) error
+	// Follow returns a subscription to the events appended to the named event log from now on.  Errors
+	// reading the log, which is retried, are logged to the logger.
+	Follow(stream string, logger *slog.Logger) (Subscription, error)
+
+	// OpenQueue returns the named work queue
+	OpenQueue(name string) Queue
+
+	// Ping checks that the store is reachable
+	Ping() error
+	Close() error
+}
+
+//CancelChannel is the channel used to stop the polling of a payment worker
+func CancelChannel(workerID string) string {
+	return fmt.Sprintf("cancel/%s", workerID)
+}
+
+//ResetPendingChannel is the channel used to wake the pending poll of a payment worker
+func ResetPendingChannel(workerID string) string {
+	return fmt.Sprintf("resetPending/%s", workerID)
+}
+
+//AckChannel is the channel payment request acknowledgements are published to
+func AckChannel(address string) string {
+	return fmt.Sprintf("ack.%s", address)
+}
+
+//PaymentStream is the event log payment updates for the address are appended to
+func PaymentStream(address string) string {
+	return fmt.Sprintf("payment.%s", address)
+}
+
+//keyClasses are the patterns of the keys written by the store, used by the janitor to find orphans
+var keyClasses = []string{"known_pending/*", "confirming/*", "amount/*", "watchers/*", "eligible/*", "attributed/*", "status/*", "payment.*"}
+
+//The keys of the requests to an address share the {address} hash tag, so a cluster keeps them in one slot
+//and the attribution script can read them together
+
+func knownPendingKey(address string, workerID string) string {
+	return fmt.Sprintf("known_pending/{%s}/%s", address, workerID)
+}
+
+func statusKey(workerID string) string {
+	return fmt.Sprintf("status/%s", workerID)
+}
+
+func confirmingKey(address string, workerID string) string {
+	return fmt.Sprintf("confirming/{%s}/%s", address, workerID)
+}
+
+func watchersKey(address string) string {
+	return fmt.Sprintf("watchers/{%s}", address)
+}
+
+func eligibleKey(address string) string {
+	return fmt.Sprintf("eligible/{%s}", address)
+}
+
+func attributedKey(address string, hash string) string {
+	return fmt.Sprintf("attributed/{%s}/%s", address, hash)
+}
+
+func amountKey(address string, amount string) string {
+	return fmt.Sprintf("amount/%s/%s", address, amount)
+}
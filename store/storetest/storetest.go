@@ -0,0 +1,49 @@
+package storetest
+
+import (
+	"nano-pp/eventlog"
+	"nano-pp/store"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+//leakGrace is how long CheckLeaks waits for connections closed asynchronously, such as by a subscription
+//goroutine, to be returned
+const leakGrace = 2 * time.Second
+
+//NewRedis starts a miniredis server for the test and returns a redis store on it along with its pool.
+//The store has no work queues.
+func NewRedis(t testing.TB, options store.RedisOptions) (store.Store, *redis.Pool, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+
+	st := store.NewRedis(pool, nil, eventlog.Publisher{Mode: eventlog.ModeBoth}, options)
+	return st, pool, server
+}
+
+//CheckLeaks fails the test if connections are still checked out of the pool, giving connections being
+//closed in the background a short grace period to come back.
+func CheckLeaks(t testing.TB, pool *redis.Pool) {
+	t.Helper()
+	deadline := time.Now().Add(leakGrace)
+	for {
+		stats := pool.Stats()
+		inUse := stats.ActiveCount - stats.IdleCount
+		if inUse == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("%d redis connections still checked out", inUse)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,72 @@
+package workers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"nano-pp/codec"
+	"nano-pp/dispatcher"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"nano-pp/store/storetest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//quietNode answers the RPC actions used before a payment arrives with an empty account
+func quietNode(t *testing.T) (string, string) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		switch request["action"] {
+		case "account_history":
+			w.Write([]byte(`{"history": ""}`))
+		case "pending":
+			w.Write([]byte(`{"blocks": ""}`))
+		default:
+			w.Write([]byte(`{"error": "unexpected action"}`))
+		}
+	}))
+	t.Cleanup(node.Close)
+
+	split := strings.LastIndex(node.URL, ":")
+	return node.URL[:split], node.URL[split+1:]
+}
+
+func TestWorkerReleasesConnections(t *testing.T) {
+	st, pool, _ := storetest.NewRedis(t, store.RedisOptions{})
+	host, port := quietNode(t)
+
+	config := structs.DefaultConfig()
+	config.RPCHost, config.RPCPort = host, port
+	config.TimeoutDuration = 1
+
+	d := dispatcher.New(st, slog.Default())
+	lc := NewLifecycle(slog.Default(), 1)
+	request := structs.PaymentRequest{DestinationAddress: "nano_1leak", Amount: "1000"}
+	lc.Go("worker", func() { PaymentRequestWorker(st, d, lc, slog.Default(), config, request, "worker") })
+
+	if !lc.Drain(5 * time.Second) {
+		t.Fatal("worker did not finish")
+	}
+	if status, _ := st.Status("worker"); status != "timeout" {
+		t.Errorf("got status '%s' want 'timeout'", status)
+	}
+	storetest.CheckLeaks(t, pool)
+}
+
+func TestProcessPaymentReleasesConnections(t *testing.T) {
+	st, pool, _ := storetest.NewRedis(t, store.RedisOptions{})
+	request := structs.PaymentRequest{DestinationAddress: "nano_1leak", Amount: "1000"}
+
+	for received, status := range map[string]string{"1000": "success", "2000": "overpayment", "500": "underpayment"} {
+		st.MarkConfirming(request.DestinationAddress, "worker")
+		processPaymentMessage(st, codec.JSON{}, slog.Default(), structs.MerchantPolicy{}, request, received, "HASH", "nano_1sender", "worker")
+		if got, _ := st.Status("worker"); got != status {
+			t.Errorf("got status '%s' for %s raw want '%s'", got, received, status)
+		}
+	}
+	storetest.CheckLeaks(t, pool)
+}
@@ -0,0 +1,171 @@
+package workers
+
+import (
+	"log/slog"
+	"nano-pp/codec"
+	"nano-pp/metrics"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"sync"
+	"time"
+)
+
+//checkpointTimeout is how long workers have to checkpoint once the grace period is over
+const checkpointTimeout = 10 * time.Second
+
+//Lifecycle tracks the running payment workers so they can be limited and drained on shutdown
+type Lifecycle struct {
+	logger     *slog.Logger
+	mu         sync.Mutex
+	wg         sync.WaitGroup
+	draining   bool
+	drain      chan struct{}
+	checkpoint chan struct{}
+	// Holds a token for each payment request with running goroutines
+	slots chan struct{}
+	// Running goroutines by worker ID
+	running map[string]int
+}
+
+//NewLifecycle returns a lifecycle accepting up to maxWorkers concurrent payment requests.
+func NewLifecycle(logger *slog.Logger, maxWorkers int) *Lifecycle {
+	metrics.WorkerLimit.Set(float64(maxWorkers))
+	return &Lifecycle{
+		logger:     logger,
+		drain:      make(chan struct{}),
+		checkpoint: make(chan struct{}),
+		slots:      make(chan struct{}, maxWorkers),
+		running:    make(map[string]int),
+	}
+}
+
+//Go waits for a free worker slot and then runs the payment worker in a tracked goroutine.  The slot is
+//held until every goroutine tracked for the worker ID has returned.  Once draining has started the
+//worker is not run and Go returns false.
+func (l *Lifecycle) Go(workerID string, worker func()) bool {
+	metrics.WaitingDeliveries.Inc()
+	select {
+	case l.slots <- struct{}{}:
+		metrics.WaitingDeliveries.Dec()
+	case <-l.drain:
+		metrics.WaitingDeliveries.Dec()
+		return false
+	}
+
+	l.mu.Lock()
+	if l.draining {
+		l.mu.Unlock()
+		<-l.slots
+		return false
+	}
+	if l.running[workerID] > 0 {
+		// The same request is already running and holds a slot
+		<-l.slots
+	} else {
+		metrics.ActiveWorkers.Inc()
+	}
+	l.running[workerID]++
+	l.wg.Add(1)
+	l.mu.Unlock()
+
+	go l.run(workerID, worker)
+	return true
+}
+
+//Full reports whether every worker slot is taken, so a further Go would wait.
+func (l *Lifecycle) Full() bool {
+	return len(l.slots) == cap(l.slots)
+}
+
+//track runs part of an already running worker in its own goroutine, even while draining.  It shares
+//the worker's slot.
+func (l *Lifecycle) track(workerID string, worker func()) {
+	l.mu.Lock()
+	l.running[workerID]++
+	l.wg.Add(1)
+	l.mu.Unlock()
+
+	go l.run(workerID, worker)
+}
+
+func (l *Lifecycle) run(workerID string, worker func()) {
+	defer l.wg.Done()
+	defer l.release(workerID)
+	worker()
+}
+
+//release frees the worker's slot once its last goroutine has returned
+func (l *Lifecycle) release(workerID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running[workerID]--
+	if l.running[workerID] > 0 {
+		return
+	}
+	delete(l.running, workerID)
+	<-l.slots
+	metrics.ActiveWorkers.Dec()
+}
+
+//Checkpoint is closed when running workers must checkpoint their request and stop.
+func (l *Lifecycle) Checkpoint() <-chan struct{} {
+	return l.checkpoint
+}
+
+//StopStarting stops new workers from starting, releasing any waiting for a slot.  Consumers blocked in Go
+//then return, so the queues can stop consuming before the running workers are drained.
+func (l *Lifecycle) StopStarting() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.draining {
+		l.draining = true
+		close(l.drain)
+	}
+}
+
+//Drain stops new workers from starting, releasing any waiting for a slot, and waits up to the grace
+//period for the running workers to finish.  Workers still running after that are asked to checkpoint.
+//It returns false if any worker had to checkpoint or did not stop in time.
+func (l *Lifecycle) Drain(grace time.Duration) bool {
+	l.StopStarting()
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+	}
+
+	close(l.checkpoint)
+	select {
+	case <-done:
+	case <-time.After(checkpointTimeout):
+		l.logger.Warn("payment workers did not checkpoint in time")
+	}
+	return false
+}
+
+//checkpoint returns the payment request to the checkpoint queue under the same worker ID so another processor
+//resumes it.  If a block was being confirmed its hash is kept so the confirmation resumes directly.
+func checkpoint(st store.Store, wire codec.Codec, logger *slog.Logger, paymentRequest structs.PaymentRequest, workerID string, hash string) {
+	paymentRequest.WorkerID = workerID
+	paymentRequest.ValidationHash = hash
+
+	data, err := wire.EncodePaymentRequest(paymentRequest)
+	if err != nil {
+		logger.Error("error encoding checkpoint", "error", err, "content_type", wire.ContentType())
+		return
+	}
+	if err := st.OpenQueue(store.CheckpointQueue).Publish(data); err != nil {
+		logger.Error("error requeueing payment request", "error", err)
+		return
+	}
+	setWorkerStatus("requeued", workerID, st, logger)
+	metrics.WorkerStopped(workerID)
+	logger.Info("checkpointed worker")
+}
@@ -0,0 +1,65 @@
+package workers
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestLifecycleWorkerLimit(t *testing.T) {
+	lc := NewLifecycle(slog.Default(), 1)
+
+	release := make(chan struct{})
+	lc.Go("first", func() {
+		// The slot is held until the tracked goroutine returns too
+		lc.track("first", func() { <-release })
+	})
+
+	started := make(chan bool)
+	go func() { started <- lc.Go("second", func() {}) }()
+
+	select {
+	case <-started:
+		t.Fatal("second worker started while the limit was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case ok := <-started:
+		if !ok {
+			t.Error("expected the second worker to start")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second worker did not start after the slot was released")
+	}
+
+	if !lc.Drain(time.Second) {
+		t.Error("expected the workers to drain")
+	}
+	if lc.Go("third", func() {}) {
+		t.Error("expected no worker to start while draining")
+	}
+}
+
+func TestLifecycleDrainReleasesWaiting(t *testing.T) {
+	lc := NewLifecycle(slog.Default(), 1)
+
+	release := make(chan struct{})
+	lc.Go("first", func() { <-release })
+
+	started := make(chan bool)
+	go func() { started <- lc.Go("second", func() {}) }()
+	time.Sleep(20 * time.Millisecond)
+
+	go lc.Drain(time.Minute)
+	select {
+	case ok := <-started:
+		if ok {
+			t.Error("expected the waiting worker not to start once draining")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting worker was not released by drain")
+	}
+	close(release)
+}
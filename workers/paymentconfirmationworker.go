@@ -2,23 +2,54 @@ package workers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"nano-pp/codec"
+	"nano-pp/dispatcher"
+	"nano-pp/logging"
 	nano "nano-pp/nanocurrency"
 	"nano-pp/nanocurrency/nanostructs"
 	nanostruct "nano-pp/nanocurrency/nanostructs"
 	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
 	"strings"
 	"time"
-
-	"github.com/gomodule/redigo/redis"
 )
 
+//errBlockNotFound is returned by fetchBlockInfo when the node reports that it has no valid block by the hash
+var errBlockNotFound = errors.New("block not found")
+
+//fetchBlockInfo pulls the block info for a provided hash from the Nano node.  A failed call or a response
+//that can't be read is returned as an error to retry, and a block the node reports missing or invalid as
+//errBlockNotFound.
+func fetchBlockInfo(rpc nanostructs.NanoRPC, hash string) (nanostruct.BlockInfo, error) {
+	var response struct {
+		nanostruct.BlockInfo
+		Error string `json:"error"`
+	}
+	blockReturn, err := nano.BlockInfo(rpc, hash)
+	if err != nil {
+		return response.BlockInfo, err
+	}
+	if err := json.Unmarshal(blockReturn, &response); err != nil {
+		return response.BlockInfo, fmt.Errorf("error decoding block info: %v", err)
+	}
+	switch response.Error {
+	case "":
+		return response.BlockInfo, nil
+	case "Block not found", "Bad hash number":
+		return response.BlockInfo, fmt.Errorf("%w: %s", errBlockNotFound, response.Error)
+	}
+	return response.BlockInfo, fmt.Errorf("node error getting block info: %s", response.Error)
+}
+
 //getBlockInfo pulls the block info for a provided hash from the Nano node.
-func getBlockInfo(rpc nanostructs.NanoRPC, hash string) nanostruct.BlockInfo {
+func getBlockInfo(rpc nanostructs.NanoRPC, logger *slog.Logger, hash string) nanostruct.BlockInfo {
 	var blockInfo nanostruct.BlockInfo
 	blockReturn, err := nano.BlockInfo(rpc, hash)
 	if err != nil {
-		fmt.Println("Error getting info for confirmation height:", err)
+		logger.Error("error getting block info", "error", err)
 	}
 	d := json.NewDecoder(strings.NewReader(string(blockReturn)))
 	d.Decode(&blockInfo)
@@ -26,95 +57,124 @@ func getBlockInfo(rpc nanostructs.NanoRPC, hash string) nanostruct.BlockInfo {
 	return blockInfo
 }
 
-func processPaymentMessage(pool *redis.Pool, paymentRequest structs.PaymentRequest, validatedAmount string, hash string, sendingAddress string, workerID string) {
-	confirmationWorkerC := pool.Get()
-	amountComparison := compareAmounts(paymentRequest.Amount, validatedAmount)
+func processPaymentMessage(st store.Store, wire codec.Codec, logger *slog.Logger, policy structs.MerchantPolicy, paymentRequest structs.PaymentRequest, validatedAmount string, hash string, sendingAddress string, workerID string) {
+	amountComparison := compareAmounts(logger, paymentRequest.Amount, validatedAmount)
 
-	var payment structs.Payment
-	payment.DestinationAddress = paymentRequest.DestinationAddress
-	payment.ExpectedAmount = validatedAmount
-	payment.ValidatedAmount = paymentRequest.Amount
+	payment := requestPayment(paymentRequest, workerID)
+	payment.ValidatedAmount = validatedAmount
 	payment.Hash = hash
 	payment.SendingAddress = sendingAddress
 
+	// A small difference, such as a wallet rounding the amount, counts as paid and is reported as the
+	// merchant's tolerance_report asks
+	if amountComparison != 0 && withinTolerance(logger, policy, paymentRequest, amountComparison, validatedAmount) {
+		difference := calcDifference(logger, amountComparison, paymentRequest.Amount, validatedAmount)
+		direction := "underpaid"
+		if amountComparison == -1 {
+			direction = "overpaid"
+		}
+		note := fmt.Sprintf("Paid within tolerance, %s by %s raw.", direction, difference.String())
+		logger.Info("payment within tolerance", "amount", validatedAmount, "difference", difference.String(), "direction", direction, "report", policy.ToleranceReport)
+
+		if policy.ToleranceReport == "error" {
+			payment.Status = "error"
+			payment.ErrorCode = 4
+			payment.ErrorMessage = note
+
+			sendConfirmation(payment, paymentRequest.DestinationAddress, st, wire, logger)
+			setWorkerStatus("within_tolerance", workerID, st, logger)
+
+			st.ClearConfirming(paymentRequest.DestinationAddress, workerID)
+			cancelWorker(st, logger, workerID)
+			return
+		}
+		payment.Note = note
+		amountComparison = 0
+	}
+
 	if amountComparison == 0 {
 
 		payment.Status = "success"
 
-		sendConfirmation(payment, paymentRequest.DestinationAddress, pool)
-		setWorkerStatus("success", workerID, pool)
+		sendConfirmation(payment, paymentRequest.DestinationAddress, st, wire, logger)
+		setWorkerStatus("success", workerID, st, logger)
 
-		fmt.Println("PAYMENT SUCCESS!")
+		logger.Info("payment success", "amount", validatedAmount)
 
-		confirmationWorkerC.Do("DEL", fmt.Sprintf("confirming/%s", paymentRequest.DestinationAddress))
-		_, err := confirmationWorkerC.Do("PUBLISH", fmt.Sprintf("cancel/%s", workerID), true)
-		if err != nil {
-			fmt.Println("Error publishing cancel event:", err)
-		}
+		st.ClearConfirming(paymentRequest.DestinationAddress, workerID)
+		cancelWorker(st, logger, workerID)
 		return
 	} else if amountComparison == -1 {
-		var payment structs.Payment
-
-		overpaymentAmount := calcDifference(amountComparison, paymentRequest.Amount, validatedAmount)
-		fmt.Println("Overpayment amount:", overpaymentAmount)
+		overpaymentAmount := calcDifference(logger, amountComparison, paymentRequest.Amount, validatedAmount)
 
 		payment.Status = "error"
 		payment.ErrorCode = 1
 		payment.ErrorMessage = fmt.Sprintf("Overpayment of %s raw received", overpaymentAmount.String())
 
-		sendConfirmation(payment, paymentRequest.DestinationAddress, pool)
-		setWorkerStatus("overpayment", workerID, pool)
+		sendConfirmation(payment, paymentRequest.DestinationAddress, st, wire, logger)
+		setWorkerStatus("overpayment", workerID, st, logger)
 
-		fmt.Println("OVERPAYMENT!")
-		confirmationWorkerC.Do("DEL", fmt.Sprintf("confirming/%s", paymentRequest.DestinationAddress))
-		_, err := confirmationWorkerC.Do("PUBLISH", fmt.Sprintf("cancel/%s", workerID), true)
-		if err != nil {
-			fmt.Println("Error publishing cancel event:", err)
-		}
+		logger.Warn("overpayment", "difference", overpaymentAmount.String())
+		st.ClearConfirming(paymentRequest.DestinationAddress, workerID)
+		cancelWorker(st, logger, workerID)
 		return
 	} else if amountComparison == 1 {
-		var payment structs.Payment
-
-		underpaymentAmount := calcDifference(amountComparison, paymentRequest.Amount, validatedAmount)
-		fmt.Println("Underpayment amount:", underpaymentAmount)
+		underpaymentAmount := calcDifference(logger, amountComparison, paymentRequest.Amount, validatedAmount)
 
 		payment.Status = "error"
 		payment.ErrorCode = 2
 		payment.ErrorMessage = fmt.Sprintf("Underpayment received, remaining balance of %s raw owed.", underpaymentAmount.String())
 
-		sendConfirmation(payment, paymentRequest.DestinationAddress, pool)
-		setWorkerStatus("underpayment", workerID, pool)
+		sendConfirmation(payment, paymentRequest.DestinationAddress, st, wire, logger)
+		setWorkerStatus("underpayment", workerID, st, logger)
 
-		fmt.Println("UNDERPAYMENT!")
-		confirmationWorkerC.Do("DEL", fmt.Sprintf("confirming/%s", paymentRequest.DestinationAddress))
-		_, err := confirmationWorkerC.Do("PUBLISH", fmt.Sprintf("cancel/%s", workerID), true)
-		if err != nil {
-			fmt.Println("Error publishing cancel event:", err)
-		}
+		logger.Warn("underpayment", "difference", underpaymentAmount.String())
+		st.ClearConfirming(paymentRequest.DestinationAddress, workerID)
+		cancelWorker(st, logger, workerID)
 		return
 	}
 }
 
 //PaymentConfirmationWorker checks the confirmation status of a provided hash and
-//sends a message when the block is confirmed.
-func PaymentConfirmationWorker(pool *redis.Pool, hash string, paymentRequest structs.PaymentRequest, workerID string) {
-	config := structs.LoadConfig()
-	rpc := nanostructs.NanoRPC{Host: config.RPCHost, Port: config.RPCPort}
+//sends a message when the block is confirmed.  The status is checked every 5 seconds or as soon
+//as the dispatcher routes a confirmation for the hash.  On shutdown the request is checkpointed with
+//the hash so the confirmation resumes on another processor.
+func PaymentConfirmationWorker(st store.Store, d *dispatcher.Dispatcher, lc *Lifecycle, logger *slog.Logger, config structs.Config, hash string, paymentRequest structs.PaymentRequest, workerID string) {
+	hlog := logging.Payment(logger, workerID, paymentRequest.DestinationAddress, hash)
+	rpc := nanostructs.NanoRPC{Host: config.RPCHost, Port: config.RPCPort, Logger: hlog}
 	pendingTimer := time.NewTimer(5 * time.Second)
+	defer pendingTimer.Stop()
+
+	wire := codec.For(config.WireFormat)
+
+	sub := d.SubscribeHash(hash)
+	defer sub.Close()
 
 	for {
 		select {
+		case <-sub.C:
 		case <-pendingTimer.C:
-			blockInfo := getBlockInfo(rpc, hash)
-
-			if blockInfo.Confirmed == "false" {
-				fmt.Println("Block still confirming, resubmitting")
-				nano.BlockConfirm(rpc, hash)
-				pendingTimer.Reset(5 * time.Second)
-			} else {
-				processPaymentMessage(pool, paymentRequest, blockInfo.Amount, hash, blockInfo.BlockAccount, workerID)
-			}
+		case <-lc.Checkpoint():
+			checkpoint(st, wire, hlog, paymentRequest, workerID, hash)
+			return
 		}
 
+		blockInfo := getBlockInfo(rpc, hlog, hash)
+
+		// Without the block, such as while the node is unreachable, there is no amount to credit yet
+		if blockInfo.Amount == "" || blockInfo.Confirmed == "false" {
+			hlog.Debug("block still confirming, resubmitting", "found", blockInfo.Amount != "")
+			nano.BlockConfirm(rpc, hash)
+			if !pendingTimer.Stop() {
+				select {
+				case <-pendingTimer.C:
+				default:
+				}
+			}
+			pendingTimer.Reset(5 * time.Second)
+		} else {
+			processPaymentMessage(st, wire, hlog, config.Policy(paymentRequest.Merchant, paymentRequest.DestinationAddress), paymentRequest, blockInfo.Amount, hash, blockInfo.BlockAccount, workerID)
+			return
+		}
 	}
 }
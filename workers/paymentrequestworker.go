@@ -2,43 +2,44 @@ package workers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math/big"
-	bb "nano-pp/block_broadcaster"
 	br "nano-pp/block_recorder"
+	"nano-pp/codec"
+	"nano-pp/dispatcher"
+	"nano-pp/logging"
+	"nano-pp/metrics"
 	nano "nano-pp/nanocurrency"
 	"nano-pp/nanocurrency/nanostructs"
 	nanostruct "nano-pp/nanocurrency/nanostructs"
 	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/gomodule/redigo/redis"
 )
 
-func getKnownBlocks(pool *redis.Pool, destinationAddress string) []string {
+func getKnownBlocks(st store.Store, rpc nanostructs.NanoRPC, logger *slog.Logger, destinationAddress string, workerID string) []string {
 	//Known hashes include the past 1000 blocks and any pending blocks (including active)
-	br.BlockRecorder(pool, destinationAddress)
-	hashC := pool.Get()
-	hashReturn, membersErr := hashC.Do("SMEMBERS", fmt.Sprintf("known_pending/%s", destinationAddress))
+	br.BlockRecorder(st, rpc, logger, destinationAddress, workerID)
+	hashes, membersErr := st.KnownHashes(destinationAddress, workerID)
 	if membersErr != nil {
-		fmt.Println("error retrieving known/pending hashes from redis:", membersErr)
+		logger.Error("error retrieving known/pending hashes from the store", "error", membersErr)
 	}
 
-	hashes, _ := redis.Strings(hashReturn, nil)
-
 	return hashes
 }
 
-func getPendingBlocks(rpc nanostructs.NanoRPC, destinationAddress string) nanostruct.Pending {
+func getPendingBlocks(rpc nanostructs.NanoRPC, logger *slog.Logger, destinationAddress string) nanostruct.Pending {
 	//getPendingBlocks is used to check for any new pending blocks periodically to resubmit for
 	//confirmation.
-	fmt.Println("checking for pending from pollPending for address:", destinationAddress)
+	logger.Debug("checking for pending blocks")
 	optionalPending := map[string]string{"include_active": "true"}
 	pendingResponse, pendingErr := nano.Pending(rpc, destinationAddress, optionalPending)
 	if pendingErr != nil {
-		fmt.Printf("Error retrieving pending blocks: %v\n", pendingErr)
+		logger.Error("error retrieving pending blocks", "error", pendingErr)
 	}
 
 	var pending nanostruct.Pending
@@ -59,12 +60,12 @@ func setPendingHashMap(hashes []string) map[string]bool {
 	return hashCheck
 }
 
-func getConfirmationHeight(rpc nanostructs.NanoRPC, hash string) string {
+func getConfirmationHeight(rpc nanostructs.NanoRPC, logger *slog.Logger, hash string) string {
 	//getConfirmationHeight will return the confirmation height for a provided hash
 	var blockInfo nanostruct.BlockInfo
 	blockReturn, err := nano.BlockInfo(rpc, hash)
 	if err != nil {
-		fmt.Println("Error getting info for confirmation height:", err)
+		logger.Error("error getting info for confirmation height", "error", err)
 	}
 	d := json.NewDecoder(strings.NewReader(string(blockReturn)))
 	d.Decode(&blockInfo)
@@ -72,24 +73,73 @@ func getConfirmationHeight(rpc nanostructs.NanoRPC, hash string) string {
 	return blockInfo.Height
 }
 
-func convertPaymentAmounts(expected string, received string) (*big.Int, *big.Int) {
+func oldBlock(rpc nanostructs.NanoRPC, logger *slog.Logger, hash string, sendingAddress string) bool {
+	//oldBlock reports whether a block is older than the most recent 5% of the sending account's confirmed
+	//blocks, such as a confirmation replayed by the node, so it can't be a payment to a new request.
+	confBlockReturn := getConfirmationHeight(rpc, logger, hash)
+	confAccountReturn, countErr := nano.AccountInformation(rpc, sendingAddress, nil)
+	if countErr != nil {
+		logger.Error("error getting the block count to invalidate old blocks", "error", countErr)
+	}
+
+	confHeightBlock, heightErr := strconv.Atoi(confBlockReturn)
+	if heightErr != nil {
+		logger.Error("error converting confirmation height", "error", heightErr)
+	}
+	accountHeight, _ := confAccountReturn["confirmation_height"].(string)
+	confHeightAccount, bcErr := strconv.Atoi(accountHeight)
+	if bcErr != nil {
+		logger.Error("error converting confirmation height", "error", bcErr)
+	}
+
+	return float64(confHeightBlock) < float64(confHeightAccount)*.95
+}
+
+func verifySend(st store.Store, rpc nanostructs.NanoRPC, logger *slog.Logger, policy structs.MerchantPolicy, destinationAddress string, hash string, workerID string) (bool, error) {
+	//verifySend reports whether the hash of a checkpointed request is a new send to the destination address
+	//credited to the worker, checked as a send seen on the websocket is before it is confirmed.  The hash is
+	//only reported invalid when the node answers for the block, a failure to ask is returned as an error.
+	blockInfo, err := fetchBlockInfo(rpc, hash)
+	if errors.Is(err, errBlockNotFound) {
+		logger.Warn("checkpointed hash is not a block", "error", err)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if blockInfo.Subtype != "send" || blockInfo.Contents.LinkAsAccount != destinationAddress {
+		logger.Warn("checkpointed hash is not a send to the address", "subtype", blockInfo.Subtype, "link_as_account", blockInfo.Contents.LinkAsAccount)
+		return false, nil
+	}
+	known, err := st.KnownHashes(destinationAddress, workerID)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving known/pending hashes from the store: %v", err)
+	}
+	if setPendingHashMap(known)[hash] || oldBlock(rpc, logger, hash, blockInfo.BlockAccount) {
+		logger.Warn("checkpointed hash existed before the request")
+		return false, nil
+	}
+	return ownsSend(st, logger, policy, destinationAddress, hash, blockInfo.Amount, workerID), nil
+}
+
+func convertPaymentAmounts(logger *slog.Logger, expected string, received string) (*big.Int, *big.Int) {
 	//convertPaymentAmounts will convert strings into big.Ints so there is no data loss in raw
 	expectedInt := new(big.Int)
 	receivedInt := new(big.Int)
 	if _, ok := expectedInt.SetString(expected, 10); !ok {
-		fmt.Println("error setting big int for expected")
+		logger.Error("error setting big int for expected", "amount", expected)
 	}
 	if _, ok := receivedInt.SetString(received, 10); !ok {
-		fmt.Println("error setting big int for received")
+		logger.Error("error setting big int for received", "amount", received)
 	}
 
 	return expectedInt, receivedInt
 }
 
-func calcDifference(amountComparison int, expected string, received string) *big.Int {
+func calcDifference(logger *slog.Logger, amountComparison int, expected string, received string) *big.Int {
 	//calcDifference returns the difference of the expected payment and the received payment
 	//This return is always positive.
-	expectedInt, receivedInt := convertPaymentAmounts(expected, received)
+	expectedInt, receivedInt := convertPaymentAmounts(logger, expected, received)
 	var difference *big.Int
 	if amountComparison == -1 {
 		difference = big.NewInt(0).Sub(receivedInt, expectedInt)
@@ -99,122 +149,156 @@ func calcDifference(amountComparison int, expected string, received string) *big
 	return difference
 }
 
-func sendConfirmation(confirming structs.Payment, destinationAddress string, pool *redis.Pool) {
-	//sendConfirmation converts a payment to a JSON string and publishes over redis.
-	confirmJSON, confirmErr := json.Marshal(confirming)
-	if confirmErr != nil {
-		fmt.Println("Error converting confirmation to JSON:", confirmErr)
+func withinTolerance(logger *slog.Logger, policy structs.MerchantPolicy, paymentRequest structs.PaymentRequest, amountComparison int, received string) bool {
+	//withinTolerance reports whether a payment that differs from the expected amount is close enough to
+	//count as paid, by the request's tolerance or else its merchant's.  A fiat request accepts the price
+	//slippage instead when that is larger.
+	spec := policy.Tolerance
+	if paymentRequest.Tolerance != "" {
+		spec = paymentRequest.Tolerance
 	}
-	confirmC := pool.Get()
-	_, err := confirmC.Do("PUBLISH", fmt.Sprintf("payment.%s", destinationAddress), string(confirmJSON))
+	tolerance, err := structs.ParseTolerance(spec)
 	if err != nil {
-		fmt.Println("Error posting payment confirmation", err)
+		logger.Warn("ignoring invalid tolerance, the exact amount is required", "error", err)
+	}
+
+	expectedInt, _ := convertPaymentAmounts(logger, paymentRequest.Amount, received)
+	allowed := tolerance.Allowance(expectedInt)
+	if paymentRequest.Rate != "" {
+		if slippage := structs.PercentTolerance(policy.PriceSlippageBps).Allowance(expectedInt); slippage.Cmp(allowed) > 0 {
+			allowed = slippage
+		}
 	}
-	confirmC.Close()
+	return calcDifference(logger, amountComparison, paymentRequest.Amount, received).Cmp(allowed) <= 0
 }
 
-func parseWebhookMessage(message []byte) bb.WebsocketMessage {
-	//parseWebhookMessage converts the webhook message sent from the Nano node to a WebsocketMessage struct.
-	var websocketJSON bb.WebsocketMessage
-	d := json.NewDecoder(strings.NewReader(string(message)))
-	d.Decode(&websocketJSON)
+func requestPayment(paymentRequest structs.PaymentRequest, workerID string) structs.Payment {
+	//requestPayment returns a payment record with the details of the request, including the locked rate of
+	//a fiat request.
+	var payment structs.Payment
+	payment.DestinationAddress = paymentRequest.DestinationAddress
+	payment.ExpectedAmount = paymentRequest.Amount
+	payment.WorkerID = workerID
+	payment.FiatAmount = paymentRequest.FiatAmount
+	payment.Currency = paymentRequest.Currency
+	payment.Rate = paymentRequest.Rate
+	return payment
+}
 
-	return websocketJSON
+func sendConfirmation(confirming structs.Payment, destinationAddress string, st store.Store, wire codec.Codec, logger *slog.Logger) {
+	//sendConfirmation encodes a payment in the configured wire format and appends it to the payment events for
+	//the destination address.
+	confirmation, confirmErr := wire.EncodePayment(confirming)
+	if confirmErr != nil {
+		logger.Error("error encoding confirmation", "error", confirmErr, "content_type", wire.ContentType())
+	}
+	err := st.Append(store.PaymentStream(destinationAddress), confirmation)
+	if err != nil {
+		logger.Error("error posting payment confirmation", "error", err)
+	}
 }
 
-func markConfirming(pool *redis.Pool, hash string, destinationAddress string) {
+func markConfirming(st store.Store, logger *slog.Logger, destinationAddress string, workerID string) {
 	//markConfirming sets the key of the worker to "confirming".  Used to prevent prematurely closing payment's
 	//status as failed while a transaction is still pending.
-	confC := pool.Get()
-	_, confErr := confC.Do("SET", fmt.Sprintf("confirming/%s", destinationAddress), "confirming")
-	if confErr != nil {
-		fmt.Println("Error marking the block as confirming.")
+	if confErr := st.MarkConfirming(destinationAddress, workerID); confErr != nil {
+		logger.Error("error marking the block as confirming", "error", confErr)
 	}
 }
 
-func setWorkerStatus(status string, workerID string, pool *redis.Pool) {
-	//setWorkerStatus sets a status in redis to allow for status checks of a specific worker.
-	statusC := pool.Get()
-	_, delErr := statusC.Do("DEL", fmt.Sprintf("status/%s", workerID))
-	if delErr != nil {
-		fmt.Println("Error clearing the worker status:", delErr)
+func setWorkerStatus(status string, workerID string, st store.Store, logger *slog.Logger) {
+	//setWorkerStatus sets a status in the store to allow for status checks of a specific worker.
+	if statusErr := st.SetStatus(workerID, status); statusErr != nil {
+		logger.Error("error updating the worker status", "error", statusErr)
 	}
-	_, statusErr := statusC.Do("SET", fmt.Sprintf("status/%s", workerID), status)
-	if statusErr != nil {
-		fmt.Println("Error updating the worker status:", statusErr)
+	metrics.WorkerStatus(workerID, status)
+	logger.Info("set the worker status", "status", status)
+}
+
+func cancelWorker(st store.Store, logger *slog.Logger, workerID string) {
+	//cancelWorker publishes to the cancel channel of the worker to stop its pending poll.
+	if err := st.Publish(store.CancelChannel(workerID), "true"); err != nil {
+		logger.Error("error publishing cancel event", "error", err)
 	}
-	fmt.Printf("Set the worker status for worker %s to %s\n", workerID, status)
 }
 
-func pollPending(paymentRequest structs.PaymentRequest, rpc nanostructs.NanoRPC, hashCheck map[string]bool, pool *redis.Pool, workerID string) {
+func pollPending(paymentRequest structs.PaymentRequest, policy structs.MerchantPolicy, rpc nanostructs.NanoRPC, hashCheck map[string]bool, st store.Store, lc *Lifecycle, logger *slog.Logger, found chan<- string, cancelled chan<- struct{}, done <-chan struct{}, timeout time.Duration, workerID string) {
 	//pollPending will periodically poll the RPC for new pending blocks for a provided account.  If there is a completed
-	//transaction in the meantime, it will cancel.
-	pendingC := pool.Get()
-	fmt.Printf("subscribing to cancel/%s\n", workerID)
-	psc := redis.PubSubConn{Conn: pendingC}
-	if err := psc.Subscribe(fmt.Sprintf("cancel/%s", workerID)); err != nil {
-		fmt.Println("Error subscribing to cancellations:", err)
-	}
-	if err := psc.Subscribe(fmt.Sprintf("resetPending/%s", workerID)); err != nil {
-		fmt.Println("Error subscribing to resetPending:", err)
+	//transaction in the meantime, or the request worker has finished, it will cancel.  A cancel published while the
+	//request worker is still waiting is passed on to it on cancelled.
+	plog := logging.Payment(logger, workerID, paymentRequest.DestinationAddress, "")
+	plog.Debug("subscribing to cancellations", "channel", store.CancelChannel(workerID))
+	sub, err := st.Subscribe(store.CancelChannel(workerID), store.ResetPendingChannel(workerID))
+	if err != nil {
+		plog.Error("error subscribing to cancellations", "error", err)
+		return
 	}
+	defer sub.Close()
 
-	cancelChan := make(chan bool)
+	// Buffered so the cancel is not blocked if the timer check has already returned
+	cancelChan := make(chan bool, 1)
 
-	go pendingTimerCheck(pool, paymentRequest, hashCheck, cancelChan, workerID, rpc)
+	lc.track(workerID, func() {
+		pendingTimerCheck(st, logger, paymentRequest, policy, hashCheck, found, cancelChan, timeout, workerID, rpc)
+	})
 
 	for {
-		switch v := psc.ReceiveWithTimeout(time.Duration(20 * time.Second)).(type) {
-		case redis.Message:
-			if v.Channel == fmt.Sprintf("cancel/%s", workerID) {
+		select {
+		case v, ok := <-sub.Messages():
+			if !ok {
 				cancelChan <- true
 				return
 			}
+			if v.Channel == store.CancelChannel(workerID) {
+				select {
+				case cancelled <- struct{}{}:
+				default:
+				}
+				cancelChan <- true
+				return
+			}
+		case <-done:
+			cancelChan <- true
+			return
 		}
 	}
 }
 
-func pendingTimerCheck(pool *redis.Pool, paymentRequest structs.PaymentRequest, hashCheck map[string]bool, cancelChan chan bool, workerID string, rpc nanostructs.NanoRPC) {
+func pendingTimerCheck(st store.Store, logger *slog.Logger, paymentRequest structs.PaymentRequest, policy structs.MerchantPolicy, hashCheck map[string]bool, found chan<- string, cancelChan chan bool, timeout time.Duration, workerID string, rpc nanostructs.NanoRPC) {
 	//pendingTimerCheck is a non-blocking goroutine which will periodically check for new pending hashes for a provided
-	//account.
-	var confirming structs.Payment
+	//account until the payment request times out.  The first new hash is handed to the request worker on found,
+	//skipping those credited to other requests to the address.
+	plog := logging.Payment(logger, workerID, paymentRequest.DestinationAddress, "")
+	others := make(map[string]bool)
 
-	timerC := pool.Get()
 	pendingTimer := time.NewTicker(5 * time.Second)
+	defer pendingTimer.Stop()
 	created := time.Now()
 	for {
 		select {
 		case <-cancelChan:
-			fmt.Println("Cancelling")
-			pendingTimer.Stop()
+			plog.Debug("cancelling pending poll")
 			return
 		case <-pendingTimer.C:
-			_, err := timerC.Do("PUBLISH", fmt.Sprintf("resetPending/%s", workerID), true)
+			err := st.Publish(store.ResetPendingChannel(workerID), "true")
 			if err != nil {
-				fmt.Println("Error publishing cancel event:", err)
+				plog.Error("error publishing reset pending event", "error", err)
 			}
-			pending := getPendingBlocks(rpc, paymentRequest.DestinationAddress)
+			pending := getPendingBlocks(rpc, plog, paymentRequest.DestinationAddress)
 
 			for _, b := range pending.Blocks {
-				if _, ok := hashCheck[b]; !ok {
-					fmt.Println("Found new pending block:", b)
-
-					confirming.DestinationAddress = paymentRequest.DestinationAddress
-					confirming.Status = "confirming"
-					confirming.Hash = b
-					confirming.WorkerID = workerID
-					sendConfirmation(confirming, paymentRequest.DestinationAddress, pool)
-					setWorkerStatus("confirming", paymentRequest.WorkerID, pool)
-
-					nano.BlockConfirm(rpc, b)
-					hashCheck[b] = true
-					markConfirming(pool, b, paymentRequest.DestinationAddress)
-					go PaymentConfirmationWorker(pool, b, paymentRequest, workerID)
-					return
+				if _, ok := hashCheck[b]; ok || others[b] {
+					continue
 				}
+				if !ownsSend(st, plog, policy, paymentRequest.DestinationAddress, b, getBlockInfo(rpc, plog, b).Amount, workerID) {
+					others[b] = true
+					continue
+				}
+				found <- b
+				return
 			}
 			now := time.Now()
-			if now.Sub(created) >= (20 * time.Second) {
+			if now.Sub(created) >= timeout {
 				return
 			}
 		}
@@ -223,123 +307,184 @@ func pendingTimerCheck(pool *redis.Pool, paymentRequest structs.PaymentRequest,
 
 }
 
-func compareAmounts(expected string, received string) int {
+func compareAmounts(logger *slog.Logger, expected string, received string) int {
 	//compareAmounts converts strings to bigInts and returns which is larger.
-	expectedInt := new(big.Int)
-	receivedInt := new(big.Int)
-	if _, ok := expectedInt.SetString(expected, 10); !ok {
-		fmt.Println("error setting big int for expected")
-	}
-	if _, ok := receivedInt.SetString(received, 10); !ok {
-		fmt.Println("error setting big int for received")
-	}
+	expectedInt, receivedInt := convertPaymentAmounts(logger, expected, received)
 
 	comparison := expectedInt.Cmp(receivedInt)
 
 	return comparison
 }
 
-//PaymentRequestWorker will monitor the websocket for confirmation messages.
+//PaymentRequestWorker will monitor the confirmations routed by the dispatcher for the destination address.
 //If a confirmation comes in with the destination address, it will double check confirmation status
 //and ensure the amount is the same as the expected amount.  If the transaction is pending, it will
-//return a confirming status and start a paymentconfirmationworker to process.
-func PaymentRequestWorker(pool *redis.Pool, paymentRequest structs.PaymentRequest, workerID string) {
-	config := structs.LoadConfig()
-
-	rpc := nanostructs.NanoRPC{Host: config.RPCHost, Port: config.RPCPort}
-	c := pool.Get()
-	psc := redis.PubSubConn{Conn: c}
+//return a confirming status and start a paymentconfirmationworker to process.  A request checkpointed
+//while confirming goes straight back to confirming its validation hash, once the hash is verified to be a
+//new send to the address credited to the request, which is retried while the node can't be asked.  A
+//hash the node reports invalid is dropped and the request watches the address again.
+//On shutdown the request is checkpointed back to the queue.  Every line is logged with the worker ID,
+//destination address and, once known, the block hash.  The request times out after its merchant
+//policy's timeout, or ends as cancelled when its cancel channel is published to before a payment is seen.
+func PaymentRequestWorker(st store.Store, d *dispatcher.Dispatcher, lc *Lifecycle, logger *slog.Logger, config structs.Config, paymentRequest structs.PaymentRequest, workerID string) {
+	policy := config.Policy(paymentRequest.Merchant, paymentRequest.DestinationAddress)
+	requestTimeout := time.Duration(policy.TimeoutDuration) * time.Second
+
+	plog := logging.Payment(logger, workerID, paymentRequest.DestinationAddress, "")
+	rpc := nanostructs.NanoRPC{Host: config.RPCHost, Port: config.RPCPort, Logger: plog}
+	wire := codec.For(config.WireFormat)
+	defer releaseAmount(st, plog, policy, paymentRequest, workerID)
+
+	metrics.WorkerStarted(workerID)
+
+	if paymentRequest.ValidationHash != "" {
+		hlog := logging.Payment(logger, workerID, paymentRequest.DestinationAddress, paymentRequest.ValidationHash)
+		hrpc := rpc
+		hrpc.Logger = hlog
+		verified, err := verifySend(st, hrpc, hlog, policy, paymentRequest.DestinationAddress, paymentRequest.ValidationHash, workerID)
+		// While the node can't be asked the hash is kept, as watching again would record the send as known
+		for err != nil {
+			hlog.Warn("error verifying the checkpointed hash, retrying", "error", err)
+			select {
+			case <-lc.Checkpoint():
+				checkpoint(st, wire, hlog, paymentRequest, workerID, paymentRequest.ValidationHash)
+				return
+			case <-time.After(5 * time.Second):
+			}
+			verified, err = verifySend(st, hrpc, hlog, policy, paymentRequest.DestinationAddress, paymentRequest.ValidationHash, workerID)
+		}
+		if verified {
+			setWorkerStatus("confirming", workerID, st, hlog)
+			markConfirming(st, hlog, paymentRequest.DestinationAddress, workerID)
+			PaymentConfirmationWorker(st, d, lc, logger, config, paymentRequest.ValidationHash, paymentRequest, workerID)
+			return
+		}
+		// The checkpointing processor left the request marked as confirming the hash
+		hlog.Warn("ignoring the checkpointed hash, watching the address again")
+		if err := st.ClearConfirming(paymentRequest.DestinationAddress, workerID); err != nil {
+			hlog.Error("error clearing the confirming flag", "error", err)
+		}
+		paymentRequest.ValidationHash = ""
+	}
 
-	setWorkerStatus("pending", workerID, pool)
+	setWorkerStatus("pending", workerID, st, plog)
 
-	if err := psc.Subscribe("nano-websocket-confirmations"); err != nil {
-		fmt.Println("Error subscribing to nano-websocket-confirmations:", err)
-	}
+	sub := d.SubscribeAccount(paymentRequest.DestinationAddress)
+	defer sub.Close()
 
 	// We record the known blocks for the account to prevent false credit for payments
-	hashes := getKnownBlocks(pool, paymentRequest.DestinationAddress)
+	hashes := getKnownBlocks(st, rpc, plog, paymentRequest.DestinationAddress, workerID)
 	hashCheck := setPendingHashMap(hashes)
 
+	// Only now is the request eligible for sends to the address, which are each credited to one request
+	if err := st.Watch(paymentRequest.DestinationAddress, workerID, paymentRequest.Amount); err != nil {
+		plog.Error("error watching the address", "error", err)
+	}
+	defer st.Unwatch(paymentRequest.DestinationAddress, workerID)
+
 	// Set a poll to check to see if there are any active pending blocks that don't pass through the websocket
-	go pollPending(paymentRequest, rpc, hashCheck, pool, workerID)
+	found := make(chan string, 1)
+	cancelled := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	lc.track(workerID, func() {
+		pollPending(paymentRequest, policy, rpc, hashCheck, st, lc, logger, found, cancelled, done, requestTimeout, workerID)
+	})
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
 
 	for {
-		switch v := psc.ReceiveWithTimeout(time.Duration(20 * time.Second)).(type) {
-		case redis.Message:
-			if v.Channel == "nano-websocket-confirmations" {
-				websocketJSON := parseWebhookMessage(v.Data)
-
-				// Check if the block is a send to the destination account
-				if websocketJSON.Message.Block.Subtype == "send" && websocketJSON.Message.Block.LinkAsAccount == paymentRequest.DestinationAddress {
-					confBlockReturn := getConfirmationHeight(rpc, websocketJSON.Message.Hash)
-					// We retrieve the confirmation height of the sending account to see if the received block is old.
-					// It must be in the most recent 5% of blocks to be accepted.
-					confAccountReturn, countErr := nano.AccountInformation(rpc, websocketJSON.Message.Account, nil)
-					if countErr != nil {
-						fmt.Println("Error getting the block count to invalidate old blocks:", countErr)
-					}
-
-					confHeightBlock, heightErr := strconv.Atoi(confBlockReturn)
-					if heightErr != nil {
-						fmt.Println("Error converting confirmation height:", heightErr)
-					}
-					confHeightAccount, bcErr := strconv.Atoi(string(confAccountReturn["confirmation_height"].(string)))
-					if bcErr != nil {
-						fmt.Println("Error converting confirmation height:", bcErr)
-					}
-
-					blockAgeCheck := float64(confHeightAccount) * .95
-
-					if _, ok := hashCheck[websocketJSON.Message.Hash]; !ok && float64(confHeightBlock) >= blockAgeCheck {
-						fmt.Printf("Hash %s didn't exist in pending or account history\n", websocketJSON.Message.Hash)
-						fmt.Println("received amount:", websocketJSON.Message.Amount)
-						fmt.Println("expected amount:", paymentRequest.Amount)
-						processPaymentMessage(pool, paymentRequest, websocketJSON.Message.Amount, websocketJSON.Message.Hash, websocketJSON.Message.Account, workerID)
-					} else {
-						fmt.Printf("Hash %s existed\n", websocketJSON.Message.Hash)
-					}
-					cancelC := pool.Get()
-					cancelC.Do("PUBLISH", fmt.Sprintf("cancel/%s", workerID), true)
-					return
+		select {
+		case websocketJSON := <-sub.C:
+			// Check if the block is a send to the destination account
+			if websocketJSON.Message.Block.Subtype == "send" && websocketJSON.Message.Block.LinkAsAccount == paymentRequest.DestinationAddress {
+				metrics.BlockSeen(workerID)
+				hash := websocketJSON.Message.Hash
+				hlog := logging.Payment(logger, workerID, paymentRequest.DestinationAddress, hash)
+				hrpc := rpc
+				hrpc.Logger = hlog
+
+				// Blocks that existed before the request, such as confirmations replayed by the node, are not payments
+				if _, ok := hashCheck[hash]; ok || oldBlock(hrpc, hlog, hash, websocketJSON.Message.Account) {
+					hlog.Info("hash existed")
+					continue
 				}
-				if v.Channel == fmt.Sprintf("cancel/%s", workerID) {
-					return
+				// A shared address also receives the payments of other requests
+				if !ownsSend(st, hlog, policy, paymentRequest.DestinationAddress, hash, websocketJSON.Message.Amount, workerID) {
+					continue
 				}
+				hlog.Info("hash didn't exist in pending or account history",
+					"received_amount", websocketJSON.Message.Amount,
+					"expected_amount", paymentRequest.Amount)
+				processPaymentMessage(st, wire, hlog, policy, paymentRequest, websocketJSON.Message.Amount, hash, websocketJSON.Message.Account, workerID)
+				cancelWorker(st, hlog, workerID)
+				return
 			}
-		case error:
-			confC := pool.Get()
-			defer confC.Close()
+		case hash := <-found:
+			// The pending poll found a block that didn't come through the websocket.  The confirmation worker
+			// decides the request from here, so payments arriving meanwhile are not taken.
+			sub.Close()
+			hlog := logging.Payment(logger, workerID, paymentRequest.DestinationAddress, hash)
+			hlog.Info("found new pending block")
+			metrics.BlockSeen(workerID)
+
+			var confirming structs.Payment
+			confirming.DestinationAddress = paymentRequest.DestinationAddress
+			confirming.Status = "confirming"
+			confirming.Hash = hash
+			confirming.WorkerID = workerID
+			sendConfirmation(confirming, paymentRequest.DestinationAddress, st, wire, hlog)
+			setWorkerStatus("confirming", workerID, st, hlog)
+
+			hrpc := rpc
+			hrpc.Logger = hlog
+			nano.BlockConfirm(hrpc, hash)
+			markConfirming(st, hlog, paymentRequest.DestinationAddress, workerID)
+			PaymentConfirmationWorker(st, d, lc, logger, config, hash, paymentRequest, workerID)
+			return
+		case <-cancelled:
+			// Cancelled by the merchant, such as through the gRPC API, before any payment was seen
+			payment := requestPayment(paymentRequest, workerID)
+
+			payment.Status = "error"
+			payment.ErrorCode = 3
+			payment.ErrorMessage = "Payment Request cancelled."
 
-			confReturn, confErr := redis.String(confC.Do("GET", fmt.Sprintf("confirming/%s", paymentRequest.DestinationAddress)))
+			sendConfirmation(payment, paymentRequest.DestinationAddress, st, wire, plog)
+			setWorkerStatus("cancelled", workerID, st, plog)
+			plog.Info("payment request cancelled")
+			return
+		case <-lc.Checkpoint():
+			// A block being confirmed is checkpointed by its confirmation worker
+			if confirming, _ := st.IsConfirming(paymentRequest.DestinationAddress, workerID); !confirming {
+				checkpoint(st, wire, plog, paymentRequest, workerID, "")
+			}
+			cancelWorker(st, plog, workerID)
+			return
+		case <-timeout.C:
+			confirming, confErr := st.IsConfirming(paymentRequest.DestinationAddress, workerID)
 			if confErr != nil {
-				fmt.Println("Error retrieving data from redis:", confErr)
+				plog.Error("error retrieving data from the store", "error", confErr)
 			}
-			fmt.Println("confReturn:", confReturn)
-			if confReturn != "confirming" {
-				var payment structs.Payment
+			if !confirming {
+				payment := requestPayment(paymentRequest, workerID)
 
 				payment.Status = "error"
 				payment.ErrorCode = 0
 				payment.ErrorMessage = "Payment Request reached time limit with no payment."
-				payment.DestinationAddress = paymentRequest.DestinationAddress
-				payment.ExpectedAmount = paymentRequest.Amount
 
-				sendConfirmation(payment, paymentRequest.DestinationAddress, pool)
-				setWorkerStatus("timeout", workerID, pool)
+				sendConfirmation(payment, paymentRequest.DestinationAddress, st, wire, plog)
+				setWorkerStatus("timeout", workerID, st, plog)
 
-				fmt.Printf("Timer expired, publishing to cancel/%s\n", workerID)
-				cancelC := pool.Get()
-				_, timeoutErr := cancelC.Do("PUBLISH", fmt.Sprintf("cancel/%s", workerID), true)
-				if timeoutErr != nil {
-					fmt.Println("Error sending timeout cancellation", timeoutErr)
-				}
+				plog.Info("timer expired, cancelling worker")
+				cancelWorker(st, plog, workerID)
 				return
 			}
 
-			fmt.Println("There's currently a block confirming.")
-			confC.Do("DEL", fmt.Sprintf("confirming/%s", paymentRequest.DestinationAddress))
-			cancelC := pool.Get()
-			cancelC.Do("PUBLISH", fmt.Sprintf("cancel/%s", workerID), true)
+			plog.Info("a block is currently confirming")
+			st.ClearConfirming(paymentRequest.DestinationAddress, workerID)
+			cancelWorker(st, plog, workerID)
 			return
 		}
 	}
@@ -0,0 +1,413 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"nano-pp/dispatcher"
+	"nano-pp/nanocurrency/fakenode"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+	"nano-pp/store/storetest"
+	"testing"
+	"time"
+)
+
+const (
+	merchant = "nano_1merchant"
+	customer = "nano_1customer"
+)
+
+//scenario is a payment request run against a fake node.  The ledger is set up by before and payments are
+//made by during once the worker is listening, each returning the hashes the expected events refer to.
+//The request has the tolerance, reported as report or else the default, and is resumed from a checkpoint
+//made while confirming the validation hash when one is given.
+type scenario struct {
+	name       string
+	timeout    int
+	tolerance  string
+	report     string
+	validation string
+	before     func(node *fakenode.Node) []string
+	during     func(t *testing.T, node *fakenode.Node, st store.Store, workerID string, hashes []string) []string
+	status     string
+	events     func(workerID string, hashes []string) []structs.Payment
+}
+
+func paid(status string, code int, message string, amount string) func(string, []string) []structs.Payment {
+	return func(workerID string, hashes []string) []structs.Payment {
+		return []structs.Payment{{
+			Status:             status,
+			Hash:               hashes[0],
+			ErrorCode:          code,
+			ErrorMessage:       message,
+			DestinationAddress: merchant,
+			SendingAddress:     customer,
+			ExpectedAmount:     "1000",
+			ValidatedAmount:    amount,
+			WorkerID:           workerID,
+		}}
+	}
+}
+
+func confirming(workerID string, hash string) structs.Payment {
+	return structs.Payment{Status: "confirming", Hash: hash, DestinationAddress: merchant, WorkerID: workerID}
+}
+
+func timedOut(workerID string, hashes []string) []structs.Payment {
+	return []structs.Payment{{
+		Status:             "error",
+		ErrorMessage:       "Payment Request reached time limit with no payment.",
+		DestinationAddress: merchant,
+		ExpectedAmount:     "1000",
+		WorkerID:           workerID,
+	}}
+}
+
+//confirmedSend sends amount raw to the merchant and confirms it on the websocket straight away.
+func confirmedSend(amount string) func(*testing.T, *fakenode.Node, store.Store, string, []string) []string {
+	return func(t *testing.T, node *fakenode.Node, st store.Store, workerID string, hashes []string) []string {
+		hash := node.Send(customer, merchant, amount)
+		node.Confirm(hash)
+		return []string{hash}
+	}
+}
+
+//waitStatus polls the worker status until it matches, failing the test after the deadline.
+func waitStatus(t *testing.T, st store.Store, workerID string, status string, deadline time.Duration) {
+	t.Helper()
+	end := time.Now().Add(deadline)
+	for {
+		got, _ := st.Status(workerID)
+		if got == status {
+			return
+		}
+		if time.Now().After(end) {
+			t.Fatalf("got status '%s' want '%s'", got, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+var scenarios = []scenario{
+	{
+		name:   "exact payment",
+		during: confirmedSend("1000"),
+		status: "success",
+		events: paid("success", 0, "", "1000"),
+	},
+	{
+		name:   "overpayment",
+		during: confirmedSend("2000"),
+		status: "overpayment",
+		events: paid("error", 1, "Overpayment of 1000 raw received", "2000"),
+	},
+	{
+		name:   "underpayment",
+		during: confirmedSend("500"),
+		status: "underpayment",
+		events: paid("error", 2, "Underpayment received, remaining balance of 500 raw owed.", "500"),
+	},
+	{
+		name:      "underpayment within tolerance",
+		tolerance: "1%",
+		during:    confirmedSend("995"),
+		status:    "success",
+		events: func(workerID string, hashes []string) []structs.Payment {
+			events := paid("success", 0, "", "995")(workerID, hashes)
+			events[0].Note = "Paid within tolerance, underpaid by 5 raw."
+			return events
+		},
+	},
+	{
+		name:      "overpayment within tolerance reported as an error",
+		tolerance: "10raw",
+		report:    "error",
+		during:    confirmedSend("1010"),
+		status:    "within_tolerance",
+		events:    paid("error", 4, "Paid within tolerance, overpaid by 10 raw.", "1010"),
+	},
+	{
+		name:       "checkpointed with a hash that is not a payment",
+		validation: "6B86B273FF34FCE19D6B804EFF5A3F5747ADA4EAA22F1D49C01E52DDB7875B4B",
+		during:     confirmedSend("1000"),
+		status:     "success",
+		events:     paid("success", 0, "", "1000"),
+	},
+	{
+		name:       "checkpointed with a hash that is not a payment and no payment",
+		timeout:    1,
+		validation: "6B86B273FF34FCE19D6B804EFF5A3F5747ADA4EAA22F1D49C01E52DDB7875B4B",
+		status:     "timeout",
+		events:     timedOut,
+	},
+	{
+		name:    "timeout",
+		timeout: 1,
+		status:  "timeout",
+		events:  timedOut,
+	},
+	{
+		name: "seen first by the pending poll",
+		during: func(t *testing.T, node *fakenode.Node, st store.Store, workerID string, hashes []string) []string {
+			// Not confirmed until the worker asks, so only the pending poll sees the block
+			node.ConfirmOnRequest(true)
+			return []string{node.Send(customer, merchant, "1000")}
+		},
+		status: "success",
+		events: func(workerID string, hashes []string) []structs.Payment {
+			return append([]structs.Payment{confirming(workerID, hashes[0])}, paid("success", 0, "", "1000")(workerID, hashes)...)
+		},
+	},
+	{
+		name: "seen first on the websocket",
+		during: func(t *testing.T, node *fakenode.Node, st store.Store, workerID string, hashes []string) []string {
+			hash := node.Send(customer, merchant, "1000")
+			time.Sleep(time.Second)
+			node.Confirm(hash)
+			return []string{hash}
+		},
+		status: "success",
+		events: paid("success", 0, "", "1000"),
+	},
+	{
+		name:    "old block replayed",
+		timeout: 2,
+		before: func(node *fakenode.Node) []string {
+			hash := node.Send(customer, merchant, "1000")
+			node.Confirm(hash)
+			node.Receive(hash)
+			return []string{hash}
+		},
+		during: func(t *testing.T, node *fakenode.Node, st store.Store, workerID string, hashes []string) []string {
+			node.Replay(hashes[0])
+			return nil
+		},
+		status: "timeout",
+		events: timedOut,
+	},
+	{
+		name: "payment while another is confirming",
+		during: func(t *testing.T, node *fakenode.Node, st store.Store, workerID string, hashes []string) []string {
+			first := node.Send(customer, merchant, "1000")
+			waitStatus(t, st, workerID, "confirming", 10*time.Second)
+			node.Confirm(node.Send("nano_1second", merchant, "500"))
+			node.Confirm(first)
+			return []string{first}
+		},
+		status: "success",
+		events: func(workerID string, hashes []string) []structs.Payment {
+			return append([]structs.Payment{confirming(workerID, hashes[0])}, paid("success", 0, "", "1000")(workerID, hashes)...)
+		},
+	},
+}
+
+func TestPaymentScenarios(t *testing.T) {
+	for i, sc := range scenarios {
+		sc := sc
+		workerID := fmt.Sprintf("scenario-%d", i)
+		t.Run(sc.name, func(t *testing.T) {
+			t.Parallel()
+			node := fakenode.New(t)
+			st, _, server := storetest.NewRedis(t, store.RedisOptions{})
+			node.Relay(t, st)
+
+			config := structs.DefaultConfig()
+			node.Configure(&config)
+			config.TimeoutDuration = 20
+			if sc.timeout > 0 {
+				config.TimeoutDuration = sc.timeout
+			}
+			if sc.report != "" {
+				config.ToleranceReport = sc.report
+			}
+
+			var hashes []string
+			if sc.before != nil {
+				hashes = sc.before(node)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			d := dispatcher.New(st, slog.Default())
+			go d.Run(stop)
+
+			lc := NewLifecycle(slog.Default(), 1)
+			if sc.validation != "" {
+				st.MarkConfirming(merchant, workerID)
+			}
+			request := structs.PaymentRequest{DestinationAddress: merchant, Amount: "1000", Tolerance: sc.tolerance, ValidationHash: sc.validation}
+			lc.Go(workerID, func() { PaymentRequestWorker(st, d, lc, slog.Default(), config, request, workerID) })
+
+			// Known blocks are recorded once the worker is listening for confirmations
+			waitStatus(t, st, workerID, "pending", 5*time.Second)
+			for node.Calls("pending") == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if sc.during != nil {
+				hashes = sc.during(t, node, st, workerID, hashes)
+			}
+
+			waitStatus(t, st, workerID, sc.status, 20*time.Second)
+			if !lc.Drain(15 * time.Second) {
+				t.Fatal("worker did not finish")
+			}
+			if status, _ := st.Status(workerID); status != sc.status {
+				t.Errorf("got final status '%s' want '%s'", status, sc.status)
+			}
+
+			entries, _ := server.Stream(store.PaymentStream(merchant))
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Values[1])
+			}
+			var want []string
+			for _, payment := range sc.events(workerID, hashes) {
+				event, _ := json.Marshal(payment)
+				want = append(want, string(event))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got events\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestResumeWhileNodeFails(t *testing.T) {
+	node := fakenode.New(t)
+	st, _, _ := storetest.NewRedis(t, store.RedisOptions{})
+	node.Relay(t, st)
+
+	config := structs.DefaultConfig()
+	node.Configure(&config)
+	config.TimeoutDuration = 20
+
+	stop := make(chan struct{})
+	defer close(stop)
+	d := dispatcher.New(st, slog.Default())
+	go d.Run(stop)
+
+	// The send was credited to the request and being confirmed when its processor checkpointed it
+	hash := node.Send(customer, merchant, "1000")
+	st.Watch(merchant, "worker", "1000")
+	st.AttributeSend(merchant, hash, "1000", config.Attribution)
+	st.Unwatch(merchant, "worker")
+	st.MarkConfirming(merchant, "worker")
+
+	node.Fail(true)
+	lc := NewLifecycle(slog.Default(), 1)
+	request := structs.PaymentRequest{DestinationAddress: merchant, Amount: "1000", ValidationHash: hash}
+	lc.Go("worker", func() { PaymentRequestWorker(st, d, lc, slog.Default(), config, request, "worker") })
+
+	// The hash is kept until the node answers, instead of the address being watched again
+	time.Sleep(time.Second)
+	if status, _ := st.Status("worker"); status == "pending" {
+		t.Fatal("the checkpointed hash was dropped while the node was failing")
+	}
+	node.Fail(false)
+	node.Confirm(hash)
+	waitStatus(t, st, "worker", "success", 15*time.Second)
+	if !lc.Drain(15 * time.Second) {
+		t.Fatal("worker did not finish")
+	}
+}
+
+func TestUniqueAmounts(t *testing.T) {
+	node := fakenode.New(t)
+	st, _, _ := storetest.NewRedis(t, store.RedisOptions{})
+	node.Relay(t, st)
+
+	config := structs.DefaultConfig()
+	node.Configure(&config)
+	config.TimeoutDuration = 20
+	config.Merchants = map[string]structs.MerchantPolicy{"shop": {Addresses: []string{merchant}, UniqueAmounts: true, Tolerance: "1000raw"}}
+	policy := config.Policy("", merchant)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	d := dispatcher.New(st, slog.Default())
+	go d.Run(stop)
+
+	// Two requests for the same amount watch the one address
+	lc := NewLifecycle(slog.Default(), 2)
+	amounts := make(map[string]string)
+	for _, workerID := range []string{"first", "second"} {
+		request := structs.PaymentRequest{DestinationAddress: merchant, Amount: "1000"}
+		tagged, err := TagAmount(st, policy, request, workerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Amount, amounts[workerID] = tagged, tagged
+		workerID := workerID
+		lc.Go(workerID, func() { PaymentRequestWorker(st, d, lc, slog.Default(), config, request, workerID) })
+		waitStatus(t, st, workerID, "pending", 5*time.Second)
+	}
+	if amounts["first"] == amounts["second"] {
+		t.Fatalf("both requests were tagged %s", amounts["first"])
+	}
+	for node.Calls("pending") < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Each send is credited to the request whose amount it matches only
+	node.Confirm(node.Send(customer, merchant, amounts["second"]))
+	waitStatus(t, st, "second", "success", 10*time.Second)
+	if status, _ := st.Status("first"); status != "pending" {
+		t.Errorf("got status '%s' for the other request want 'pending'", status)
+	}
+	// A send of the untagged amount is held by no request, so it is attributed to the one still watching
+	node.Confirm(node.Send(customer, merchant, "1000"))
+	waitStatus(t, st, "first", "success", 10*time.Second)
+
+	if !lc.Drain(15 * time.Second) {
+		t.Fatal("workers did not finish")
+	}
+	for workerID, amount := range amounts {
+		if owner, _ := st.AmountOwner(merchant, amount); owner != "" {
+			t.Errorf("amount of %s still held by '%s'", workerID, owner)
+		}
+	}
+}
+
+func TestSharedAddressAttribution(t *testing.T) {
+	node := fakenode.New(t)
+	st, _, _ := storetest.NewRedis(t, store.RedisOptions{})
+	node.Relay(t, st)
+
+	config := structs.DefaultConfig()
+	node.Configure(&config)
+	config.TimeoutDuration = 20
+
+	stop := make(chan struct{})
+	defer close(stop)
+	d := dispatcher.New(st, slog.Default())
+	go d.Run(stop)
+
+	// Two requests for the same amount watch the one address without unique amounts
+	lc := NewLifecycle(slog.Default(), 2)
+	request := structs.PaymentRequest{DestinationAddress: merchant, Amount: "1000"}
+	for _, workerID := range []string{"first", "second"} {
+		workerID := workerID
+		lc.Go(workerID, func() { PaymentRequestWorker(st, d, lc, slog.Default(), config, request, workerID) })
+		for watchers, _ := st.Watchers(merchant); len(watchers) == 0 || watchers[len(watchers)-1] != workerID; watchers, _ = st.Watchers(merchant) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The first send is credited to the older request only, and the second to the other
+	node.Confirm(node.Send(customer, merchant, "1000"))
+	waitStatus(t, st, "first", "success", 10*time.Second)
+	time.Sleep(200 * time.Millisecond)
+	if status, _ := st.Status("second"); status != "pending" {
+		t.Fatalf("got status '%s' for the second request want 'pending'", status)
+	}
+	node.Confirm(node.Send("nano_1second", merchant, "1000"))
+	waitStatus(t, st, "second", "success", 10*time.Second)
+
+	if !lc.Drain(15 * time.Second) {
+		t.Fatal("workers did not finish")
+	}
+	if watchers, _ := st.Watchers(merchant); len(watchers) != 0 {
+		t.Errorf("got watchers %v after the requests finished", watchers)
+	}
+}
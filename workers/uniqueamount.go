@@ -0,0 +1,80 @@
+package workers
+
+import (
+	"fmt"
+	"log/slog"
+	"math/big"
+	"math/rand"
+	structs "nano-pp/paymentstructs"
+	"nano-pp/store"
+)
+
+//maxTagAttempts is how many suffixes are tried before a request to a busy address is refused
+const maxTagAttempts = 64
+
+//TagAmount adds a suffix of 1 to unique_amount_range raw to the amount of a request to a merchant with
+//unique_amounts and reserves the tagged amount at the destination address for the worker.  Sends to an
+//address shared by several requests are then told apart by their exact amount.
+func TagAmount(st store.Store, policy structs.MerchantPolicy, paymentRequest structs.PaymentRequest, workerID string) (string, error) {
+	amount, ok := new(big.Int).SetString(paymentRequest.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return "", fmt.Errorf("amount must be a positive whole number of raw, got %q", paymentRequest.Amount)
+	}
+
+	attempts := policy.UniqueAmountRange
+	if attempts > maxTagAttempts {
+		attempts = maxTagAttempts
+	}
+	// Suffixes are tried from a random start, so concurrent requests rarely try the same ones
+	start := rand.Intn(policy.UniqueAmountRange)
+	for i := 0; i < attempts; i++ {
+		suffix := (start+i)%policy.UniqueAmountRange + 1
+		tagged := new(big.Int).Add(amount, big.NewInt(int64(suffix))).String()
+		reserved, err := st.ReserveAmount(paymentRequest.DestinationAddress, tagged, workerID)
+		if err != nil {
+			return "", fmt.Errorf("error reserving a unique amount: %v", err)
+		}
+		if reserved {
+			return tagged, nil
+		}
+	}
+	return "", fmt.Errorf("no unique amount is free at %s, too many requests to it are open", paymentRequest.DestinationAddress)
+}
+
+func ownsSend(st store.Store, logger *slog.Logger, policy structs.MerchantPolicy, destinationAddress string, hash string, amount string, workerID string) bool {
+	//ownsSend reports whether a new send of the amount to the destination address is for the worker.  With
+	//unique amounts it is the send of the amount the worker reserved.  Any other send, such as one of the
+	//untagged or a rounded amount, is attributed by the store to one of the requests watching the address
+	//by the merchant's attribution policy.
+	var owner string
+	var err error
+	if policy.UniqueAmounts {
+		owner, err = st.AmountOwner(destinationAddress, amount)
+	}
+	if err == nil && owner == "" {
+		owner, err = st.AttributeSend(destinationAddress, hash, amount, policy.Attribution)
+	}
+	if err != nil {
+		logger.Error("error finding the request the send is for", "error", err, "amount", amount)
+		return false
+	}
+	if owner != workerID {
+		logger.Info("send is not for this request", "amount", amount, "owner", owner)
+		return false
+	}
+	return true
+}
+
+func releaseAmount(st store.Store, logger *slog.Logger, policy structs.MerchantPolicy, paymentRequest structs.PaymentRequest, workerID string) {
+	//releaseAmount frees the unique amount of a finished request.  A request checkpointed for another
+	//processor keeps its amount.
+	if !policy.UniqueAmounts {
+		return
+	}
+	if status, _ := st.Status(workerID); !structs.Final(status) {
+		return
+	}
+	if err := st.ReleaseAmount(paymentRequest.DestinationAddress, paymentRequest.Amount, workerID); err != nil {
+		logger.Error("error releasing the unique amount", "error", err, "amount", paymentRequest.Amount)
+	}
+}